@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// adminTimeout is how long a connection to the admin socket gets to send its
+// command.
+const adminTimeout = 10 * time.Second
+
+const adminHelp = `players                    List everyone on the server
+kick <username> [reason]   Disconnect a player
+ban <username|ip> [reason] Keep a username, address or CIDR range off the server
+unban <username|ip>        Lift a ban
+bans                       List the bans
+mute <username>            Stop a player chatting and talking
+unmute <username>          Let a player chat and talk again
+say <message>              Send a message to everyone on the server`
+
+// adminDone says what a command did to the players it was run on.
+var adminDone = map[string]string{
+	"kick":   "Kicked",
+	"mute":   "Muted",
+	"unmute": "Unmuted",
+}
+
+// Admin runs one of the operator commands, as typed into the admin socket or
+// sent by an operator in an AdminCommand, and returns what it printed.
+func (s *Server) Admin(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return adminHelp, nil
+	}
+
+	name, args := args[0], args[1:]
+
+	reason := ""
+	if len(args) > 1 {
+		reason = strings.Join(args[1:], " ")
+	}
+
+	switch name {
+	case "help":
+		return adminHelp, nil
+	case "players":
+		var b strings.Builder
+
+		for _, p := range s.players() {
+			room := ""
+			if r := p.Room(); r != nil {
+				room = r.Opts.Name
+			}
+
+			fmt.Fprintf(&b, "%v\t%v\t%v\t%v\n", p.ID, p.Username, p.IP(), room)
+		}
+
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	case "kick", "mute", "unmute":
+		if len(args) == 0 {
+			return "", fmt.Errorf("Usage: %v <username>", name)
+		}
+
+		ps := s.playersNamed(args[0])
+		if len(ps) == 0 {
+			return "", ErrPlayerDoesntExist
+		}
+
+		for _, p := range ps {
+			r := p.Room()
+			if r == nil {
+				continue
+			}
+
+			switch name {
+			case "kick":
+				if reason == "" {
+					reason = "Kicked by an operator."
+				}
+
+				r.Kick(p.ID, reason)
+			case "mute", "unmute":
+				r.Mute(p.ID, name == "mute")
+			}
+		}
+
+		return fmt.Sprintf("%v %v", adminDone[name], plural(len(ps), "player")), nil
+	case "ban":
+		if len(args) == 0 {
+			return "", fmt.Errorf("Usage: ban <username|ip> [reason]")
+		}
+
+		b := Ban{Username: args[0], Reason: reason}
+		if isAddress(args[0]) {
+			b = Ban{IP: args[0], Reason: reason}
+		}
+
+		err := s.Ban(b)
+		if err != nil {
+			return "", err
+		}
+
+		return "Banned " + b.Target(), nil
+	case "unban":
+		if len(args) == 0 {
+			return "", fmt.Errorf("Usage: unban <username|ip>")
+		}
+
+		err := s.Unban(args[0])
+		if err != nil {
+			return "", err
+		}
+
+		return "Unbanned " + args[0], nil
+	case "say":
+		if len(args) == 0 {
+			return "", fmt.Errorf("Usage: say <message>")
+		}
+
+		s.Announce(strings.Join(args, " "))
+
+		return "Sent to " + plural(len(s.players()), "player"), nil
+	case "bans":
+		var b strings.Builder
+
+		for _, ban := range s.Bans.List() {
+			fmt.Fprintf(&b, "%v\t%v\t%v\n", ban.Target(), ban.At.Format(time.RFC3339), ban.Reason)
+		}
+
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	}
+
+	return "", ErrUnknownAdminCommand
+}
+
+func isAddress(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+
+	_, _, err := net.ParseCIDR(s)
+
+	return err == nil
+}
+
+func plural(n int, s string) string {
+	if n == 1 {
+		return fmt.Sprintf("%v %v", n, s)
+	}
+
+	return fmt.Sprintf("%v %vs", n, s)
+}
+
+func (s *Server) adminCommand(conn *ChildConn) error {
+	ac := AdminCommand{}
+
+	err := conn.Read(&ac)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, ac.PID)
+	if err != nil {
+		return err
+	}
+
+	if !s.Operator(p) {
+		return ErrNotOperator
+	}
+
+	conn.log().Printf("%q (%v) ran admin command %q", p.Username, p.ID, ac.Line)
+
+	out, err := s.Admin(ac.Line)
+	if err != nil {
+		return &ProtocolError{Code: ErrAdminFailed.Code, Message: err.Error()}
+	}
+
+	return conn.Send(AdminResultCmd, &AdminResult{Output: out})
+}
+
+// adminReply is what the admin socket writes back for each command.
+type adminReply struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// listenAdmin opens the admin socket, replacing one left behind by a server
+// which didn't shut down cleanly. Only the user running the server can
+// connect to it.
+func (s *Server) listenAdmin() error {
+	path := s.Opts.AdminSocket
+
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	return s.adminLn.set(ln)
+}
+
+// serveAdmin runs a command for every connection to the admin socket.
+func (s *Server) serveAdmin() error {
+	for {
+		conn, err := s.adminLn.ln.Accept()
+		if err != nil {
+			return s.adminLn.err(err)
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleAdmin(conn)
+		}()
+	}
+}
+
+func (s *Server) handleAdmin(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	command := strings.TrimSpace(line)
+	s.log.Printf("Admin socket ran %q", command)
+
+	ar := adminReply{}
+
+	ar.Output, err = s.Admin(command)
+	if err != nil {
+		ar.Error = err.Error()
+	}
+
+	json.NewEncoder(conn).Encode(&ar)
+}
+
+// DialAdmin runs a command on the server listening on the admin socket, and
+// returns what it printed.
+func DialAdmin(socket, command string) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	_, err = fmt.Fprintln(conn, command)
+	if err != nil {
+		return "", err
+	}
+
+	ar := adminReply{}
+
+	err = json.NewDecoder(conn).Decode(&ar)
+	if err != nil {
+		return "", err
+	}
+
+	if ar.Error != "" {
+		return ar.Output, errors.New(ar.Error)
+	}
+
+	return ar.Output, nil
+}
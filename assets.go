@@ -1,63 +1,305 @@
 package server
 
 import (
+	"crypto/tls"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAssetTimeout      = 30 * time.Second
+	DefaultMaxAssetTransfers = 64
 )
 
 type AssetServer struct {
 	Dir   http.Dir
 	Addr  string
 	Ready chan struct{}
+	TLS   *tls.Config // Nil for plaintext.
+
+	// Timeout is how long a connection has to send its key and receive the
+	// asset before it's dropped.
+	Timeout time.Duration
+
+	// MaxTransfers caps how many assets are sent at once. Connections over
+	// the limit are told the server is busy.
+	MaxTransfers int
+
+	// HTTP serves assets over HTTP, at /<key>, instead of the framed
+	// protocol. See ServeHTTP.
+	HTTP bool
+
+	// PublicURL is advertised to clients in place of the server's own
+	// address, for when assets sit behind a CDN.
+	PublicURL string
+
+	Metrics *Metrics // Counts and times transfers, if set.
 
-	l *log.Logger
+	manifest     *Manifest
+	generated    map[string]*generatedAsset // By key.
+	manifestLock sync.RWMutex
+
+	ln        listener
+	srv       *http.Server
+	transfers chan struct{}
+	wg        sync.WaitGroup
+	l         *log.Logger
 }
 
 func NewAssetServer(addr, dir string) *AssetServer {
-	return &AssetServer{
+	as := &AssetServer{
 		Addr:  addr,
 		Dir:   http.Dir(dir),
 		l:     log.New(os.Stdout, "assets: ", logFlags),
 		Ready: make(chan struct{}),
+
+		Timeout:      DefaultAssetTimeout,
+		MaxTransfers: DefaultMaxAssetTransfers,
 	}
+
+	as.srv = &http.Server{Handler: as}
+
+	return as
 }
 
 func (as *AssetServer) Listen() error {
-	ln, err := net.Listen(ConnectionType, as.Addr)
+	ln, err := listen(as.Addr, as.TLS)
 	if err != nil {
 		return err
 	}
 
+	err = as.ln.set(ln)
+	if err != nil {
+		return err
+	}
+
+	if as.Manifest() == nil {
+		err = as.Scan()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	as.transfers = make(chan struct{}, as.MaxTransfers)
+
 	go func() { as.Ready <- struct{}{} }()
 
+	if as.HTTP {
+		// Large assets can take a while, so only the request has to
+		// arrive within the timeout.
+		as.srv.ReadHeaderTimeout = as.Timeout
+
+		err = as.srv.Serve(ln)
+		if err == http.ErrServerClosed {
+			return ErrServerClosed
+		}
+
+		return as.ln.err(err)
+	}
+
+	// Let transfers which are already going finish before returning.
+	defer as.wg.Wait()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			return err // Probably shouldn't break the server here...
+			return as.ln.err(err)
 		}
 
-		c := &Conn{NConn: conn, log: as.l}
-		err = as.Handle(c)
-		if err != nil {
-			return err
-		}
+		as.wg.Add(1)
+		go func() {
+			defer as.wg.Done()
+			defer conn.Close()
+
+			c := &Conn{NConn: conn, MaxFrameSize: maxAssetKeySize, log: as.l}
+
+			if as.Timeout > 0 {
+				conn.SetDeadline(time.Now().Add(as.Timeout))
+			}
+
+			select {
+			case as.transfers <- struct{}{}:
+				defer func() { <-as.transfers }()
+			default:
+				as.Metrics.assetSent(ErrAssetServerBusy.Code, 0, time.Now())
+				c.SendError(ErrAssetServerBusy)
+				return
+			}
+
+			err := as.Handle(c)
+			if err != nil {
+				as.l.Println("Couldn't send asset:", err)
+			}
+		}()
+	}
+}
+
+// Close stops the asset server from accepting connections.
+func (as *AssetServer) Close() error {
+	as.srv.Close()
+
+	return as.ln.Close()
+}
+
+// Scan rebuilds the manifest from the files in Dir.
+func (as *AssetServer) Scan() error {
+	m, err := ScanAssets(string(as.Dir))
+	if err != nil {
+		return err
+	}
+
+	as.setManifest(m)
+
+	return nil
+}
+
+func (as *AssetServer) setManifest(m *Manifest) {
+	as.manifestLock.Lock()
+	as.manifest = m
+	as.manifestLock.Unlock()
+}
+
+// Manifest returns the assets found by the last Scan, or nil if there hasn't
+// been one.
+func (as *AssetServer) Manifest() *Manifest {
+	as.manifestLock.RLock()
+	defer as.manifestLock.RUnlock()
+
+	return as.manifest
+}
+
+// URL is the address clients should fetch assets from. HTTP servers give a
+// URL which keys are appended to, others just the host and port.
+func (as *AssetServer) URL() string {
+	if as.PublicURL != "" {
+		return as.PublicURL
+	}
+
+	if !as.HTTP {
+		return as.Addr
+	}
+
+	scheme := "http"
+	if as.TLS != nil {
+		scheme = "https"
 	}
+
+	return scheme + "://" + as.Addr + "/"
 }
 
+// Handle reads a key from the connection and sends back the asset, or an error
+// frame explaining why it can't.
 func (as *AssetServer) Handle(conn *Conn) error {
 	keyBuf, err := conn.ReadRaw()
 	if err != nil {
 		return err
 	}
 
+	start := time.Now()
 	key := keyBuf.String()
 
-	f, err := as.Dir.Open(key)
+	f, fi, _, err := as.open(key)
+	if pe, ok := err.(*ProtocolError); ok {
+		as.Metrics.assetSent(pe.Code, 0, start)
+		return conn.SendError(pe)
+	}
 	if err != nil {
+		as.Metrics.assetSent("error", 0, start)
 		return err
 	}
+	defer f.Close()
+
+	err = conn.SendRawSized(f, fi.Size())
+	if err != nil {
+		as.Metrics.assetSent("error", 0, start)
+		return err
+	}
+
+	as.Metrics.assetSent("ok", fi.Size(), start)
+
+	return nil
+}
+
+// open finds the asset with the key, which may be a hash. Missing and hidden
+// assets come back as protocol errors which can be passed on to the client.
+// The asset's manifest entry comes back too, unless the file has changed since
+// it was scanned, in which case it's only served by its key.
+func (as *AssetServer) open(key string) (http.File, os.FileInfo, *AssetInfo, error) {
+	hashed := strings.HasPrefix(key, HashKeyPrefix)
+
+	ai, known := as.Lookup(key)
+	if hashed {
+		if !known {
+			return nil, nil, nil, ErrAssetNotFound
+		}
+
+		key = ai.Key
+	}
+
+	if g := as.generatedAsset(key); g != nil {
+		if hashed && g.info.Hash != ai.Hash {
+			return nil, nil, nil, ErrAssetNotFound
+		}
+
+		return g.open(), g, &g.info, nil
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, nil, nil, ErrAssetForbidden
+		}
+	}
+
+	f, err := as.Dir.Open(key)
+	if os.IsNotExist(err) {
+		return nil, nil, nil, ErrAssetNotFound
+	}
+	if os.IsPermission(err) {
+		return nil, nil, nil, ErrAssetForbidden
+	}
+	if err != nil {
+		as.l.Printf("Couldn't open %q: %v", key, err)
+		return nil, nil, nil, ErrAssetNotFound
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+
+	if fi.IsDir() {
+		f.Close()
+		return nil, nil, nil, ErrAssetForbidden
+	}
+
+	if !known {
+		return f, fi, nil, nil
+	}
+
+	// Whatever goes out under a hash is cached for good, so it's always
+	// checked. Otherwise it's only worth it if the file looks different.
+	if hashed || fi.Size() != ai.Size || !fi.ModTime().Equal(ai.modTime) {
+		ok, err := hashMatches(f, ai.Hash)
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+
+		if !ok {
+			if hashed {
+				f.Close()
+				return nil, nil, nil, ErrAssetNotFound
+			}
+
+			return f, fi, nil, nil
+		}
+	}
 
-	return conn.SendRaw(f)
+	return f, fi, &ai, nil
 }
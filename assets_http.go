@@ -0,0 +1,250 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+func init() {
+	mime.AddExtensionType(".gsml", "text/xml; charset=utf-8")
+}
+
+// ServeHTTP serves the asset at /<key>. Responses carry an ETag and
+// Last-Modified so they can be cached, and support Range requests. Text based
+// assets are gzipped for clients which accept it, unless a range was asked
+// for.
+func (as *AssetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+
+	// There's no limit until Listen has been called, since ServeHTTP can be
+	// mounted on another server.
+	if as.transfers != nil {
+		select {
+		case as.transfers <- struct{}{}:
+			defer func() { <-as.transfers }()
+		default:
+			as.Metrics.assetSent(ErrAssetServerBusy.Code, 0, start)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, ErrAssetServerBusy.Message, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+
+	f, fi, ai, err := as.open(key)
+	if pe, ok := err.(*ProtocolError); ok {
+		as.Metrics.assetSent(pe.Code, 0, start)
+		http.Error(w, err.Error(), assetStatus(err))
+		return
+	}
+	if err != nil {
+		as.Metrics.assetSent("error", 0, start)
+		http.Error(w, err.Error(), assetStatus(err))
+		return
+	}
+	defer f.Close()
+
+	// What goes over the wire is counted, which may be compressed or only
+	// part of the asset.
+	mw := &meteredResponseWriter{ResponseWriter: w}
+	defer func() { as.Metrics.assetSent(mw.result(), mw.n, start) }()
+
+	w = mw
+
+	etag := fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+	var ctype string
+
+	if ai != nil {
+		etag = `"` + ai.Hash + `"`
+		ctype = ai.Type
+
+		// Whatever is behind a hash can never change.
+		if strings.HasPrefix(key, HashKeyPrefix) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+	} else {
+		ctype, err = contentType(key, f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", ctype)
+
+	if compressible(ctype) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Header.Get("Range") == "" && acceptsGzip(r) {
+			// The compressed body is a different representation, so it
+			// needs its own ETag.
+			etag = etag[:len(etag)-1] + `-gz"`
+
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.Close()
+
+			w = gw
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r, key, fi.ModTime(), f)
+}
+
+func assetStatus(err error) int {
+	switch err {
+	case ErrAssetNotFound:
+		return http.StatusNotFound
+	case ErrAssetForbidden:
+		return http.StatusForbidden
+	case ErrAssetServerBusy:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// contentType works out the asset's type from its extension, or from its
+// first few bytes if it hasn't got one, the same way http.ServeContent would.
+func contentType(key string, f io.ReadSeeker) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t, nil
+	}
+
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+
+	return http.DetectContentType(buf[:n]), err
+}
+
+// compressible guesses whether gzipping an asset is worth it from its type.
+// Images and the like are already compressed.
+func compressible(t string) bool {
+	return strings.HasPrefix(t, "text/") ||
+		strings.Contains(t, "xml") ||
+		strings.Contains(t, "json") ||
+		strings.Contains(t, "javascript")
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(strings.SplitN(enc, ";", 2)[0])
+
+		if enc == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// meteredResponseWriter counts the bytes written, and remembers the status,
+// for the metrics.
+type meteredResponseWriter struct {
+	http.ResponseWriter
+
+	code int
+	n    int64
+}
+
+func (w *meteredResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *meteredResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+
+	return n, err
+}
+
+// result labels the response the same way as the asset protocol's results.
+func (w *meteredResponseWriter) result() string {
+	switch {
+	case w.code == 0 || w.code < 300:
+		return "ok"
+	case w.code == http.StatusNotModified:
+		return "not_modified"
+	}
+
+	return "error"
+}
+
+// gzipResponseWriter compresses successful responses. Anything else, such as
+// a 304, goes out untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	gz      *gzip.Writer
+	skip    bool
+	written bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.written {
+		return
+	}
+
+	w.written = true
+
+	if code == http.StatusOK {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+	} else {
+		w.skip = true
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.skip {
+		return w.ResponseWriter.Write(p)
+	}
+
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	return w.gz.Write(p)
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+
+	return w.gz.Close()
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator decides whether a client may join with the credential in its
+// ConnectRequest. The error it returns is shown to the client, so it should
+// explain what went wrong without giving too much away.
+type Authenticator interface {
+	Authenticate(username, credential string) error
+}
+
+// UserAuthenticator is an Authenticator which checks a credential of each
+// user's own rather than one they all share, so the usernames it lets in can
+// be trusted. Servers need one to have Operators.
+type UserAuthenticator interface {
+	Authenticator
+	IdentifiesUsers() bool
+}
+
+func identifiesUsers(a Authenticator) bool {
+	ua, ok := a.(UserAuthenticator)
+	return ok && ua.IdentifiesUsers()
+}
+
+type AuthenticatorFunc func(username, credential string) error
+
+func (f AuthenticatorFunc) Authenticate(username, credential string) error {
+	return f(username, credential)
+}
+
+// PasswordAuthenticator lets in anyone who knows the shared password.
+type PasswordAuthenticator struct {
+	Password string
+}
+
+func (a *PasswordAuthenticator) Authenticate(username, credential string) error {
+	if subtle.ConstantTimeCompare([]byte(a.Password), []byte(credential)) != 1 {
+		return ErrWrongPassword
+	}
+
+	return nil
+}
+
+// HtpasswdAuthenticator checks passwords against a file of username:hash
+// lines, where every hash is bcrypt, as written by `htpasswd -B`.
+type HtpasswdAuthenticator struct {
+	Path string
+
+	users map[string][]byte
+	lock  sync.RWMutex
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{Path: path}
+
+	return a, a.Reload()
+}
+
+// Reload reads the file again, for when users have been added or removed.
+func (a *HtpasswdAuthenticator) Reload() error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(l, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return fmt.Errorf("%v:%v: expected username:bcrypt-hash", a.Path, line)
+		}
+
+		users[parts[0]] = []byte(parts[1])
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	a.users = users
+	a.lock.Unlock()
+
+	return nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username, credential string) error {
+	a.lock.RLock()
+	hash, ok := a.users[username]
+	a.lock.RUnlock()
+
+	if !ok {
+		// Still do the work so unknown users take as long as known ones.
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(credential))
+		return ErrWrongPassword
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(credential)) != nil {
+		return ErrWrongPassword
+	}
+
+	return nil
+}
+
+func (a *HtpasswdAuthenticator) IdentifiesUsers() bool { return true }
+
+var (
+	dummy     []byte
+	dummyOnce sync.Once
+)
+
+// dummyHash is compared against for unknown users. It's made the first time
+// it's needed, so servers without an htpasswd file don't pay for it.
+func dummyHash() []byte {
+	dummyOnce.Do(func() {
+		dummy, _ = bcrypt.GenerateFromPassword([]byte("gnamma"), bcrypt.DefaultCost)
+	})
+
+	return dummy
+}
+
+// TokenAuthenticator accepts tokens issued by an external service which shares
+// the secret. See IssueToken for the format.
+type TokenAuthenticator struct {
+	Secret []byte
+}
+
+func (a *TokenAuthenticator) Authenticate(username, credential string) error {
+	parts := strings.SplitN(credential, ".", 2)
+	if len(parts) != 2 {
+		return ErrInvalidLoginToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidLoginToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signToken(a.Secret, payload)) {
+		return ErrInvalidLoginToken
+	}
+
+	// The username may contain colons but the expiry can't, so split on
+	// the last one.
+	i := strings.LastIndex(string(payload), ":")
+	if i < 0 || string(payload[:i]) != username {
+		return ErrInvalidLoginToken
+	}
+
+	expires, err := strconv.ParseInt(string(payload[i+1:]), 10, 64)
+	if err != nil {
+		return ErrInvalidLoginToken
+	}
+
+	if time.Now().Unix() > expires {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+func (a *TokenAuthenticator) IdentifiesUsers() bool { return true }
+
+// IssueToken creates a token for the username which expires at the given
+// time. Tokens are base64url("username:expiry-unix") + "." +
+// base64url(HMAC-SHA256(secret, "username:expiry-unix")).
+func IssueToken(secret []byte, username string, expires time.Time) string {
+	payload := []byte(fmt.Sprintf("%v:%v", username, expires.Unix()))
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signToken(secret, payload))
+}
+
+func signToken(secret, payload []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(payload)
+
+	return m.Sum(nil)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DefaultChatMaxLength = 500
+	DefaultChatRate      = 1
+	DefaultChatBurst     = 5
+	DefaultChatRadius    = 10
+)
+
+// Who a chat message goes to.
+const (
+	ChatRoom    = "room"    // Everyone in the sender's room.
+	ChatWhisper = "whisper" // Only the player it's to.
+	ChatNearby  = "nearby"  // Everyone whose head is within the chat radius of the sender's.
+)
+
+// ChatFilter can change or refuse what a player says before anyone sees it.
+// Returning a ProtocolError tells the player why, any other error refuses it
+// with ErrChatFiltered.
+type ChatFilter func(from *Player, text string) (string, error)
+
+// ChatOptions limit what players can say. The zero value uses the defaults,
+// without a filter.
+type ChatOptions struct {
+	MaxLength int // In characters.
+
+	// Rate is how many messages a second each player can send, with up to
+	// Burst at once.
+	Rate  float64
+	Burst int
+
+	Radius float64 // How far nearby chat carries.
+
+	Filter ChatFilter
+}
+
+func (o *ChatOptions) defaults() {
+	if o.MaxLength == 0 {
+		o.MaxLength = DefaultChatMaxLength
+	}
+
+	if o.Rate == 0 {
+		o.Rate = DefaultChatRate
+	}
+
+	if o.Burst == 0 {
+		o.Burst = DefaultChatBurst
+	}
+
+	if o.Radius == 0 {
+		o.Radius = DefaultChatRadius
+	}
+}
+
+// chatLimiter is a token bucket, refilled at the chat rate.
+type chatLimiter struct {
+	tokens float64
+	at     time.Time
+}
+
+func (l *chatLimiter) allow(now time.Time, rate float64, burst int) bool {
+	if l.at.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens = math.Min(float64(burst), l.tokens+now.Sub(l.at).Seconds()*rate)
+	}
+
+	l.at = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens -= 1
+
+	return true
+}
+
+// Chat checks what the player said and sends it on. It's how the server sends
+// chat on a player's behalf too.
+func (r *Room) Chat(p *Player, scope string, to uint, text string) error {
+	o := r.s.Opts.Chat
+
+	if p.Muted() {
+		return ErrMuted
+	}
+
+	text = strings.TrimSpace(strings.ToValidUTF8(text, "�"))
+	if text == "" {
+		return ErrChatEmpty
+	}
+
+	if utf8.RuneCountInString(text) > o.MaxLength {
+		return ErrChatTooLong
+	}
+
+	b := Broadcast{
+		Cmd:  ChatMessageCmd,
+		From: p.ID,
+	}
+
+	switch scope {
+	case ChatRoom:
+	case ChatWhisper:
+		if _, err := r.Player(to); err != nil {
+			return ErrChatNoRecipient
+		}
+
+		b.To = to
+	case ChatNearby:
+		h := p.Head()
+		if h == nil {
+			return ErrChatNoHead
+		}
+
+		b.around, b.within = h.Position, o.Radius
+	default:
+		return ErrChatUnknownScope
+	}
+
+	p.chatLock.Lock()
+	ok := p.chat.allow(time.Now(), o.Rate, o.Burst)
+	p.chatLock.Unlock()
+
+	if !ok {
+		return ErrChatTooFast
+	}
+
+	if o.Filter != nil {
+		var err error
+
+		text, err = o.Filter(p, text)
+		if _, ok := err.(*ProtocolError); ok {
+			return err
+		}
+		if err != nil {
+			return ErrChatFiltered
+		}
+	}
+
+	b.Com = &ChatMessage{
+		From:     p.ID,
+		Username: p.Username,
+		Scope:    scope,
+		To:       to,
+		Text:     text,
+	}
+
+	r.broadcast(b)
+
+	return nil
+}
+
+// nearby returns the players whose heads are within the radius of the point.
+func nearby(ps []*Player, around Point, radius float64) []*Player {
+	var out []*Player
+
+	for _, p := range ps {
+		h := p.Head()
+		if h != nil && h.Position.Distance(around) <= radius {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+func (r *Room) chat(conn *ChildConn) error {
+	c := Chat{}
+
+	err := conn.Read(&c)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, c.PID)
+	if err != nil {
+		return err
+	}
+
+	return r.Chat(p, c.Scope, c.To, c.Text)
+}
@@ -1,35 +1,88 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// voiceBuffer is how many frames of voice the client keeps waiting to be
+// played, which is a second of 20ms frames.
+const voiceBuffer = 50
+
 // Mainly for testing. Perhaps bots too? I don't know.
 type Client struct {
 	Addr       string
 	AssetsAddr string
 	Username   string
 
+	// TLS, if set, is used for both the game and asset servers.
+	TLS *tls.Config
+
+	// Credential is the password or token the server asks for, if any.
+	Credential string
+
+	// Room is the ID of the room to join when connecting, and is kept up to
+	// date as the client moves between rooms. Zero joins the default room.
+	Room uint
+
+	// Codec is the name of the wire codec the client would like to use, such
+	// as "binary". The server falls back to JSON if it doesn't know it.
+	Codec string
+
+	// Snapshots asks the server for a snapshot of the room every tick rather
+	// than an UpdateNode for every change. Read them with Snapshot.
+	Snapshots bool
+
+	// CacheDir keeps assets fetched with AssetByHash between sessions. Leave
+	// empty to always download them.
+	CacheDir string
+
+	// Entities are the ones in the room as of the client joining it.
+	Entities []Entity
+
 	// ReadSpeed is the amount of times the client should read the server.
 	ReadSpeed float64
 
 	player *Player
 	conn   *ComConn
 
-	chans map[string]chan *ChildConn
+	// Unreliable channel for node updates, nil if the server doesn't offer one.
+	udp        *net.UDPConn
+	udpToken   string
+	udpSeq     uint64
+	udpLastSeq map[[2]uint]uint64 // By player and node ID.
+	udpSeqLock sync.Mutex
+
+	voice chan VoiceFrame // Frames heard over the unreliable channel.
+
+	states map[uint64]map[NodeRef]NodeState // Rebuilt snapshots, by sequence.
+	latest uint64
+
+	chans     map[string]chan *ChildConn
+	chansLock sync.Mutex
 }
 
 func (c *Client) readLoop() {
 	for {
 		cc, err := c.conn.Read()
 		if err != nil {
+			// Whatever went wrong, the stream can't be picked back up.
 			c.conn.log().Println("Error in client read loop:", err)
-			continue
+			c.conn.Close()
+			return
 		}
 
 		go func(cc *ChildConn) {
@@ -39,6 +92,22 @@ func (c *Client) readLoop() {
 				return
 			}
 
+			// The server pings to measure the round trip, so answer
+			// straight away.
+			if com.Command == PingCmd {
+				pi := Ping{}
+
+				err = cc.Read(&pi)
+				if err == nil {
+					err = c.conn.Raw.Send(PongCmd, &Pong{Nonce: pi.Nonce})
+				}
+				if err != nil {
+					c.conn.log().Println("Couldn't answer ping:", err)
+				}
+
+				return
+			}
+
 			ch := c.populateChan(com.Command)
 
 			ch <- cc
@@ -53,6 +122,9 @@ func (c *Client) WaitFor(cmd string) *ChildConn {
 }
 
 func (c *Client) populateChan(cmd string) chan *ChildConn {
+	c.chansLock.Lock()
+	defer c.chansLock.Unlock()
+
 	ch, ok := c.chans[cmd]
 
 	if !ok {
@@ -72,7 +144,7 @@ func (c *Client) UpdateLoop() {
 
 	wait := time.Second / time.Duration(c.ReadSpeed)
 
-	for {
+	for !c.conn.Closed {
 		c.conn.Done()
 		time.Sleep(wait)
 	}
@@ -81,7 +153,7 @@ func (c *Client) UpdateLoop() {
 func (c *Client) setup() error {
 	c.chans = make(map[string]chan *ChildConn)
 
-	conn, err := net.Dial("tcp", c.Addr)
+	conn, err := dial(c.Addr, c.TLS)
 	if err != nil {
 		return err
 	}
@@ -103,8 +175,17 @@ func (c *Client) Connect() error {
 	}
 
 	cr := ConnectRequest{
-		Username: c.Username,
+		Username:   c.Username,
+		Credential: c.Credential,
+		Room:       c.Room,
+		Snapshots:  c.Snapshots,
+		Pings:      true, // The read loop answers them.
 	}
+
+	if c.Codec != "" {
+		cr.Codecs = []string{c.Codec, JSONCodecName}
+	}
+
 	err = c.conn.Send(ConnectRequestCmd, &cr)
 	if err != nil {
 		return err
@@ -117,7 +198,15 @@ func (c *Client) Connect() error {
 	}
 
 	if !cv.CanProceed {
-		return ErrClientRejected
+		return &RejectedError{Message: cv.Message}
+	}
+
+	c.Room = cv.RoomID
+	c.Entities = cv.Entities
+
+	codec, ok := CodecByName(cv.Codec)
+	if ok {
+		c.conn.Raw.SetCodec(codec)
 	}
 
 	c.player = &Player{
@@ -126,9 +215,163 @@ func (c *Client) Connect() error {
 		nodesMap: make(map[uint]*Node),
 	}
 
+	err = c.openUnreliable()
+	if err != nil {
+		c.conn.log().Println("Unreliable channel unavailable, staying on TCP:", err)
+	}
+
+	if c.AssetsAddr == "" {
+		_, err = c.AssetServer()
+		if err != nil {
+			c.conn.log().Println("Couldn't find the asset server:", err)
+		}
+	}
+
 	return nil
 }
 
+// AssetServer asks the server where assets should be fetched from, and uses
+// that from then on.
+func (c *Client) AssetServer() (string, error) {
+	if c.conn == nil {
+		return "", ErrClientNotConnected
+	}
+
+	err := c.conn.Send(AssetServerRequestCmd, &AssetServerRequest{})
+	if err != nil {
+		return "", err
+	}
+
+	aa := AssetServerAddress{}
+
+	err = c.ExpectAndRead(AssetServerAddressCmd, &aa)
+	if err != nil {
+		return "", err
+	}
+
+	c.AssetsAddr = resolveAddr(aa.Address, c.Addr)
+
+	return c.AssetsAddr, nil
+}
+
+func (c *Client) openUnreliable() error {
+	err := c.conn.Send(UnreliableRequestCmd, &UnreliableRequest{})
+	if err != nil {
+		return err
+	}
+
+	uc := UnreliableChannel{}
+	err = c.ExpectAndRead(UnreliableChannelCmd, &uc)
+	if err != nil || uc.Address == "" {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr(UnreliableConnectionType, resolveAddr(uc.Address, c.Addr))
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP(UnreliableConnectionType, nil, addr)
+	if err != nil {
+		return err
+	}
+
+	c.udp = conn
+	c.udpToken = uc.Token
+	c.udpLastSeq = make(map[[2]uint]uint64)
+	c.voice = make(chan VoiceFrame, voiceBuffer)
+
+	go c.unreliableReadLoop()
+
+	// Say hello so the server knows where to send updates.
+	return c.sendDatagram(Datagram{})
+}
+
+// sendDatagram fills in the token and the next sequence number, and sends the
+// datagram to the server.
+func (c *Client) sendDatagram(d Datagram) error {
+	d.Token = c.udpToken
+	d.Seq = atomic.AddUint64(&c.udpSeq, 1)
+
+	out, err := BinaryCodec.Marshal(&d)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.udp.Write(out)
+	return err
+}
+
+// SendVoice sends a frame of Opus encoded audio to everyone close enough to
+// hear it. It needs the unreliable channel.
+func (c *Client) SendVoice(data []byte) error {
+	if c.udp == nil {
+		return ErrNoUnreliableChannel
+	}
+
+	return c.sendDatagram(Datagram{Voice: &VoiceFrame{Data: data}})
+}
+
+// Voice returns the frames the client hears from other players, or nil if it
+// hasn't got an unreliable channel to hear them on.
+func (c *Client) Voice() <-chan VoiceFrame {
+	return c.voice
+}
+
+// unreliableReadLoop hands updates from the server to whoever is waiting for
+// them, just like the reliable read loop, dropping any that arrive late.
+func (c *Client) unreliableReadLoop() {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			c.conn.log().Println("Error in client unreliable read loop:", err)
+			return
+		}
+
+		d := Datagram{}
+
+		err = BinaryCodec.Unmarshal(buf[:n], &d)
+		if err != nil || d.Token != c.udpToken {
+			continue
+		}
+
+		if d.Voice != nil {
+			// Drop frames nobody is listening to rather than fall
+			// behind.
+			select {
+			case c.voice <- *d.Voice:
+			default:
+			}
+
+			continue
+		}
+
+		key := [2]uint{d.Update.PID, d.Update.NID}
+
+		c.udpSeqLock.Lock()
+		stale := d.Seq <= c.udpLastSeq[key]
+		if !stale {
+			c.udpLastSeq[key] = d.Seq
+		}
+		c.udpSeqLock.Unlock()
+
+		if stale {
+			continue
+		}
+
+		out, err := BinaryCodec.Marshal(&d.Update)
+		if err != nil {
+			continue
+		}
+
+		go func(cc *ChildConn) {
+			c.populateChan(UpdateNodeCmd) <- cc
+		}(NewChildConn(bytes.NewBuffer(out), BinaryCodec, c.conn))
+	}
+}
+
 func (c *Client) Ping() (Pong, error) {
 	po := Pong{}
 
@@ -145,6 +388,67 @@ func (c *Client) Ping() (Pong, error) {
 	return po, err
 }
 
+func (c *Client) Rooms() ([]RoomInfo, error) {
+	if c.conn == nil {
+		return nil, ErrClientNotConnected
+	}
+
+	err := c.conn.Send(ListRoomsCmd, &ListRooms{})
+	if err != nil {
+		return nil, err
+	}
+
+	rl := RoomList{}
+	err = c.ExpectAndRead(RoomListCmd, &rl)
+	return rl.Rooms, err
+}
+
+// JoinRoom moves the client into another room without reconnecting.
+func (c *Client) JoinRoom(id uint) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	err := c.conn.Send(JoinRoomCmd, &JoinRoom{RoomID: id})
+	if err != nil {
+		return err
+	}
+
+	return c.expectRoomVerdict()
+}
+
+// LeaveRoom moves the client back into the server's default room.
+func (c *Client) LeaveRoom() error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	err := c.conn.Send(LeaveRoomCmd, &LeaveRoom{})
+	if err != nil {
+		return err
+	}
+
+	return c.expectRoomVerdict()
+}
+
+func (c *Client) expectRoomVerdict() error {
+	rv := RoomVerdict{}
+
+	err := c.ExpectAndRead(RoomVerdictCmd, &rv)
+	if err != nil {
+		return err
+	}
+
+	if !rv.CanProceed {
+		return ErrClientRoomRejected
+	}
+
+	c.Room = rv.RoomID
+	c.Entities = rv.Entities
+
+	return nil
+}
+
 func (c *Client) Environment() (EnvironmentPackage, error) {
 	ep := EnvironmentPackage{}
 
@@ -162,7 +466,11 @@ func (c *Client) Environment() (EnvironmentPackage, error) {
 }
 
 func (c *Client) Asset(key string) (io.Reader, error) {
-	nc, err := net.Dial("tcp", c.AssetsAddr)
+	if strings.HasPrefix(c.AssetsAddr, "http://") || strings.HasPrefix(c.AssetsAddr, "https://") {
+		return c.httpAsset(key)
+	}
+
+	nc, err := dial(c.AssetsAddr, c.TLS)
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +486,73 @@ func (c *Client) Asset(key string) (io.Reader, error) {
 	return conn.ReadRaw()
 }
 
+// AssetByHash fetches the asset with the SHA-256 hash from the manifest,
+// using the cache if it's already there.
+func (c *Client) AssetByHash(hash string) (io.Reader, error) {
+	var cached string
+
+	if c.CacheDir != "" {
+		cached = filepath.Join(c.CacheDir, filepath.Base(hash))
+
+		b, err := ioutil.ReadFile(cached)
+		if err == nil && hashOf(b) == hash {
+			return bytes.NewReader(b), nil
+		}
+	}
+
+	r, err := c.Asset(HashKeyPrefix + hash)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if hashOf(b) != hash {
+		return nil, ErrAssetHashMismatch
+	}
+
+	if cached != "" {
+		err = ioutil.WriteFile(cached, b, 0644)
+		if err != nil {
+			log.Println("Couldn't cache asset:", err)
+		}
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+// httpAsset fetches an asset from an HTTP asset server, turning its status
+// codes back into the errors the framed protocol would have given.
+func (c *Client) httpAsset(key string) (io.Reader, error) {
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: c.TLS}}
+
+	res, err := hc.Get(strings.TrimSuffix(c.AssetsAddr, "/") + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrAssetNotFound
+	case http.StatusForbidden:
+		return nil, ErrAssetForbidden
+	case http.StatusServiceUnavailable:
+		return nil, ErrAssetServerBusy
+	default:
+		return nil, fmt.Errorf("Asset server responded with %v", res.Status)
+	}
+
+	buf := &bytes.Buffer{}
+
+	_, err = buf.ReadFrom(res.Body)
+	return buf, err
+}
+
 func (c *Client) RegisterNodes(nodes []*Node) error {
 	if c.conn == nil {
 		return ErrClientNotConnected
@@ -242,8 +617,10 @@ func (c *Client) RegisterNode(n *Node) error {
 	n.ID = rn.NID
 	n.PID = c.player.ID
 
+	c.player.nodesLock.Lock()
 	c.player.nodesMap[rn.NID] = n
 	c.player.nodeCount = rn.NID
+	c.player.nodesLock.Unlock()
 
 	return nil
 }
@@ -253,16 +630,296 @@ func (c *Client) UpdateNode(n Node) error {
 		return ErrClientNotConnected
 	}
 
-	return c.conn.Send(UpdateNodeCmd, &UpdateNode{
+	un := UpdateNode{
 		PID:      c.player.ID,
 		NID:      n.ID,
 		Position: n.Position,
 		Rotation: n.Rotation,
+	}
+
+	if c.udp != nil {
+		un.Prepare(UpdateNodeCmd)
+
+		return c.sendDatagram(Datagram{Update: un})
+	}
+
+	return c.conn.Send(UpdateNodeCmd, &un)
+}
+
+// SpawnEntity adds an entity owned by the client to its room, filling in the
+// ID the server gave it.
+func (c *Client) SpawnEntity(e *Entity) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	err := c.conn.Send(SpawnEntityCmd, &SpawnEntity{
+		PID:    c.player.ID,
+		Entity: *e,
+	})
+	if err != nil {
+		return err
+	}
+
+	se := SpawnedEntity{}
+	err = c.ExpectAndRead(SpawnedEntityCmd, &se)
+	if err != nil {
+		return err
+	}
+
+	e.ID = se.ID
+	e.Owner = c.player.ID
+
+	return nil
+}
+
+func (c *Client) UpdateEntity(e Entity) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	return c.conn.Send(UpdateEntityCmd, &UpdateEntity{
+		PID:      c.player.ID,
+		ID:       e.ID,
+		Position: e.Position,
+		Rotation: e.Rotation,
+	})
+}
+
+func (c *Client) DespawnEntity(id uint) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	return c.conn.Send(DespawnEntityCmd, &DespawnEntity{
+		PID: c.player.ID,
+		ID:  id,
 	})
 }
 
+// RequestOwnership tries to grab the entity, holding it with the node if nid
+// isn't zero. It returns whether the client got it.
+func (c *Client) RequestOwnership(id, nid uint) (bool, error) {
+	if c.conn == nil {
+		return false, ErrClientNotConnected
+	}
+
+	err := c.conn.Send(RequestOwnershipCmd, &RequestOwnership{
+		PID: c.player.ID,
+		ID:  id,
+		NID: nid,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	ov := OwnershipVerdict{}
+	err = c.ExpectAndRead(OwnershipVerdictCmd, &ov)
+	if err != nil {
+		return false, err
+	}
+
+	return ov.Granted, nil
+}
+
+func (c *Client) ReleaseOwnership(id uint) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	return c.conn.Send(ReleaseOwnershipCmd, &ReleaseOwnership{
+		PID: c.player.ID,
+		ID:  id,
+	})
+}
+
+// ScriptCommand asks the room's script to handle a command.
+func (c *Client) ScriptCommand(name string, args map[string]string) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	return c.conn.Send(ScriptCommandCmd, &ScriptCommand{
+		PID:  c.player.ID,
+		Name: name,
+		Args: args,
+	})
+}
+
+// Admin runs an operator command on the server and returns what it printed.
+// It fails with ErrNotOperator unless the client's username is an operator.
+func (c *Client) Admin(command string) (string, error) {
+	if c.conn == nil {
+		return "", ErrClientNotConnected
+	}
+
+	err := c.conn.Send(AdminCommandCmd, &AdminCommand{
+		PID:  c.player.ID,
+		Line: command,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case cc := <-c.populateChan(AdminResultCmd):
+		ar := AdminResult{}
+
+		err = cc.Read(&ar)
+		if err != nil {
+			return "", err
+		}
+
+		return ar.Output, nil
+	case cc := <-c.populateChan(ErrorCmd):
+		er := ErrorReply{}
+
+		err = cc.Read(&er)
+		if err != nil {
+			return "", err
+		}
+
+		return "", knownProtocolError(er.Code, er.Message)
+	}
+}
+
+// Chat says something to everyone in the client's room.
+func (c *Client) Chat(text string) error {
+	return c.sendChat(ChatRoom, 0, text)
+}
+
+// Whisper says something to only one player in the client's room.
+func (c *Client) Whisper(pid uint, text string) error {
+	return c.sendChat(ChatWhisper, pid, text)
+}
+
+// ChatNearby says something to everyone close to the client's head.
+func (c *Client) ChatNearby(text string) error {
+	return c.sendChat(ChatNearby, 0, text)
+}
+
+func (c *Client) sendChat(scope string, to uint, text string) error {
+	if c.conn == nil {
+		return ErrClientNotConnected
+	}
+
+	return c.conn.Send(ChatCmd, &Chat{
+		PID:   c.player.ID,
+		Scope: scope,
+		To:    to,
+		Text:  text,
+	})
+}
+
+// Snapshot waits for the next snapshot from the server, acknowledges it and
+// returns the state of every node the client can see.
+func (c *Client) Snapshot() (map[NodeRef]NodeState, error) {
+	if c.conn == nil {
+		return nil, ErrClientNotConnected
+	}
+
+	for {
+		sn := Snapshot{}
+		err := c.ExpectAndRead(SnapshotCmd, &sn)
+		if err != nil {
+			return nil, err
+		}
+
+		state, err := c.applySnapshot(sn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.conn.Send(SnapshotAckCmd, &SnapshotAck{Seq: sn.Seq})
+		if err != nil {
+			return nil, err
+		}
+
+		// Snapshots can overtake each other on the way in, only hand back
+		// the newest.
+		if sn.Seq >= c.latest {
+			c.latest = sn.Seq
+			return state, nil
+		}
+	}
+}
+
+func (c *Client) applySnapshot(sn Snapshot) (map[NodeRef]NodeState, error) {
+	if c.states == nil {
+		c.states = make(map[uint64]map[NodeRef]NodeState)
+	}
+
+	state := make(map[NodeRef]NodeState)
+
+	if sn.Base != 0 {
+		base, ok := c.states[sn.Base]
+		if !ok {
+			return nil, ErrUnknownSnapshotBase
+		}
+
+		for k, ns := range base {
+			state[k] = ns
+		}
+	}
+
+	for _, ns := range sn.Nodes {
+		state[ns.NodeRef] = ns
+	}
+
+	for _, k := range sn.Removed {
+		delete(state, k)
+	}
+
+	c.states[sn.Seq] = state
+
+	// Keep a few older states around in case a late snapshot is based on
+	// one of them.
+	for seq := range c.states {
+		if seq+maxUnackedSnapshots < sn.Seq {
+			delete(c.states, seq)
+		}
+	}
+
+	return state, nil
+}
+
+// NextError waits for the server to refuse one of the client's
+// communications and returns why.
+func (c *Client) NextError() (*ProtocolError, string, error) {
+	er := ErrorReply{}
+
+	err := c.ExpectAndRead(ErrorCmd, &er)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &ProtocolError{Code: er.Code, Message: er.Message}, er.Command, nil
+}
+
 func (c *Client) ExpectAndRead(cmd string, v Preparer) error {
 	cc := c.WaitFor(cmd)
 
 	return cc.Read(v)
 }
+
+// resolveAddr fills in the host of an address advertised by the server, such
+// as ":3002" or "http://:3001/", with the host the client originally
+// connected to.
+func resolveAddr(advertised, fallback string) string {
+	if u, err := url.Parse(advertised); err == nil && u.Scheme != "" && u.Opaque == "" {
+		u.Host = resolveAddr(u.Host, fallback)
+		return u.String()
+	}
+
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil || host != "" {
+		return advertised
+	}
+
+	fhost, _, err := net.SplitHostPort(fallback)
+	if err != nil {
+		return advertised
+	}
+
+	return net.JoinHostPort(fhost, port)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gnamma/server"
+)
+
+// admin runs `gns admin -socket path command [args...]`, which sends an
+// admin command to a running server and prints what it says.
+func admin(args []string) {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	socket := fs.String("socket", "", "The admin socket of the server, as given to -admin-socket")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gns admin -socket path command [args...]")
+		fmt.Fprintln(fs.Output(), "Run `gns admin help` for the commands.")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || *socket == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	out, err := server.DialAdmin(*socket, strings.Join(fs.Args(), " "))
+	if out != "" {
+		fmt.Println(out)
+	}
+	if err != nil {
+		log.SetFlags(0)
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,14 @@
+-- Runs the lobby, see the docs of server.Script for everything it can do.
+
+local platform = room.spawn({asset = "platform.gsml", label = "platform", y = 0.5})
+local t = 0
+
+function on_join(player)
+  room.send(player.id, "welcome", {text = "Welcome to " .. room.name .. ", " .. player.username .. "!"})
+end
+
+-- Float the platform up and down between the pillars.
+function on_tick(dt)
+  t = t + dt
+  room.move(platform, 0, 2.5 + 2 * math.sin(t / 2), 0)
+end
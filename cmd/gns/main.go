@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gnamma/server"
 )
@@ -13,27 +21,196 @@ var (
 	address     = flag.String("address", ":3000", "The address which you want to host the server on, etc localhost:3000")
 	assets      = flag.String("assets", "cmd/gns/example", "The path of where the files for the server are kept")
 	assetsAddr  = flag.String("assets-addr", ":3001", "The address of where to host the asset server")
+	assetsHTTP  = flag.Bool("assets-http", false, "Serve assets over HTTP rather than the framed protocol")
+	watch       = flag.Duration("watch", time.Second, "How often to check the assets for changes to push to players. Zero to never check")
+	assetsURL   = flag.String("assets-url", "", "The URL to tell clients to fetch assets from, such as a CDN in front of the asset server")
+	udpAddr     = flag.String("unreliable-addr", "", "The UDP address to accept node updates on, etc :3002. Disabled if empty")
+	wsAddr      = flag.String("websocket-addr", "", "The address to accept WebSocket connections from browsers on, etc :3003. Disabled if empty")
+	wsOrigins   = flag.String("websocket-origins", "", "Comma separated list of pages on other hosts which may connect over WebSockets, etc https://example.com. * allows any")
+	interest    = flag.Float64("interest-radius", 0, "How close a node has to be to a player's head for them to get its updates. Zero sends every update to everyone")
+	maxSpeed    = flag.Float64("max-speed", 0, "The fastest a node may move, in units per second. Zero for no limit")
+	worldSize   = flag.Float64("world-size", 0, "How far from the origin nodes may go along each axis. Zero for no limit")
+	clamp       = flag.Bool("clamp", false, "Pull nodes back within the limits instead of rejecting their updates")
+	collide     = flag.Bool("collide", false, "Stop nodes going through the boxes and planes of the room, or below the floor")
+	floor       = flag.Float64("floor", 0, "The height nodes can't go below when -collide is set")
+	nodeRadius  = flag.Float64("node-radius", 0.1, "How far nodes are kept from the room when -collide is set")
+	password    = flag.String("password", "", "A password every player has to connect with")
+	htpasswd    = flag.String("htpasswd", "", "A file of username:bcrypt-hash lines to check player passwords against")
+	tokenSecret = flag.String("token-secret", "", "The secret shared with the service which issues login tokens")
+	tlsCert     = flag.String("tls-cert", "", "The certificate to serve TLS with. TLS is off unless this and -tls-key are set")
+	tlsKey      = flag.String("tls-key", "", "The private key for -tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "Only let in clients with a certificate signed by one of the CAs in this file")
+	grace       = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for players to be told the server is going away when stopping")
+	operators   = flag.String("operators", "", "Comma separated list of usernames which can run admin commands from their client. Needs -htpasswd or -token-secret")
+	bans        = flag.String("bans", "", "The file to keep bans in. Empty to forget them when the server stops")
+	adminSocket = flag.String("admin-socket", "", "The Unix socket `gns admin` sends commands to. Empty to go without")
+	metricsAddr = flag.String("metrics-addr", "", "The address to serve Prometheus metrics on, at /metrics, etc localhost:3005. Disabled if empty")
+	statusAddr  = flag.String("status-addr", "", "The address to serve the HTTP status API on, etc localhost:3004. Disabled if empty")
+	statusToken = flag.String("status-token", "", "The bearer token needed to kick players or broadcast messages through the status API")
+	scriptTime  = flag.Duration("script-timeout", server.DefaultScriptTimeout, "How long room scripts get to handle each event")
+	scriptMem   = flag.Int64("script-memory", server.DefaultScriptMemory, "How many bytes room scripts can allocate handling each event, or hold on to between them")
+	rooms       = flag.String("rooms", "lobby=room.gsml", "Comma separated list of rooms to host, as name=asset pairs. The first room is the default. A Lua file next to the asset with the same name, such as room.lua, runs the room")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		admin(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
-	s := server.New(server.Options{
+	s, err := server.New(server.Options{
 		Name:        *name,
 		Description: *description,
 		Addr:        *address,
 		AssetsDir:   *assets,
 		AssetsAddr:  *assetsAddr,
+		AssetsHTTP:  *assetsHTTP,
+		AssetsURL:   *assetsURL,
+		WatchAssets: *watch,
+		Rooms:       parseRooms(*rooms),
+
+		UnreliableAddr:   *udpAddr,
+		Authenticator:    authenticator(),
+		TLS:              tlsOptions(),
+		WebSocketAddr:    *wsAddr,
+		WebSocketOrigins: splitList(*wsOrigins),
+		ScriptTimeout:    *scriptTime,
+		ScriptMemory:     *scriptMem,
+
+		Operators:   splitList(*operators),
+		BansFile:    *bans,
+		AdminSocket: *adminSocket,
+		StatusAddr:  *statusAddr,
+		MetricsAddr: *metricsAddr,
+		StatusToken: *statusToken,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	log.Println("Starting Gnamma server...")
 
 	log.Printf("Name: %v, Description: %v\n", s.Opts.Name, s.Opts.Description)
 
-	err := s.Go()
-	if err != nil {
+	stopped := make(chan struct{})
+	go shutdownOnSignal(s, stopped)
+
+	err = s.Go()
+	if err != server.ErrServerClosed {
 		log.Fatal(err)
 	}
 
+	<-stopped
+
 	log.Println("Exiting")
 }
+
+func tlsOptions() *server.TLSOptions {
+	if *tlsCert == "" && *tlsKey == "" {
+		return nil
+	}
+
+	return &server.TLSOptions{
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ClientCAFile: *tlsClientCA,
+	}
+}
+
+func authenticator() server.Authenticator {
+	switch {
+	case *password != "" && *htpasswd == "" && *tokenSecret == "":
+		return &server.PasswordAuthenticator{Password: *password}
+	case *htpasswd != "" && *password == "" && *tokenSecret == "":
+		a, err := server.NewHtpasswdAuthenticator(*htpasswd)
+		if err != nil {
+			log.Fatal("Couldn't load htpasswd file:", err)
+		}
+
+		return a
+	case *tokenSecret != "" && *password == "" && *htpasswd == "":
+		return &server.TokenAuthenticator{Secret: []byte(*tokenSecret)}
+	case *password == "" && *htpasswd == "" && *tokenSecret == "":
+		return nil
+	}
+
+	log.Fatal("Only one of -password, -htpasswd and -token-secret can be used")
+	return nil
+}
+
+// shutdownOnSignal shuts the server down on SIGINT or SIGTERM, and closes
+// stopped once it has.
+func shutdownOnSignal(s *server.Server, stopped chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	log.Printf("Got %v, shutting down...", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if err != nil {
+		log.Println("Couldn't shut down cleanly:", err)
+	}
+
+	close(stopped)
+}
+
+// roomScript returns the key of the script next to the room's asset, or an
+// empty string if it hasn't got one.
+func roomScript(main string) string {
+	key := strings.TrimSuffix(main, path.Ext(main)) + ".lua"
+
+	_, err := os.Stat(filepath.Join(*assets, filepath.FromSlash(key)))
+	if err != nil {
+		return ""
+	}
+
+	return key
+}
+
+func splitList(s string) []string {
+	var l []string
+
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+
+	return l
+}
+
+func parseRooms(s string) []server.RoomOptions {
+	var rs []server.RoomOptions
+
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(r), "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid room %q, expected name=asset", r)
+		}
+
+		rs = append(rs, server.RoomOptions{
+			Name:           parts[0],
+			Main:           parts[1],
+			InterestRadius: *interest,
+			Limits: server.Limits{
+				MaxSpeed: *maxSpeed,
+				Min:      server.Point{X: -*worldSize, Y: -*worldSize, Z: -*worldSize},
+				Max:      server.Point{X: *worldSize, Y: *worldSize, Z: *worldSize},
+				Clamp:    *clamp,
+			},
+			Collision: server.Collision{
+				Enabled:    *collide,
+				Floor:      *floor,
+				NodeRadius: *nodeRadius,
+			},
+			Script: roomScript(parts[1]),
+		})
+	}
+
+	return rs
+}
@@ -14,6 +14,11 @@ var (
 	addr       = flag.String("address", "localhost:3000", "The address for the server you want to connect to")
 	assetsAddr = flag.String("assets-address", "localhost:3001", "The address for the specific address server you want to listen on")
 	username   = flag.String("username", "reverb", "The username this bot will take")
+	useTLS     = flag.Bool("tls", false, "Connect to the server over TLS")
+	tlsCA      = flag.String("tls-ca", "", "The CA to trust the server's certificate with, instead of the system's")
+	tlsCert    = flag.String("tls-cert", "", "The certificate to show servers which verify clients")
+	tlsKey     = flag.String("tls-key", "", "The private key for -tls-cert")
+	codec      = flag.String("codec", "", "The wire codec to ask the server for, etc binary. Defaults to JSON")
 
 	client *server.Client
 )
@@ -25,6 +30,16 @@ func main() {
 		Addr:       *addr,
 		AssetsAddr: *assetsAddr,
 		Username:   *username,
+		Codec:      *codec,
+	}
+
+	if *useTLS {
+		conf, err := server.ClientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal("Couldn't load TLS configuration:", err)
+		}
+
+		client.TLS = conf
 	}
 
 	err := client.Connect()
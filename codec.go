@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+)
+
+const (
+	JSONCodecName   = "json"
+	BinaryCodecName = "binary"
+)
+
+// Codec encodes communications on the wire. The codec used for a connection
+// is negotiated in the ConnectRequest, JSON is used until then.
+type Codec interface {
+	Name() string
+
+	// Tag is written at the start of every frame encoded with the codec so
+	// that the receiver knows how to decode it. A zero tag means the legacy
+	// ASCII length framing.
+	Tag() byte
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+
+	codecs     = make(map[string]Codec)
+	codecTags  = make(map[byte]Codec)
+	codecsLock sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(BinaryCodec)
+}
+
+// RegisterCodec makes a codec available for negotiation. Tags must be unique
+// and must not be ASCII digits, which start legacy frames, or '!', which
+// starts error frames.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[c.Name()] = c
+
+	if c.Tag() != 0 {
+		codecTags[c.Tag()] = c
+	}
+}
+
+func CodecByName(name string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[name]
+	return c, ok
+}
+
+func codecByTag(tag byte) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecTags[tag]
+	return c, ok
+}
+
+// negotiateCodec picks the first codec in the client's list of preferences
+// which the server knows about.
+func negotiateCodec(names []string) Codec {
+	for _, n := range names {
+		c, ok := CodecByName(n)
+		if ok {
+			return c
+		}
+	}
+
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return JSONCodecName }
+func (jsonCodec) Tag() byte    { return 0 }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// binaryCodec is a compact encoding for high frequency traffic. Integers are
+// written as varints, floats are narrowed to float32 and structs are written
+// field by field in declaration order, so both ends must agree on the
+// protocol version. Fields tagged `json:"-"` are skipped. Byte slices are
+// written as they are, after their length.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return BinaryCodecName }
+func (binaryCodec) Tag() byte    { return 'B' }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	err := encodeValue(buf, reflect.Indirect(reflect.ValueOf(v)))
+	return buf.Bytes(), err
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("binary codec: cannot decode into %T", v)
+	}
+
+	return decodeValue(bytes.NewReader(data), rv.Elem())
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	var tmp [binary.MaxVarintLen64]byte
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.Write(tmp[:binary.PutVarint(tmp[:], v.Int())])
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], v.Uint())])
+	case reflect.Float32, reflect.Float64:
+		binary.BigEndian.PutUint32(tmp[:4], math.Float32bits(float32(v.Float())))
+		buf.Write(tmp[:4])
+	case reflect.String:
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(v.Len()))])
+		buf.WriteString(v.String())
+	case reflect.Slice, reflect.Array:
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(v.Len()))])
+
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(v.Bytes())
+			return nil
+		}
+
+		for i := 0; i < v.Len(); i++ {
+			err := encodeValue(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(v.Len()))])
+
+		it := v.MapRange()
+		for it.Next() {
+			err := encodeValue(buf, it.Key())
+			if err != nil {
+				return err
+			}
+
+			err = encodeValue(buf, it.Value())
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return nil
+		}
+
+		buf.WriteByte(1)
+		return encodeValue(buf, v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+
+		for i := 0; i < t.NumField(); i++ {
+			if skipField(t.Field(i)) {
+				continue
+			}
+
+			err := encodeValue(buf, v.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary codec: unsupported type %v", v.Type())
+	}
+
+	return nil
+}
+
+func decodeValue(r *bytes.Reader, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var tmp [4]byte
+
+		_, err := io.ReadFull(r, tmp[:])
+		if err != nil {
+			return err
+		}
+
+		v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(tmp[:]))))
+	case reflect.String:
+		l, err := readLen(r)
+		if err != nil {
+			return err
+		}
+
+		b := make([]byte, l)
+
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return err
+		}
+
+		v.SetString(string(b))
+	case reflect.Slice:
+		l, err := readLen(r)
+		if err != nil {
+			return err
+		}
+
+		if l == 0 {
+			return nil
+		}
+
+		v.Set(reflect.MakeSlice(v.Type(), l, l))
+
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			_, err = io.ReadFull(r, v.Bytes())
+			return err
+		}
+
+		for i := 0; i < l; i++ {
+			err = decodeValue(r, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		l, err := readLen(r)
+		if err != nil {
+			return err
+		}
+
+		if l != v.Len() {
+			return fmt.Errorf("binary codec: array length %v does not match %v", l, v.Type())
+		}
+
+		for i := 0; i < l; i++ {
+			err = decodeValue(r, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		l, err := readLen(r)
+		if err != nil {
+			return err
+		}
+
+		m := reflect.MakeMapWithSize(v.Type(), l)
+
+		for i := 0; i < l; i++ {
+			k := reflect.New(v.Type().Key()).Elem()
+			err = decodeValue(r, k)
+			if err != nil {
+				return err
+			}
+
+			e := reflect.New(v.Type().Elem()).Elem()
+			err = decodeValue(r, e)
+			if err != nil {
+				return err
+			}
+
+			m.SetMapIndex(k, e)
+		}
+
+		v.Set(m)
+	case reflect.Ptr:
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if b == 0 {
+			return nil
+		}
+
+		e := reflect.New(v.Type().Elem())
+
+		err = decodeValue(r, e.Elem())
+		if err != nil {
+			return err
+		}
+
+		v.Set(e)
+	case reflect.Struct:
+		t := v.Type()
+
+		for i := 0; i < t.NumField(); i++ {
+			if skipField(t.Field(i)) {
+				continue
+			}
+
+			err := decodeValue(r, v.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary codec: unsupported type %v", v.Type())
+	}
+
+	return nil
+}
+
+func readLen(r *bytes.Reader) (int, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if l > uint64(r.Len()) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return int(l), nil
+}
+
+func skipField(f reflect.StructField) bool {
+	return f.PkgPath != "" || f.Tag.Get("json") == "-"
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"math"
+
+	"github.com/gnamma/server/gsml"
+)
+
+// collisionGap keeps nodes just outside of whatever they hit, so they don't
+// start their next move touching it.
+const collisionGap = 1e-6
+
+// Collision makes the server stop nodes going through the room's static
+// geometry. The zero value leaves nodes to go wherever they like.
+type Collision struct {
+	Enabled bool
+
+	Floor      float64 // Height nodes can't go below.
+	NodeRadius float64 // How far nodes are kept from geometry.
+}
+
+// AABB is an axis aligned box, from one corner to the opposite one.
+type AABB struct {
+	Min Point
+	Max Point
+}
+
+// Collider resolves node moves against a room's geometry.
+type Collider struct {
+	Boxes []AABB
+	Opts  Collision
+}
+
+// NewCollider builds a box for every <box> and <plane> in the room, along with
+// any <el> using one of them as its model. Rotations aren't supported, so
+// every box lines up with the axes.
+func NewCollider(scene *gsml.Room, o Collision) *Collider {
+	c := &Collider{Opts: o}
+
+	var walk func(es []*gsml.Element, pos, scale gsml.Vector)
+
+	walk = func(es []*gsml.Element, pos, scale gsml.Vector) {
+		for _, e := range es {
+			p := gsml.Vector{
+				X: pos.X + e.Position.X*scale.X,
+				Y: pos.Y + e.Position.Y*scale.Y,
+				Z: pos.Z + e.Position.Z*scale.Z,
+			}
+
+			s := gsml.Vector{
+				X: scale.X * e.Scale.X,
+				Y: scale.Y * e.Scale.Y,
+				Z: scale.Z * e.Scale.Z,
+			}
+
+			switch shape(e) {
+			case gsml.Box:
+				c.Boxes = append(c.Boxes, boxAt(p, s))
+			case gsml.Plane:
+				// Planes are flat, whatever their Y scale says.
+				s.Y = 0
+				c.Boxes = append(c.Boxes, boxAt(p, s))
+			}
+
+			walk(e.Children, p, s)
+		}
+	}
+
+	walk(scene.Elements, gsml.Vector{}, gsml.Vector{X: 1, Y: 1, Z: 1})
+
+	return c
+}
+
+func shape(e *gsml.Element) string {
+	if e.Kind == gsml.El {
+		return e.Model
+	}
+
+	return e.Kind
+}
+
+// boxAt makes the box for a unit shape centred on p and scaled by s.
+func boxAt(p, s gsml.Vector) AABB {
+	hx, hy, hz := math.Abs(s.X)/2, math.Abs(s.Y)/2, math.Abs(s.Z)/2
+
+	return AABB{
+		Min: Point{X: p.X - hx, Y: p.Y - hy, Z: p.Z - hz},
+		Max: Point{X: p.X + hx, Y: p.Y + hy, Z: p.Z + hz},
+	}
+}
+
+// Resolve works out where a node moving from one point to another ends up.
+// It stops at the first box in the way and slides along it with whatever is
+// left of the move. Nodes which start inside a box are free to leave it.
+func (c *Collider) Resolve(from, to Point) Point {
+	r := c.Opts.NodeRadius
+
+	// Each slide gets rid of the move along one axis, so three is enough.
+	for i := 0; i < 3; i++ {
+		hit, t, axis, box := false, 1.0, 0, AABB{}
+
+		for _, b := range c.Boxes {
+			b = b.grow(r)
+
+			bt, baxis, ok := b.sweep(from, to)
+			if ok && (!hit || bt < t) {
+				hit, t, axis, box = true, bt, baxis, b
+			}
+		}
+
+		if !hit {
+			break
+		}
+
+		contact := from.Lerp(to, t)
+
+		if axisOf(to, axis) > axisOf(from, axis) {
+			setAxis(&contact, axis, axisOf(box.Min, axis)-collisionGap)
+		} else {
+			setAxis(&contact, axis, axisOf(box.Max, axis)+collisionGap)
+		}
+
+		setAxis(&to, axis, axisOf(contact, axis))
+		from = contact
+	}
+
+	if to.Y < c.Opts.Floor+r {
+		to.Y = c.Opts.Floor + r
+	}
+
+	return to
+}
+
+func (b AABB) grow(r float64) AABB {
+	return AABB{
+		Min: Point{X: b.Min.X - r, Y: b.Min.Y - r, Z: b.Min.Z - r},
+		Max: Point{X: b.Max.X + r, Y: b.Max.Y + r, Z: b.Max.Z + r},
+	}
+}
+
+func (b AABB) contains(p Point) bool {
+	return p.X > b.Min.X && p.X < b.Max.X &&
+		p.Y > b.Min.Y && p.Y < b.Max.Y &&
+		p.Z > b.Min.Z && p.Z < b.Max.Z
+}
+
+// sweep finds how far along the move from one point to another it first
+// touches the box, and along which axis.
+func (b AABB) sweep(from, to Point) (float64, int, bool) {
+	if b.contains(from) {
+		return 0, 0, false
+	}
+
+	near, far, axis := math.Inf(-1), math.Inf(1), 0
+
+	for a := 0; a < 3; a++ {
+		f, d := axisOf(from, a), axisOf(to, a)-axisOf(from, a)
+		min, max := axisOf(b.Min, a), axisOf(b.Max, a)
+
+		if d == 0 {
+			if f < min || f > max {
+				return 0, 0, false
+			}
+
+			continue
+		}
+
+		t1, t2 := (min-f)/d, (max-f)/d
+		if t1 > t2 {
+			t1, t2 = t2, t1
+		}
+
+		if t1 > near {
+			near, axis = t1, a
+		}
+
+		far = math.Min(far, t2)
+	}
+
+	if near > far || near < 0 || near > 1 {
+		return 0, 0, false
+	}
+
+	return near, axis, true
+}
+
+func axisOf(p Point, a int) float64 {
+	switch a {
+	case 0:
+		return p.X
+	case 1:
+		return p.Y
+	}
+
+	return p.Z
+}
+
+func setAxis(p *Point, a int, v float64) {
+	switch a {
+	case 0:
+		p.X = v
+	case 1:
+		p.Y = v
+	default:
+		p.Z = v
+	}
+}
@@ -1,12 +1,19 @@
 package server
 
+import "time"
+
 type CommunicationHandler func(conn *ChildConn) error
 
 type Dispatch struct {
 	H map[string]CommunicationHandler // Do not change at runtime!
+
+	Metrics *Metrics // Counts and times every command, if set.
 }
 
-func (d *Dispatch) Handle(cmd string, conn *ChildConn) error {
+func (d *Dispatch) Handle(cmd string, conn *ChildConn) (err error) {
+	start := time.Now()
+	defer func() { d.Metrics.handled(cmd, start, err) }()
+
 	f, ok := d.H[cmd]
 	if !ok {
 		return ErrHandlerNotFound
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+const DefaultMaxSpawned = 32
+
+// Entity is an object in a room which doesn't belong to a player's body, such
+// as a door, a moving platform or a prop.
+type Entity struct {
+	ID       uint   `json:"id"`
+	Asset    string `json:"asset"`
+	Label    string `json:"label"`
+	Position Point  `json:"position"`
+	Rotation Point  `json:"rotation"`
+
+	// Owner is the player who may move the entity, or zero if only the
+	// server can.
+	Owner uint `json:"owner"`
+
+	// Grabbable entities can be taken over by any player, see Room.Grab.
+	Grabbable bool `json:"grabbable"`
+	Node      uint `json:"node"` // The owner's node it's following, if any.
+
+	spawner      uint  // The player who spawned it, zero for the server.
+	held         bool  // Whether the owner grabbed it.
+	offset, spin Point // From the node it's following.
+
+	updatedAt time.Time // When the entity last moved.
+}
+
+// TickFunc is called on every tick of a room's update loop, with the time
+// since the last one.
+type TickFunc func(r *Room, dt time.Duration)
+
+// OnTick calls fn on every tick of the room, which is where server side
+// scripts should move entities from.
+func (r *Room) OnTick(fn TickFunc) {
+	r.tickLock.Lock()
+	r.tickFuncs = append(r.tickFuncs, fn)
+	r.tickLock.Unlock()
+}
+
+func (r *Room) tick(dt time.Duration) {
+	r.tickLock.RLock()
+	fns := r.tickFuncs
+	r.tickLock.RUnlock()
+
+	for _, fn := range fns {
+		fn(r, dt)
+	}
+
+	if sc := r.Script(); sc != nil {
+		sc.onTick(dt)
+	}
+}
+
+// Spawn adds the entity to the room and lets everyone know, returning the ID
+// it was given.
+func (r *Room) Spawn(e Entity) uint {
+	id, _ := r.spawn(e, 0)
+
+	return id
+}
+
+// spawn is Spawn, refusing if the entity's spawner already has max entities
+// in the room. Zero allows any number.
+func (r *Room) spawn(e Entity, max int) (uint, error) {
+	r.entitiesLock.Lock()
+	if max > 0 && r.spawnedBy(e.spawner) >= max {
+		r.entitiesLock.Unlock()
+		return 0, ErrTooManyEntities
+	}
+
+	r.entityCount += 1
+	e.ID = r.entityCount
+	e.updatedAt = time.Now()
+	r.entities[e.ID] = &e
+	r.entitiesLock.Unlock()
+
+	r.broadcast(Broadcast{
+		Cmd:  EntitySpawnedCmd,
+		Com:  &EntitySpawned{Entity: e},
+		From: e.Owner,
+	})
+
+	return e.ID, nil
+}
+
+// spawnedBy counts the entities the player spawned. It's called with the
+// entities lock held.
+func (r *Room) spawnedBy(pid uint) int {
+	n := 0
+
+	for _, e := range r.entities {
+		if e.spawner == pid {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Despawn removes the entity from the room and lets everyone know.
+func (r *Room) Despawn(id uint) error {
+	r.entitiesLock.Lock()
+	e, ok := r.entities[id]
+	delete(r.entities, id)
+	r.entitiesLock.Unlock()
+
+	if !ok {
+		return ErrEntityDoesntExist
+	}
+
+	r.broadcast(Broadcast{
+		Cmd:  EntityDespawnedCmd,
+		Com:  &EntityDespawned{ID: id},
+		From: e.Owner,
+	})
+
+	return nil
+}
+
+// MoveEntity moves the entity and lets everyone know. It refuses to move it
+// anywhere that isn't finite, which couldn't be sent to JSON clients.
+func (r *Room) MoveEntity(id uint, position, rotation Point) error {
+	if !position.Finite() || !rotation.Finite() {
+		return ErrNodeNotFinite
+	}
+
+	var owner uint
+
+	r.entitiesLock.Lock()
+	e, ok := r.entities[id]
+	if ok {
+		e.Position = position
+		e.Rotation = rotation
+		e.updatedAt = time.Now()
+		owner = e.Owner
+	}
+	r.entitiesLock.Unlock()
+
+	if !ok {
+		return ErrEntityDoesntExist
+	}
+
+	r.broadcast(Broadcast{
+		Cmd: UpdateEntityCmd,
+		Com: &UpdateEntity{
+			ID:       id,
+			Position: position,
+			Rotation: rotation,
+		},
+		From: owner,
+	})
+
+	return nil
+}
+
+// Entity returns a copy of the entity with the ID.
+func (r *Room) Entity(id uint) (Entity, error) {
+	r.entitiesLock.RLock()
+	defer r.entitiesLock.RUnlock()
+
+	e, ok := r.entities[id]
+	if !ok {
+		return Entity{}, ErrEntityDoesntExist
+	}
+
+	return *e, nil
+}
+
+// Entities returns a copy of every entity in the room, in the order they were
+// spawned.
+func (r *Room) Entities() []Entity {
+	r.entitiesLock.RLock()
+	defer r.entitiesLock.RUnlock()
+
+	es := make([]Entity, 0, len(r.entities))
+	for _, e := range r.entities {
+		es = append(es, *e)
+	}
+
+	sort.Slice(es, func(i, j int) bool { return es[i].ID < es[j].ID })
+
+	return es
+}
+
+// despawnSpawnedBy removes every entity the player spawned.
+func (r *Room) despawnSpawnedBy(pid uint) {
+	for _, e := range r.Entities() {
+		if e.spawner == pid {
+			r.Despawn(e.ID)
+		}
+	}
+}
+
+// owned returns the entity if the player is allowed to change it.
+func (r *Room) owned(id, pid uint) (Entity, error) {
+	e, err := r.Entity(id)
+	if err != nil {
+		return e, err
+	}
+
+	if e.Owner != pid {
+		return e, ErrNotEntityOwner
+	}
+
+	return e, nil
+}
+
+func (r *Room) spawnEntity(conn *ChildConn) error {
+	se := SpawnEntity{}
+
+	err := conn.Read(&se)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, se.PID)
+	if err != nil {
+		return err
+	}
+
+	se.Entity.Position, err = r.Opts.Limits.Place(se.Entity.Position)
+	if err != nil {
+		return err
+	}
+
+	err = r.Opts.Limits.Rotate(se.Entity.Rotation)
+	if err != nil {
+		return err
+	}
+
+	// Players own what they spawn, and it goes when they do.
+	se.Entity.Owner = p.ID
+	se.Entity.Node = 0
+	se.Entity.spawner = p.ID
+
+	max := r.Opts.MaxSpawned
+	if max == 0 {
+		max = DefaultMaxSpawned
+	}
+
+	id, err := r.spawn(se.Entity, max)
+	if err != nil {
+		return err
+	}
+
+	return conn.Send(SpawnedEntityCmd, &SpawnedEntity{ID: id})
+}
+
+func (r *Room) despawnEntity(conn *ChildConn) error {
+	de := DespawnEntity{}
+
+	err := conn.Read(&de)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, de.PID)
+	if err != nil {
+		return err
+	}
+
+	e, err := r.Entity(de.ID)
+	if err != nil {
+		return err
+	}
+
+	// Grabbing only lends an entity, so only whoever spawned it can get rid
+	// of it.
+	if e.spawner != p.ID {
+		return ErrNotEntityOwner
+	}
+
+	return r.Despawn(de.ID)
+}
+
+func (r *Room) updateEntity(conn *ChildConn) error {
+	ue := UpdateEntity{}
+
+	err := conn.Read(&ue)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, ue.PID)
+	if err != nil {
+		return err
+	}
+
+	e, err := r.owned(ue.ID, p.ID)
+	if err != nil {
+		return err
+	}
+
+	// The same as nodes, updates landing together shouldn't look like a
+	// teleport.
+	dt := time.Since(e.updatedAt)
+	if min := time.Second / time.Duration(r.s.Opts.ReadSpeed); dt < min {
+		dt = min
+	}
+
+	position, err := r.Opts.Limits.Check(e.Position, ue.Position, dt)
+	if err != nil {
+		return err
+	}
+
+	err = r.Opts.Limits.Rotate(ue.Rotation)
+	if err != nil {
+		return err
+	}
+
+	return r.MoveEntity(ue.ID, position, ue.Rotation)
+}
@@ -1,17 +1,161 @@
 package server
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/gnamma/server/gsml"
+)
 
 var (
 	ErrHandlerNotFound    = errors.New("Handler for that command could not be found")
 	ErrPlayerCantJoin     = errors.New("Player is unable to join")
 	ErrPlayerDoesntExist  = errors.New("Player does not exist")
+	ErrPlayerNotConnected = errors.New("Connection has not joined as a player")
+	ErrRoomDoesntExist    = errors.New("Room does not exist")
 	ErrNodeDoesntExist    = errors.New("Node does not exist")
 	ErrNodeAlreadyExists  = errors.New("Node already exists")
 	ErrUnexpectedCom      = errors.New("Unexpected communication")
 	ErrEmptyBuffer        = errors.New("Buffer is empty")
 	ErrClientDisconnected = errors.New("Client is disconnected")
+	ErrUnknownCodec       = errors.New("Frame was encoded with an unknown codec")
+	ErrServerClosed       = errors.New("Server has been shut down")
+	ErrFrameTooBig        = errors.New("Frame is bigger than the connection allows")
+	ErrScriptMemory       = errors.New("Script held on to more memory than it's allowed")
+	ErrScriptAllocated    = errors.New("Script allocated more memory in one call than it's allowed")
+
+	ErrNoUnreliableChannel = errors.New("Player has no unreliable channel")
+	ErrVoiceFrameTooBig    = errors.New("Voice frame is bigger than an Opus frame can be")
+	ErrInvalidToken        = errors.New("Invalid unreliable channel token")
+
+	ErrWrongPassword     = errors.New("Invalid username or password")
+	ErrInvalidLoginToken = errors.New("Invalid login token")
+	ErrTokenExpired      = errors.New("Login token has expired")
 
 	ErrClientRejected     = errors.New("Client was rejected by the server")
 	ErrClientNotConnected = errors.New("Client is not connected to a server")
+	ErrClientRoomRejected = errors.New("Client was rejected by the room")
+
+	ErrAssetHashMismatch = errors.New("Asset doesn't match its hash")
+	ErrRoomFileMissing   = errors.New("Room file has been removed")
+
+	ErrUnknownSnapshotBase = errors.New("Snapshot is based on one the client doesn't have")
+
+	ErrNotBanned           = errors.New("Nobody is banned by that username or address")
+	ErrNoAddress           = errors.New("Player's address is unknown")
+	ErrUnknownAdminCommand = errors.New("Unknown admin command, try help")
+	ErrOperatorsNeedAuth   = errors.New("Operators can't be trusted without an Authenticator which checks each user")
+)
+
+// RejectedError is returned when the server turns the client away, along with
+// the reason it gave.
+type RejectedError struct {
+	Message string
+}
+
+func (e *RejectedError) Error() string {
+	return ErrClientRejected.Error() + ": " + e.Message
+}
+
+func (e *RejectedError) Unwrap() error {
+	return ErrClientRejected
+}
+
+// GSMLError explains what's wrong with a GSML asset.
+type GSMLError struct {
+	Key string
+	Err error
+}
+
+func (e *GSMLError) Error() string {
+	// Parse errors already say which file they're in, which may be one the
+	// asset includes.
+	if ge, ok := e.Err.(*gsml.Error); ok && ge.File != "" {
+		return ge.Error()
+	}
+
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *GSMLError) Unwrap() error {
+	return e.Err
+}
+
+// ScriptError explains what's wrong with a room's script.
+type ScriptError struct {
+	Key string
+	Err error
+}
+
+func (e *ScriptError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolError is sent back to the client when the server refuses one of its
+// communications.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrWrongPlayer     = &ProtocolError{"wrong_player", "Communication is for a different player than the connection"}
+	ErrNodeTooFast     = &ProtocolError{"too_fast", "Node moved faster than the server allows"}
+	ErrNodeOutOfBounds = &ProtocolError{"out_of_bounds", "Node is outside of the world"}
+	ErrNodeNotFinite   = &ProtocolError{"not_finite", "Position or rotation is not a finite number"}
+
+	ErrEntityDoesntExist  = &ProtocolError{"no_entity", "Entity does not exist"}
+	ErrNotEntityOwner     = &ProtocolError{"not_owner", "Entity is owned by someone else"}
+	ErrEntityTaken        = &ProtocolError{"taken", "Entity has already been grabbed"}
+	ErrEntityNotGrabbable = &ProtocolError{"not_grabbable", "Entity can't be grabbed"}
+	ErrTooManyEntities    = &ProtocolError{"too_many_entities", "Player has spawned as many entities as the room allows"}
+
+	ErrChatEmpty        = &ProtocolError{"empty", "Chat message is empty"}
+	ErrChatTooLong      = &ProtocolError{"too_long", "Chat message is too long"}
+	ErrChatTooFast      = &ProtocolError{"rate_limited", "Sending chat messages too quickly"}
+	ErrChatFiltered     = &ProtocolError{"filtered", "Chat message was refused"}
+	ErrChatNoRecipient  = &ProtocolError{"no_recipient", "Player to whisper to is not in the room"}
+	ErrChatNoHead       = &ProtocolError{"no_head", "Nearby chat needs a head node"}
+	ErrChatUnknownScope = &ProtocolError{"unknown_scope", "Chat scope is not room, whisper or nearby"}
+
+	ErrMuted       = &ProtocolError{"muted", "Player has been muted"}
+	ErrNotOperator = &ProtocolError{"not_operator", "Only operators can run admin commands"}
+
+	// ErrAdminFailed is sent with why the command failed in place of its
+	// message.
+	ErrAdminFailed = &ProtocolError{"admin_failed", "Admin command failed"}
+
+	ErrUnknownScriptCommand = &ProtocolError{"unknown_command", "Room's script doesn't handle that command"}
+	ErrScriptFailed         = &ProtocolError{"script_error", "Room's script couldn't handle the command"}
+
+	ErrAssetNotFound   = &ProtocolError{"not_found", "Asset does not exist"}
+	ErrAssetForbidden  = &ProtocolError{"forbidden", "Asset is not available to clients"}
+	ErrAssetServerBusy = &ProtocolError{"busy", "Asset server is busy, try again later"}
 )
+
+// knownProtocolError returns the error variable with the code, so clients can
+// compare the errors they receive against them.
+func knownProtocolError(code, message string) *ProtocolError {
+	for _, e := range []*ProtocolError{
+		ErrWrongPlayer, ErrNodeTooFast, ErrNodeOutOfBounds, ErrNodeNotFinite,
+		ErrEntityDoesntExist, ErrNotEntityOwner, ErrEntityTaken, ErrEntityNotGrabbable, ErrTooManyEntities,
+		ErrUnknownScriptCommand, ErrScriptFailed,
+		ErrChatEmpty, ErrChatTooLong, ErrChatTooFast, ErrChatFiltered,
+		ErrChatNoRecipient, ErrChatNoHead, ErrChatUnknownScope,
+		ErrMuted, ErrNotOperator,
+		ErrAssetNotFound, ErrAssetForbidden, ErrAssetServerBusy,
+	} {
+		if e.Code == code {
+			return e
+		}
+	}
+
+	return &ProtocolError{Code: code, Message: message}
+}
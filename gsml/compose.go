@@ -0,0 +1,372 @@
+package gsml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ParseFS parses the room in the file with the key, putting in everything it
+// includes and uses, so the result is a single flattened room.
+//
+// <include src="pillars.gsml"/> puts the elements of another room in a group
+// where the include is. The path is relative to the including file.
+//
+// <template name="pillar" params="height middle"> defines a template at the
+// top of a room, which <use template="pillar" height="5" middle="2.5"/> puts
+// in a group later on in the same file. "${height}" in any attribute of the
+// template is replaced with the value given to use.
+//
+// Both groups take a name and the usual position and scale attributes. The
+// names of everything in a named group are prefixed with the group's, as in
+// "left/pillar", so a room can include the same file more than once.
+func ParseFS(fsys fs.FS, key string) (*Room, error) {
+	f, err := fsys.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := newParser(fsys, key, &decoderSource{xml.NewDecoder(f)})
+	p.including = []string{key}
+
+	return p.room()
+}
+
+type template struct {
+	params []string
+	body   []recorded
+	line   int
+}
+
+type recorded struct {
+	tok  xml.Token
+	line int
+}
+
+func (p *parser) template(start xml.StartElement, line int) error {
+	t := &template{line: line}
+	var name string
+
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "name":
+			name = a.Value
+		case "params":
+			t.params = strings.Fields(a.Value)
+		default:
+			return p.errorf(line, "<template> doesn't take attribute %q", a.Name.Local)
+		}
+	}
+
+	if name == "" {
+		return p.errorf(line, "<template> needs a name")
+	}
+
+	if old, ok := p.templates[name]; ok {
+		return p.errorf(line, "template %q is already defined on line %v", name, old.line)
+	}
+
+	for _, param := range t.params {
+		if isGroupAttr(param) {
+			return p.errorf(line, "%q can't be a parameter, <use> already takes it", param)
+		}
+	}
+
+	// Keep the body as it is, since it can't be checked properly until the
+	// parameters are filled in.
+	depth := 0
+
+	for {
+		tok, l, err := p.token()
+		if err == io.EOF {
+			return p.errorf(l, "<template> is never closed")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+
+		if depth < 0 {
+			break
+		}
+
+		t.body = append(t.body, recorded{tok, l})
+	}
+
+	p.templates[name] = t
+
+	return nil
+}
+
+func (p *parser) use(start xml.StartElement, line int) (*Element, error) {
+	var name string
+	args := make(map[string]string)
+
+	g, err := p.group(start, line, func(attr, value string) bool {
+		if attr == "template" {
+			name = value
+		} else {
+			args[attr] = value
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.empty("use")
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := p.templates[name]
+	if name == "" {
+		return nil, p.errorf(line, "<use> needs a template")
+	}
+	if !ok {
+		return nil, p.errorf(line, "unknown template %q, templates have to be defined before they're used", name)
+	}
+
+	for _, u := range p.using {
+		if u == name {
+			return nil, p.errorf(line, "template %q uses itself", name)
+		}
+	}
+
+	vars := make(map[string]string)
+
+	for _, param := range t.params {
+		v, ok := args[param]
+		if !ok {
+			return nil, p.errorf(line, "template %q needs %q", name, param)
+		}
+
+		vars[param] = v
+		delete(args, param)
+	}
+
+	if len(args) != 0 {
+		extra := make([]string, 0, len(args))
+		for a := range args {
+			extra = append(extra, a)
+		}
+		sort.Strings(extra)
+
+		return nil, p.errorf(line, "template %q doesn't take %q", name, extra[0])
+	}
+
+	sub := *p
+	sub.src = &replaySource{body: t.body, vars: vars}
+	sub.prefix = childPrefix(p.prefix, g.Name)
+	sub.using = append(append([]string(nil), p.using...), name)
+
+	g.Children, err = sub.children("")
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (p *parser) include(start xml.StartElement, line int) (*Element, error) {
+	var src string
+
+	g, err := p.group(start, line, func(attr, value string) bool {
+		if attr == "src" {
+			src = value
+		}
+
+		return attr == "src"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.empty("include")
+	if err != nil {
+		return nil, err
+	}
+
+	if src == "" {
+		return nil, p.errorf(line, "<include> needs a src")
+	}
+
+	if p.fsys == nil {
+		return nil, p.errorf(line, "can't include %q without a directory to include from", src)
+	}
+
+	key := path.Join(path.Dir(p.file), src)
+
+	for _, f := range p.including {
+		if f == key {
+			return nil, p.errorf(line, "include cycle: %v -> %v", strings.Join(p.including, " -> "), key)
+		}
+	}
+
+	f, err := p.fsys.Open(key)
+	if err != nil {
+		return nil, p.errorf(line, "can't include %q: %v", src, err)
+	}
+	defer f.Close()
+
+	sub := &parser{
+		state:     p.state,
+		file:      key,
+		src:       &decoderSource{xml.NewDecoder(f)},
+		prefix:    childPrefix(p.prefix, g.Name),
+		templates: make(map[string]*template),
+		including: append(append([]string(nil), p.including...), key),
+	}
+
+	r, err := sub.room()
+	if err != nil {
+		return nil, err
+	}
+
+	g.Children = r.Elements
+
+	return g, nil
+}
+
+// group makes the element an include or use turns into. Attributes which
+// aren't for the group are given to other, which says whether it took them.
+func (p *parser) group(start xml.StartElement, line int, other func(attr, value string) bool) (*Element, error) {
+	g := &Element{
+		Kind:  El,
+		Scale: Vector{1, 1, 1},
+		Line:  line,
+	}
+
+	for _, a := range start.Attr {
+		if isGroupAttr(a.Name.Local) {
+			err := p.attr(g, a.Name.Local, a.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if !other(a.Name.Local, a.Value) {
+			return nil, p.errorf(line, "<%v> doesn't take attribute %q", start.Name.Local, a.Name.Local)
+		}
+	}
+
+	return g, p.name(g)
+}
+
+// empty reads the end of an element which can't have anything in it.
+func (p *parser) empty(kind string) error {
+	t, line, err := p.token()
+	if err == io.EOF {
+		return p.errorf(line, "<%v> is never closed", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, ok := t.(xml.EndElement); !ok {
+		return p.errorf(line, "<%v> can't have anything in it", kind)
+	}
+
+	return nil
+}
+
+func isGroupAttr(attr string) bool {
+	switch attr {
+	case "name", "x", "y", "z", "scale-x", "scale-y", "scale-z":
+		return true
+	}
+
+	return false
+}
+
+// childPrefix is the prefix for the names inside a group. The group's name has
+// already been prefixed, so it's used as it is.
+func childPrefix(prefix, group string) string {
+	if group == "" {
+		return prefix
+	}
+
+	return group + "/"
+}
+
+// replaySource plays back the body of a template, filling in its parameters.
+type replaySource struct {
+	body []recorded
+	vars map[string]string
+	i    int
+}
+
+func (s *replaySource) next() (xml.Token, int, error) {
+	if s.i >= len(s.body) {
+		line := 0
+		if len(s.body) > 0 {
+			line = s.body[len(s.body)-1].line
+		}
+
+		return nil, line, io.EOF
+	}
+
+	r := s.body[s.i]
+	s.i++
+
+	start, ok := r.tok.(xml.StartElement)
+	if !ok {
+		return r.tok, r.line, nil
+	}
+
+	start = start.Copy()
+
+	for i, a := range start.Attr {
+		v, err := s.fill(a.Value)
+		if err != nil {
+			return nil, r.line, err
+		}
+
+		start.Attr[i].Value = v
+	}
+
+	return start, r.line, nil
+}
+
+// fill replaces every ${param} in the value.
+func (s *replaySource) fill(v string) (string, error) {
+	var b strings.Builder
+
+	for {
+		i := strings.Index(v, "${")
+		if i < 0 {
+			b.WriteString(v)
+			return b.String(), nil
+		}
+
+		j := strings.Index(v[i:], "}")
+		if j < 0 {
+			return "", fmt.Errorf("%q has an unclosed ${", v)
+		}
+
+		name := v[i+2 : i+j]
+
+		val, ok := s.vars[name]
+		if !ok {
+			return "", fmt.Errorf("unknown parameter %q", name)
+		}
+
+		b.WriteString(v[:i])
+		b.WriteString(val)
+		v = v[i+j+1:]
+	}
+}
@@ -0,0 +1,398 @@
+// Package gsml parses GSML, the XML based format rooms are described in.
+//
+// A room is a <room> element containing any number of <el>, <box> and <plane>
+// elements, which can themselves be nested:
+//
+//	<room>
+//	  <el name="roof" model="plane" scale-y="-0.1" y="5"/>
+//	  <box name="pillar" scale-y="5" y="2.5" x="-4.5" z="4.5"/>
+//	</room>
+//
+// Rooms can be put together from other files and templates, see ParseFS.
+package gsml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	El    = "el"    // A model, or just a group of elements if it hasn't got one.
+	Box   = "box"   // A unit cube.
+	Plane = "plane" // A unit square, flat along X and Z.
+)
+
+type Vector struct {
+	X, Y, Z float64
+}
+
+// Element is a single thing in a room. Positions are relative to the parent,
+// and scales multiply the parent's.
+type Element struct {
+	Kind     string
+	Name     string
+	Model    string // Only for El.
+	Position Vector
+	Scale    Vector // Defaults to 1 along every axis.
+	Children []*Element
+
+	Line int // Where the element starts in the file.
+}
+
+type Room struct {
+	Elements []*Element
+
+	// Files lists every file the room was built from, starting with its
+	// own. Empty if it was parsed with Parse.
+	Files []string
+}
+
+// Walk calls fn for every element in the room, parents before their children.
+func (r *Room) Walk(fn func(e *Element)) {
+	var walk func(es []*Element)
+
+	walk = func(es []*Element) {
+		for _, e := range es {
+			fn(e)
+			walk(e.Children)
+		}
+	}
+
+	walk(r.Elements)
+}
+
+// Error is a problem with a GSML file, along with where it is.
+type Error struct {
+	File string // Empty if parsed with Parse.
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %v: %v", e.Line, e.Msg)
+	}
+
+	return fmt.Sprintf("%v:%v: %v", e.File, e.Line, e.Msg)
+}
+
+// ParseFile parses and validates the GSML file at path. Includes are relative
+// to the file's directory, and errors name files relative to it too.
+func ParseFile(path string) (*Room, error) {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	return ParseFS(os.DirFS(dir), file)
+}
+
+// Parse parses and validates GSML, stopping at the first problem. There's
+// nowhere to include files from, so <include> is an error.
+func Parse(r io.Reader) (*Room, error) {
+	p := newParser(nil, "", &decoderSource{xml.NewDecoder(r)})
+
+	return p.room()
+}
+
+type parser struct {
+	*state
+
+	file      string
+	src       source
+	prefix    string               // Added to the name of every element.
+	templates map[string]*template // Defined in this file so far.
+	including []string             // Files being included, to catch cycles.
+	using     []string             // Templates being used, to catch cycles.
+}
+
+// state is shared by the parsers for every file in a room.
+type state struct {
+	fsys  fs.FS
+	names map[string]where
+	files []string
+}
+
+type where struct {
+	file string
+	line int
+}
+
+func newParser(fsys fs.FS, file string, src source) *parser {
+	return &parser{
+		state: &state{
+			fsys:  fsys,
+			names: make(map[string]where),
+		},
+		file:      file,
+		src:       src,
+		templates: make(map[string]*template),
+	}
+}
+
+func (p *parser) errorf(line int, format string, args ...interface{}) error {
+	return &Error{File: p.file, Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// token reads the next token that matters, skipping comments, whitespace and
+// the like, along with the line it's on.
+func (p *parser) token() (xml.Token, int, error) {
+	for {
+		t, line, err := p.src.next()
+		if err == io.EOF {
+			return nil, line, err
+		}
+
+		if se, ok := err.(*xml.SyntaxError); ok {
+			return nil, se.Line, p.errorf(se.Line, "%v", se.Msg)
+		}
+
+		if _, ok := err.(*Error); ok {
+			return nil, line, err
+		}
+
+		if err != nil {
+			return nil, line, p.errorf(line, "%v", err)
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement, xml.EndElement:
+			return t, line, nil
+		case xml.CharData:
+			if len(strings.TrimSpace(string(t))) != 0 {
+				return nil, line, p.errorf(line, "unexpected text %q", strings.TrimSpace(string(t)))
+			}
+		}
+	}
+}
+
+func (p *parser) room() (*Room, error) {
+	t, line, err := p.token()
+	if err == io.EOF {
+		return nil, p.errorf(line, "expected <room>, got nothing")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start, ok := t.(xml.StartElement)
+	if !ok || start.Name.Local != "room" {
+		return nil, p.errorf(line, "expected <room>")
+	}
+
+	if len(start.Attr) != 0 {
+		return nil, p.errorf(line, "<room> doesn't take attribute %q", start.Attr[0].Name.Local)
+	}
+
+	if p.file != "" {
+		p.files = append(p.files, p.file)
+	}
+
+	r := &Room{}
+
+	for {
+		t, line, err := p.token()
+		if err == io.EOF {
+			return nil, p.errorf(line, "<room> is never closed")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			break
+		}
+
+		// Templates can only be defined at the top, so they're handled
+		// here rather than with the other elements.
+		if start.Name.Local == "template" {
+			err = p.template(start, line)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		e, err := p.element(start, line)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Elements = append(r.Elements, e)
+	}
+
+	_, line, err = p.token()
+	if err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, p.errorf(line, "unexpected content after </room>")
+	}
+
+	r.Files = p.files
+
+	return r, nil
+}
+
+// children reads elements until the parent's end tag, or until there's
+// nothing left if parent is empty.
+func (p *parser) children(parent string) ([]*Element, error) {
+	var es []*Element
+
+	for {
+		t, line, err := p.token()
+		if err == io.EOF && parent == "" {
+			return es, nil
+		}
+		if err == io.EOF {
+			return nil, p.errorf(line, "<%v> is never closed", parent)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.EndElement:
+			return es, nil
+		case xml.StartElement:
+			e, err := p.element(t, line)
+			if err != nil {
+				return nil, err
+			}
+
+			es = append(es, e)
+		}
+	}
+}
+
+func (p *parser) element(start xml.StartElement, line int) (*Element, error) {
+	e := &Element{
+		Kind:  start.Name.Local,
+		Scale: Vector{1, 1, 1},
+		Line:  line,
+	}
+
+	switch e.Kind {
+	case El, Box, Plane:
+	case "include":
+		return p.include(start, line)
+	case "use":
+		return p.use(start, line)
+	case "template":
+		return nil, p.errorf(line, "templates can only be defined directly in <room>")
+	default:
+		return nil, p.errorf(line, "unknown element <%v>", e.Kind)
+	}
+
+	for _, a := range start.Attr {
+		err := p.attr(e, a.Name.Local, a.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := p.name(e)
+	if err != nil {
+		return nil, err
+	}
+
+	e.Children, err = p.children(e.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// name prefixes the element's name and makes sure it's unique.
+func (p *parser) name(e *Element) error {
+	if e.Name == "" {
+		return nil
+	}
+
+	e.Name = p.prefix + e.Name
+
+	if w, ok := p.names[e.Name]; ok {
+		if w.file != p.file {
+			return p.errorf(e.Line, "name %q is already used on line %v of %v", e.Name, w.line, w.file)
+		}
+
+		return p.errorf(e.Line, "name %q is already used on line %v", e.Name, w.line)
+	}
+
+	p.names[e.Name] = where{p.file, e.Line}
+
+	return nil
+}
+
+func (p *parser) attr(e *Element, name, value string) error {
+	var f *float64
+
+	switch name {
+	case "name":
+		e.Name = value
+		return nil
+	case "model":
+		if e.Kind != El {
+			return p.errorf(e.Line, "only <el> can have a model, not <%v>", e.Kind)
+		}
+
+		e.Model = value
+		return nil
+	case "x":
+		f = &e.Position.X
+	case "y":
+		f = &e.Position.Y
+	case "z":
+		f = &e.Position.Z
+	case "scale-x":
+		f = &e.Scale.X
+	case "scale-y":
+		f = &e.Scale.Y
+	case "scale-z":
+		f = &e.Scale.Z
+	default:
+		return p.errorf(e.Line, "<%v> doesn't take attribute %q", e.Kind, name)
+	}
+
+	// NaN and Inf parse, but nothing can be put anywhere with them.
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return p.errorf(e.Line, "%v should be a number, not %q", name, value)
+	}
+
+	*f = v
+
+	return nil
+}
+
+// source is where a parser gets its tokens from.
+type source interface {
+	// next returns the next token and the line it's on.
+	next() (xml.Token, int, error)
+}
+
+type decoderSource struct {
+	d *xml.Decoder
+}
+
+func (s *decoderSource) next() (xml.Token, int, error) {
+	t, err := s.d.Token()
+	line, _ := s.d.InputPos()
+
+	if err != nil {
+		return nil, line, err
+	}
+
+	return xml.CopyToken(t), line, nil
+}
@@ -0,0 +1,139 @@
+package gsml
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const pillars = `<room>
+  <el name="roof" model="plane" scale-y="-0.1" y="5"/>
+
+  <box name="pillar_bl" scale-y="5" y="2.5" x="-4.5" z="4.5"/>
+
+  <el name="stage">
+    <plane name="ground" scale-x="2" y="0"/>
+  </el>
+</room>
+`
+
+func TestParse(t *testing.T) {
+	r, err := Parse(strings.NewReader(pillars))
+	if err != nil {
+		t.Fatal("Couldn't parse room:", err)
+	}
+
+	if len(r.Elements) != 3 {
+		t.Fatalf("Expected 3 elements, got %v", len(r.Elements))
+	}
+
+	roof := r.Elements[0]
+	if roof.Kind != El || roof.Model != "plane" || roof.Position.Y != 5 || roof.Scale != (Vector{1, -0.1, 1}) || roof.Line != 2 {
+		t.Fatalf("Roof wasn't parsed properly: %+v", roof)
+	}
+
+	pillar := r.Elements[1]
+	if pillar.Kind != Box || pillar.Position != (Vector{-4.5, 2.5, 4.5}) {
+		t.Fatalf("Pillar wasn't parsed properly: %+v", pillar)
+	}
+
+	var names []string
+	r.Walk(func(e *Element) { names = append(names, e.Name) })
+
+	if strings.Join(names, ",") != "roof,pillar_bl,stage,ground" {
+		t.Fatal("Walked elements in the wrong order:", names)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		"":                                                 "line 1: expected <room>, got nothing",
+		"<world></world>":                                  "line 1: expected <room>",
+		"<room>\n<box>\n</room>":                           "line 3: element <box> closed by </room>",
+		"<room>\n  <sphere/>\n</room>":                     "line 2: unknown element <sphere>",
+		"<room>\n\n<box x=\"left\"/></room>":               `line 3: x should be a number, not "left"`,
+		"<room><box y=\"NaN\"/></room>":                    `line 1: y should be a number, not "NaN"`,
+		"<room><box scale-x=\"-Inf\"/></room>":             `line 1: scale-x should be a number, not "-Inf"`,
+		"<room><box colour=\"red\"/></room>":               `line 1: <box> doesn't take attribute "colour"`,
+		"<room><box model=\"crate\"/></room>":              "line 1: only <el> can have a model, not <box>",
+		"<room>hello</room>":                               `line 1: unexpected text "hello"`,
+		"<room></room><room></room>":                       "line 1: unexpected content after </room>",
+		"<room><box name=\"a\"/>\n<el name=\"a\"/></room>": `line 2: name "a" is already used on line 1`,
+	} {
+		_, err := Parse(strings.NewReader(src))
+		if err == nil || err.Error() != want {
+			t.Errorf("Parsing %q: expected %q, got %v", src, want, err)
+		}
+	}
+}
+
+var composed = fstest.MapFS{
+	"room.gsml": {Data: []byte(`<room>
+  <template name="pillar" params="height">
+    <box name="pillar" scale-y="${height}"/>
+  </template>
+
+  <use template="pillar" name="left" height="5" x="-4.5"/>
+  <use template="pillar" name="right" height="3" x="4.5"/>
+
+  <include src="parts/stage.gsml" name="stage" y="1"/>
+</room>`)},
+	"parts/stage.gsml": {Data: []byte(`<room>
+  <plane name="floor"/>
+  <include src="lights.gsml"/>
+</room>`)},
+	"parts/lights.gsml": {Data: []byte(`<room><el name="light" model="lamp"/></room>`)},
+
+	"a.gsml": {Data: []byte(`<room><include src="b.gsml"/></room>`)},
+	"b.gsml": {Data: []byte("<room>\n<include src=\"a.gsml\"/></room>")},
+	"loop.gsml": {Data: []byte(`<room>
+  <template name="loop"><use template="loop"/></template>
+  <use template="loop"/>
+</room>`)},
+}
+
+func TestParseFS(t *testing.T) {
+	r, err := ParseFS(composed, "room.gsml")
+	if err != nil {
+		t.Fatal("Couldn't parse room:", err)
+	}
+
+	var names []string
+	r.Walk(func(e *Element) { names = append(names, e.Name) })
+
+	if strings.Join(names, ",") != "left,left/pillar,right,right/pillar,stage,stage/floor,,stage/light" {
+		t.Fatal("Room wasn't put together properly:", names)
+	}
+
+	if r.Elements[1].Position.X != 4.5 || r.Elements[1].Children[0].Scale.Y != 3 {
+		t.Fatalf("Template wasn't filled in: %+v", r.Elements[1].Children[0])
+	}
+
+	if strings.Join(r.Files, ",") != "room.gsml,parts/stage.gsml,parts/lights.gsml" {
+		t.Fatal("Wrong files:", r.Files)
+	}
+
+	// The flattened room should parse to the same thing on its own.
+	flat, err := Parse(bytes.NewReader(r.GSML()))
+	if err != nil {
+		t.Fatalf("Couldn't parse flattened room: %v\n%s", err, r.GSML())
+	}
+
+	var flatNames []string
+	flat.Walk(func(e *Element) { flatNames = append(flatNames, e.Name) })
+
+	if strings.Join(flatNames, ",") != strings.Join(names, ",") {
+		t.Fatal("Flattened room is different:", flatNames)
+	}
+
+	_, err = ParseFS(composed, "a.gsml")
+	if err == nil || err.Error() != "b.gsml:2: include cycle: a.gsml -> b.gsml -> a.gsml" {
+		t.Fatal("Expected an include cycle, got:", err)
+	}
+
+	_, err = ParseFS(composed, "loop.gsml")
+	if err == nil || err.Error() != `loop.gsml:2: template "loop" uses itself` {
+		t.Fatal("Expected a template cycle, got:", err)
+	}
+}
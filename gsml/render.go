@@ -0,0 +1,70 @@
+package gsml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// GSML writes the room back out. Rooms from ParseFS come out flattened, with
+// every include and template filled in, so clients only need the one file.
+func (r *Room) GSML() []byte {
+	var b bytes.Buffer
+
+	b.WriteString("<room>\n")
+
+	for _, e := range r.Elements {
+		writeElement(&b, e, 1)
+	}
+
+	b.WriteString("</room>\n")
+
+	return b.Bytes()
+}
+
+func writeElement(b *bytes.Buffer, e *Element, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	b.WriteString(indent + "<" + e.Kind)
+
+	attr := func(name, value string) {
+		b.WriteString(" " + name + `="`)
+		xml.EscapeText(b, []byte(value))
+		b.WriteString(`"`)
+	}
+
+	num := func(name string, v, def float64) {
+		if v != def {
+			attr(name, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	}
+
+	if e.Name != "" {
+		attr("name", e.Name)
+	}
+
+	if e.Model != "" {
+		attr("model", e.Model)
+	}
+
+	num("x", e.Position.X, 0)
+	num("y", e.Position.Y, 0)
+	num("z", e.Position.Z, 0)
+	num("scale-x", e.Scale.X, 1)
+	num("scale-y", e.Scale.Y, 1)
+	num("scale-z", e.Scale.Z, 1)
+
+	if len(e.Children) == 0 {
+		b.WriteString("/>\n")
+		return
+	}
+
+	b.WriteString(">\n")
+
+	for _, c := range e.Children {
+		writeElement(b, c, depth+1)
+	}
+
+	b.WriteString(indent + "</" + e.Kind + ">\n")
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	DefaultInterestHysteresis = 0.1
+)
+
+type cell struct {
+	X, Y, Z int64
+}
+
+// Grid is a spatial hash of positions keyed by ID. Cells are cubes of
+// CellSize, so looking up everything within a radius only has to look at the
+// handful of cells the radius touches.
+type Grid struct {
+	CellSize float64
+
+	cells map[cell]map[uint]Point
+	where map[uint]cell
+	lock  sync.RWMutex
+}
+
+func NewGrid(size float64) *Grid {
+	return &Grid{
+		CellSize: size,
+		cells:    make(map[cell]map[uint]Point),
+		where:    make(map[uint]cell),
+	}
+}
+
+func (g *Grid) cellOf(p Point) cell {
+	return cell{
+		X: int64(math.Floor(p.X / g.CellSize)),
+		Y: int64(math.Floor(p.Y / g.CellSize)),
+		Z: int64(math.Floor(p.Z / g.CellSize)),
+	}
+}
+
+func (g *Grid) Move(id uint, p Point) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	c := g.cellOf(p)
+
+	old, ok := g.where[id]
+	if ok && old != c {
+		g.remove(id, old)
+	}
+
+	if g.cells[c] == nil {
+		g.cells[c] = make(map[uint]Point)
+	}
+
+	g.cells[c][id] = p
+	g.where[id] = c
+}
+
+func (g *Grid) Remove(id uint) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	c, ok := g.where[id]
+	if ok {
+		g.remove(id, c)
+	}
+}
+
+func (g *Grid) remove(id uint, c cell) {
+	delete(g.cells[c], id)
+	if len(g.cells[c]) == 0 {
+		delete(g.cells, c)
+	}
+
+	delete(g.where, id)
+}
+
+func (g *Grid) Has(id uint) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	_, ok := g.where[id]
+	return ok
+}
+
+// Near returns the position of everything within radius of p.
+func (g *Grid) Near(p Point, radius float64) map[uint]Point {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	min := g.cellOf(Point{p.X - radius, p.Y - radius, p.Z - radius})
+	max := g.cellOf(Point{p.X + radius, p.Y + radius, p.Z + radius})
+
+	near := make(map[uint]Point)
+
+	for x := min.X; x <= max.X; x++ {
+		for y := min.Y; y <= max.Y; y++ {
+			for z := min.Z; z <= max.Z; z++ {
+				for id, q := range g.cells[cell{x, y, z}] {
+					if p.Distance(q) <= radius {
+						near[id] = q
+					}
+				}
+			}
+		}
+	}
+
+	return near
+}
+
+// Interest decides which players get told about which node updates, based on
+// how far each node is from the player's head. A node comes into view at the
+// player's radius but only leaves it once it is Hysteresis times further out,
+// so nodes sitting on the edge don't flap in and out.
+type Interest struct {
+	Radius     float64 // The furthest anyone sees, and how far players who haven't asked for less do.
+	Hysteresis float64
+
+	heads     *Grid
+	radii     map[uint]float64          // Of every tracked player, by ID.
+	maxRadius float64                   // The largest of radii.
+	visible   map[uint]map[NodeRef]bool // By viewing player.
+	lock      sync.Mutex
+}
+
+func NewInterest(radius, hysteresis float64) *Interest {
+	if hysteresis == 0 {
+		hysteresis = DefaultInterestHysteresis
+	}
+
+	return &Interest{
+		Radius:     radius,
+		Hysteresis: hysteresis,
+		heads:      NewGrid(radius),
+		radii:      make(map[uint]float64),
+		visible:    make(map[uint]map[NodeRef]bool),
+	}
+}
+
+// radius is how far the player can see. Players can ask to see less than the
+// room's radius, but not more.
+func (in *Interest) radius(p *Player) float64 {
+	if p.InterestRadius > 0 && p.InterestRadius < in.Radius {
+		return p.InterestRadius
+	}
+
+	return in.Radius
+}
+
+// Track moves the player's view to wherever their head is.
+func (in *Interest) Track(p *Player, head Point) {
+	in.lock.Lock()
+	if r := in.radius(p); in.radii[p.ID] != r {
+		in.radii[p.ID] = r
+		in.updateMaxRadius()
+	}
+	in.lock.Unlock()
+
+	in.heads.Move(p.ID, head)
+}
+
+// Forget stops tracking the player, and what everyone else could see of
+// them.
+func (in *Interest) Forget(pid uint) {
+	in.heads.Remove(pid)
+
+	in.lock.Lock()
+	delete(in.visible, pid)
+	for _, vis := range in.visible {
+		for k := range vis {
+			if k.PID == pid {
+				delete(vis, k)
+			}
+		}
+	}
+	if _, ok := in.radii[pid]; ok {
+		delete(in.radii, pid)
+		in.updateMaxRadius()
+	}
+	in.lock.Unlock()
+}
+
+// updateMaxRadius works out how far Recipients has to search from the players
+// being tracked now. It's called with the lock held.
+func (in *Interest) updateMaxRadius() {
+	in.maxRadius = 0
+
+	for _, r := range in.radii {
+		in.maxRadius = math.Max(in.maxRadius, r)
+	}
+}
+
+// Recipients filters players down to those who can see the updated node, and
+// those who could see it until now, who need to be told it's gone. Players
+// always see their own nodes, and players without a head yet see everything.
+func (in *Interest) Recipients(un *UpdateNode, players []*Player) (see, left []*Player) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	near := in.heads.Near(un.Position, in.maxRadius*(1+in.Hysteresis))
+	k := NodeRef{un.PID, un.NID}
+
+	for _, p := range players {
+		if p.ID == un.PID {
+			see = append(see, p)
+			continue
+		}
+
+		vis, ok := in.visible[p.ID]
+		if !ok {
+			vis = make(map[NodeRef]bool)
+			in.visible[p.ID] = vis
+		}
+
+		if !in.heads.Has(p.ID) {
+			vis[k] = true
+			see = append(see, p)
+			continue
+		}
+
+		d := math.Inf(1)
+		if head, ok := near[p.ID]; ok {
+			d = head.Distance(un.Position)
+		}
+
+		r := in.radius(p)
+		sees := d <= r || (vis[k] && d <= r*(1+in.Hysteresis))
+
+		if sees {
+			vis[k] = true
+			see = append(see, p)
+		} else if vis[k] {
+			delete(vis, k)
+			left = append(left, p)
+		}
+	}
+
+	return see, left
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HashKeyPrefix marks an asset key as a SHA-256 hash rather than a path, as in
+// "sha256/<hex>". Assets fetched by hash never change, so they can be cached
+// forever.
+const HashKeyPrefix = "sha256/"
+
+// FlattenedKeyPrefix is put in front of a room's key for the flattened version
+// of it, as in "flattened/room.gsml". It hides any real directory of the same
+// name.
+const FlattenedKeyPrefix = "flattened/"
+
+// AssetInfo describes one asset in the manifest.
+type AssetInfo struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"` // Hex encoded SHA-256 of the contents.
+	Size int64  `json:"size"`
+	Type string `json:"type"` // MIME type.
+
+	modTime time.Time // Of the file when it was hashed.
+}
+
+// Manifest lists every asset the asset server has, by key.
+type Manifest struct {
+	Assets map[string]AssetInfo
+
+	byHash map[string]string // Hash to key.
+}
+
+// ScanAssets hashes every file in the directory. Hidden files, which the
+// asset server won't serve, are left out.
+func ScanAssets(dir string) (*Manifest, error) {
+	return rescanAssets(dir, nil)
+}
+
+// rescanAssets is ScanAssets, but files whose size and modification time are
+// the same as in the previous scan keep their old hash instead of being read
+// again.
+func rescanAssets(dir string, prev *Manifest) (*Manifest, error) {
+	m := &Manifest{
+		Assets: make(map[string]AssetInfo),
+		byHash: make(map[string]string),
+	}
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p != dir && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+
+		ai, ok := AssetInfo{}, false
+		if prev != nil {
+			ai, ok = prev.Assets[key]
+		}
+
+		if !ok || ai.Size != fi.Size() || !ai.modTime.Equal(fi.ModTime()) {
+			ai, err = hashAsset(p, key)
+			if err != nil {
+				return err
+			}
+
+			ai.modTime = fi.ModTime()
+		}
+
+		m.Assets[ai.Key] = ai
+		m.byHash[ai.Hash] = ai.Key
+
+		return nil
+	})
+
+	return m, err
+}
+
+func hashAsset(file, key string) (AssetInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return AssetInfo{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return AssetInfo{}, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return AssetInfo{}, err
+	}
+
+	t, err := contentType(key, f)
+	if err != nil {
+		return AssetInfo{}, err
+	}
+
+	return AssetInfo{
+		Key:  key,
+		Hash: hex.EncodeToString(h.Sum(nil)),
+		Size: n,
+		Type: t,
+	}, nil
+}
+
+func hashOf(b []byte) string {
+	h := sha256.Sum256(b)
+
+	return hex.EncodeToString(h[:])
+}
+
+// hashMatches checks whether f still holds what was hashed, leaving it at the
+// start for whatever reads it next.
+func hashMatches(f io.ReadSeeker, hash string) (bool, error) {
+	h := sha256.New()
+
+	_, err := io.Copy(h, f)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+
+	return hex.EncodeToString(h.Sum(nil)) == hash, err
+}
+
+// Lookup finds an asset by key, or by hash if the key starts with
+// HashKeyPrefix.
+func (m *Manifest) Lookup(key string) (AssetInfo, bool) {
+	if m == nil {
+		return AssetInfo{}, false
+	}
+
+	if strings.HasPrefix(key, HashKeyPrefix) {
+		k, ok := m.byHash[strings.TrimPrefix(key, HashKeyPrefix)]
+		if !ok {
+			return AssetInfo{}, false
+		}
+
+		key = k
+	}
+
+	ai, ok := m.Assets[key]
+	return ai, ok
+}
+
+// generatedAsset is served as if it were a file in the assets directory, such
+// as a flattened room.
+type generatedAsset struct {
+	info    AssetInfo
+	data    []byte
+	modTime time.Time
+}
+
+// Generate serves data under the key as if it were a file, replacing whatever
+// was generated under it before. Generated assets take precedence over files.
+func (as *AssetServer) Generate(key string, data []byte) (AssetInfo, error) {
+	t, err := contentType(key, bytes.NewReader(data))
+	if err != nil {
+		return AssetInfo{}, err
+	}
+
+	g := &generatedAsset{
+		info: AssetInfo{
+			Key:  key,
+			Hash: hashOf(data),
+			Size: int64(len(data)),
+			Type: t,
+		},
+		data:    data,
+		modTime: time.Now(),
+	}
+
+	as.manifestLock.Lock()
+	defer as.manifestLock.Unlock()
+
+	if old, ok := as.generated[key]; ok && old.info.Hash == g.info.Hash {
+		return old.info, nil
+	}
+
+	if as.generated == nil {
+		as.generated = make(map[string]*generatedAsset)
+	}
+
+	as.generated[key] = g
+
+	return g.info, nil
+}
+
+func (as *AssetServer) generatedAsset(key string) *generatedAsset {
+	as.manifestLock.RLock()
+	defer as.manifestLock.RUnlock()
+
+	return as.generated[key]
+}
+
+// Lookup finds an asset by key, or by hash if the key starts with
+// HashKeyPrefix, whether it's a file or generated.
+func (as *AssetServer) Lookup(key string) (AssetInfo, bool) {
+	as.manifestLock.RLock()
+	defer as.manifestLock.RUnlock()
+
+	for _, g := range as.generated {
+		if g.info.Key == key || HashKeyPrefix+g.info.Hash == key {
+			return g.info, true
+		}
+	}
+
+	return as.manifest.Lookup(key)
+}
+
+// Assets lists every asset, files and generated, by key.
+func (as *AssetServer) Assets() map[string]AssetInfo {
+	as.manifestLock.RLock()
+	defer as.manifestLock.RUnlock()
+
+	assets := make(map[string]AssetInfo)
+
+	if as.manifest != nil {
+		for k, ai := range as.manifest.Assets {
+			assets[k] = ai
+		}
+	}
+
+	for k, g := range as.generated {
+		assets[k] = g.info
+	}
+
+	return assets
+}
+
+func (g *generatedAsset) open() http.File {
+	return &generatedFile{Reader: bytes.NewReader(g.data), a: g}
+}
+
+func (g *generatedAsset) Name() string       { return g.info.Key }
+func (g *generatedAsset) Size() int64        { return g.info.Size }
+func (g *generatedAsset) Mode() os.FileMode  { return 0444 }
+func (g *generatedAsset) ModTime() time.Time { return g.modTime }
+func (g *generatedAsset) IsDir() bool        { return false }
+func (g *generatedAsset) Sys() interface{}   { return nil }
+
+// generatedFile reads a generated asset.
+type generatedFile struct {
+	*bytes.Reader
+
+	a *generatedAsset
+}
+
+func (f *generatedFile) Close() error { return nil }
+
+func (f *generatedFile) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *generatedFile) Stat() (os.FileInfo, error) { return f.a, nil }
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unknownCommand labels commands without a handler, so clients can't make up
+// as many labels as they like.
+const unknownCommand = "unknown"
+
+// Metrics measures the load on a server, in the Prometheus format. Every
+// method does nothing on a nil Metrics, so the parts of the server which can
+// be used on their own don't need one.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	connsOpen  prometheus.Gauge
+	connsTotal prometheus.Counter
+
+	commands        *prometheus.CounterVec
+	commandErrors   *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+
+	nodeUpdates       prometheus.Counter
+	broadcastDuration *prometheus.HistogramVec
+	tickDuration      *prometheus.HistogramVec
+	players           *prometheus.GaugeVec
+
+	assetRequests *prometheus.CounterVec
+	assetSize     prometheus.Histogram
+	assetDuration prometheus.Histogram
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		connsOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gns_connections_open",
+			Help: "Connections to the game server which are open.",
+		}),
+		connsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gns_connections_total",
+			Help: "Connections accepted by the game server.",
+		}),
+
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gns_commands_total",
+			Help: "Communications handled, by command.",
+		}, []string{"command"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gns_command_errors_total",
+			Help: "Communications whose handler returned an error, by command.",
+		}, []string{"command"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gns_command_duration_seconds",
+			Help:    "How long communications took to handle, by command.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+		}, []string{"command"}),
+
+		nodeUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gns_node_updates_total",
+			Help: "Node updates accepted, over either channel.",
+		}),
+		broadcastDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gns_broadcast_duration_seconds",
+			Help:    "How long broadcasts took to reach everyone they were for, by command.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}, []string{"command"}),
+		tickDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gns_room_tick_duration_seconds",
+			Help:    "How long each room's update loop took per tick, by room.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 12),
+		}, []string{"room"}),
+		players: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gns_players",
+			Help: "Players in each room, as of its last tick.",
+		}, []string{"room"}),
+
+		assetRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gns_asset_requests_total",
+			Help: "Asset requests handled, by result.",
+		}, []string{"result"}),
+		assetSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gns_asset_transfer_bytes",
+			Help:    "Size of the assets sent.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		assetDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gns_asset_transfer_duration_seconds",
+			Help:    "How long assets took to send.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 9),
+		}),
+	}
+
+	m.Registry.MustRegister(
+		m.connsOpen, m.connsTotal,
+		m.commands, m.commandErrors, m.commandDuration,
+		m.nodeUpdates, m.broadcastDuration, m.tickDuration, m.players,
+		m.assetRequests, m.assetSize, m.assetDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) connOpened() {
+	if m == nil {
+		return
+	}
+
+	m.connsOpen.Inc()
+	m.connsTotal.Inc()
+}
+
+func (m *Metrics) connClosed() {
+	if m == nil {
+		return
+	}
+
+	m.connsOpen.Dec()
+}
+
+func (m *Metrics) handled(cmd string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	if err == ErrHandlerNotFound {
+		cmd = unknownCommand
+	}
+
+	m.commands.WithLabelValues(cmd).Inc()
+	m.commandDuration.WithLabelValues(cmd).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.commandErrors.WithLabelValues(cmd).Inc()
+	}
+}
+
+func (m *Metrics) nodeUpdated() {
+	if m == nil {
+		return
+	}
+
+	m.nodeUpdates.Inc()
+}
+
+func (m *Metrics) broadcastSent(cmd string, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.broadcastDuration.WithLabelValues(cmd).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) ticked(room string, players int, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.tickDuration.WithLabelValues(room).Observe(time.Since(start).Seconds())
+	m.players.WithLabelValues(room).Set(float64(players))
+}
+
+// assetSent records an asset request. Size is only counted if the asset was
+// sent.
+func (m *Metrics) assetSent(result string, size int64, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.assetRequests.WithLabelValues(result).Inc()
+
+	if result == "ok" {
+		m.assetSize.Observe(float64(size))
+		m.assetDuration.Observe(time.Since(start).Seconds())
+	}
+}
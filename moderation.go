@@ -0,0 +1,368 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban keeps a username or an address off the server. IP may be a single
+// address or a CIDR range.
+type Ban struct {
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+}
+
+// Target is the username or address the ban is for.
+func (b Ban) Target() string {
+	if b.IP != "" {
+		return b.IP
+	}
+
+	return b.Username
+}
+
+// Matches reports whether the ban applies to a player connecting with the
+// username from the address.
+func (b Ban) Matches(username, ip string) bool {
+	if b.Username != "" {
+		return b.Username == username
+	}
+
+	if _, n, err := net.ParseCIDR(b.IP); err == nil {
+		addr := net.ParseIP(ip)
+		return addr != nil && n.Contains(addr)
+	}
+
+	return b.IP == ip
+}
+
+// BanList is every ban on the server, kept in a JSON file so they outlast
+// restarts. Without a path the bans are only kept in memory.
+type BanList struct {
+	Path string
+
+	bans []Ban
+	lock sync.RWMutex
+}
+
+// Load reads the bans from the file. A file that doesn't exist yet is an
+// empty list.
+func (l *BanList) Load() error {
+	if l.Path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var bans []Ban
+
+	err = json.Unmarshal(b, &bans)
+	if err != nil {
+		return fmt.Errorf("%v: %v", l.Path, err)
+	}
+
+	l.lock.Lock()
+	l.bans = bans
+	l.lock.Unlock()
+
+	return nil
+}
+
+// save writes the bans out. It's called with the lock held.
+func (l *BanList) save() error {
+	if l.Path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(l.bans, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write next to the file and swap it in, so a crash can't leave half a
+	// list behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(l.Path), filepath.Base(l.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), l.Path)
+}
+
+// Add bans the username or address, replacing any ban already on it.
+func (l *BanList) Add(b Ban) error {
+	if b.At.IsZero() {
+		b.At = time.Now()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.bans = append(l.remove(b.Target()), b)
+
+	return l.save()
+}
+
+// Remove lifts the ban on the username or address. It returns false if there
+// wasn't one.
+func (l *BanList) Remove(target string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bans := l.remove(target)
+	if len(bans) == len(l.bans) {
+		return false, nil
+	}
+
+	l.bans = bans
+
+	return true, l.save()
+}
+
+// remove returns the bans without the one on the target. It's called with the
+// lock held.
+func (l *BanList) remove(target string) []Ban {
+	var bans []Ban
+
+	for _, b := range l.bans {
+		if b.Target() != target {
+			bans = append(bans, b)
+		}
+	}
+
+	return bans
+}
+
+// Match returns the ban keeping the player out, if there is one.
+func (l *BanList) Match(username, ip string) (Ban, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	for _, b := range l.bans {
+		if b.Matches(username, ip) {
+			return b, true
+		}
+	}
+
+	return Ban{}, false
+}
+
+// List returns every ban, oldest first.
+func (l *BanList) List() []Ban {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	bans := append([]Ban(nil), l.bans...)
+	sort.SliceStable(bans, func(i, j int) bool { return bans[i].At.Before(bans[j].At) })
+
+	return bans
+}
+
+// Ban adds the ban and kicks everyone it applies to.
+func (s *Server) Ban(b Ban) error {
+	err := s.Bans.Add(b)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range s.players() {
+		if b.Matches(p.Username, p.IP()) {
+			s.Kick(p, banMessage(b))
+		}
+	}
+
+	return nil
+}
+
+// Unban lifts the ban on the username or address.
+func (s *Server) Unban(target string) error {
+	ok, err := s.Bans.Remove(target)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrNotBanned
+	}
+
+	return nil
+}
+
+func banMessage(b Ban) string {
+	if b.Reason == "" {
+		return "You have been banned."
+	}
+
+	return "You have been banned: " + b.Reason
+}
+
+// Operator reports whether the player may run admin commands. Operators are
+// picked by username, which New only allows with a UserAuthenticator to check
+// it, and only one connection at a time can use each.
+func (s *Server) Operator(p *Player) bool {
+	s.operatorsLock.Lock()
+	defer s.operatorsLock.Unlock()
+
+	id, ok := s.operators[p.Username]
+
+	return ok && id == p.ID
+}
+
+func (s *Server) operatorName(username string) bool {
+	for _, u := range s.Opts.Operators {
+		if u == username {
+			return true
+		}
+	}
+
+	return false
+}
+
+// claimOperator keeps the player's username to them if it's an operator's,
+// returning false if someone else is already connected with it.
+func (s *Server) claimOperator(p *Player) bool {
+	if !s.operatorName(p.Username) {
+		return true
+	}
+
+	s.operatorsLock.Lock()
+	defer s.operatorsLock.Unlock()
+
+	if _, ok := s.operators[p.Username]; ok {
+		return false
+	}
+
+	s.operators[p.Username] = p.ID
+
+	return true
+}
+
+// releaseOperator lets someone else connect with the player's username, if
+// they were holding it.
+func (s *Server) releaseOperator(p *Player) {
+	s.operatorsLock.Lock()
+	defer s.operatorsLock.Unlock()
+
+	if id, ok := s.operators[p.Username]; ok && id == p.ID {
+		delete(s.operators, p.Username)
+	}
+}
+
+// players returns every player in every room.
+func (s *Server) players() []*Player {
+	var ps []*Player
+
+	for _, r := range s.Rooms() {
+		ps = append(ps, r.members()...)
+	}
+
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+
+	return ps
+}
+
+// playersNamed returns every player with the username, since without an
+// Authenticator more than one can share it.
+func (s *Server) playersNamed(username string) []*Player {
+	var ps []*Player
+
+	for _, p := range s.players() {
+		if p.Username == username {
+			ps = append(ps, p)
+		}
+	}
+
+	return ps
+}
+
+// Kick disconnects the player from the room, telling them why.
+func (r *Room) Kick(pid uint, reason string) error {
+	p, err := r.Player(pid)
+	if err != nil {
+		return err
+	}
+
+	r.s.log.Printf("Kicking %q (%v) from %v: %v", p.Username, p.ID, r.Opts.Name, reason)
+
+	return r.s.Kick(p, reason)
+}
+
+// Ban keeps the player's username off the server and kicks them.
+func (r *Room) Ban(pid uint, reason string) error {
+	p, err := r.Player(pid)
+	if err != nil {
+		return err
+	}
+
+	return r.s.Ban(Ban{Username: p.Username, Reason: reason})
+}
+
+// BanIP keeps the player's address off the server and kicks everyone
+// connected from it.
+func (r *Room) BanIP(pid uint, reason string) error {
+	p, err := r.Player(pid)
+	if err != nil {
+		return err
+	}
+
+	ip := p.IP()
+	if ip == "" {
+		return ErrNoAddress
+	}
+
+	return r.s.Ban(Ban{IP: ip, Reason: reason})
+}
+
+// Mute stops, or with muted false lets, the player chat and talk.
+func (r *Room) Mute(pid uint, muted bool) error {
+	p, err := r.Player(pid)
+	if err != nil {
+		return err
+	}
+
+	p.setMuted(muted)
+
+	return nil
+}
+
+// remoteIP returns the address a connection is from, without its port.
+func remoteIP(c net.Conn) string {
+	addr := c.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return strings.Trim(addr.String(), "[]")
+	}
+
+	return host
+}
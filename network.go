@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,6 +17,21 @@ import (
 
 const (
 	ConnectionType = "tcp"
+
+	// errorFrameTag starts a frame which carries a JSON ErrorReply in place
+	// of whatever the other end was expecting.
+	errorFrameTag = '!'
+
+	// DefaultMaxFrameSize is the biggest frame the server reads from a game
+	// connection.
+	DefaultMaxFrameSize = 1 << 20
+
+	// maxErrorFrameSize caps error frames on every connection, since they
+	// only ever carry a short message.
+	maxErrorFrameSize = 1 << 16
+
+	// maxAssetKeySize is the biggest asset key the asset server reads.
+	maxAssetKeySize = 4096
 )
 
 type Networker struct {
@@ -24,14 +40,24 @@ type Networker struct {
 
 func (n *Networker) Handle(conn net.Conn, id uint) {
 	rc := &Conn{
-		NConn: conn,
-		ID:    id,
+		NConn:        conn,
+		ID:           id,
+		MaxFrameSize: n.s.Opts.MaxFrameSize,
 
 		log: n.s.log,
 	}
 
 	c := NewComConn(rc)
 
+	if !n.s.track(c) {
+		rc.Close()
+		return
+	}
+	defer n.s.untrack(c)
+
+	n.s.Metrics.connOpened()
+	defer n.s.Metrics.connClosed()
+
 	for {
 		if c.Closed {
 			return
@@ -45,7 +71,10 @@ func (n *Networker) Handle(conn net.Conn, id uint) {
 			return
 		}
 
+		n.s.wg.Add(1)
 		go func(cc *ChildConn) {
+			defer n.s.wg.Done()
+
 			com, err := cc.Com()
 			if err != nil {
 				c.Raw.log.Println("Couldn't read command, disconnecting client:", err)
@@ -53,10 +82,18 @@ func (n *Networker) Handle(conn net.Conn, id uint) {
 				return
 			}
 
-			err = n.s.Room.Handle(com.Command, cc)
+			err = n.s.Handle(com.Command, cc)
 			if err != nil {
 				c.Raw.log.Printf("Couldn't handle com (%s): %v", com.Command, err)
 			}
+
+			if pe, ok := err.(*ProtocolError); ok {
+				c.Send(ErrorCmd, &ErrorReply{
+					Code:    pe.Code,
+					Message: pe.Message,
+					Command: com.Command,
+				})
+			}
 		}(cc)
 
 		time.Sleep(time.Second / time.Duration(n.s.Opts.ReadSpeed))
@@ -64,21 +101,23 @@ func (n *Networker) Handle(conn net.Conn, id uint) {
 }
 
 type ChildConn struct {
-	buf *bytes.Buffer
-	p   *ComConn
+	buf   *bytes.Buffer
+	codec Codec // The codec the communication was encoded with.
+	p     *ComConn
 }
 
-func NewChildConn(b *bytes.Buffer, p *ComConn) *ChildConn {
+func NewChildConn(b *bytes.Buffer, codec Codec, p *ComConn) *ChildConn {
 	return &ChildConn{
-		buf: b,
-		p:   p,
+		buf:   b,
+		codec: codec,
+		p:     p,
 	}
 }
 
 func (cc *ChildConn) Com() (Communication, error) {
 	com := Communication{}
 
-	err := json.Unmarshal(cc.buf.Bytes(), &com)
+	err := cc.codec.Unmarshal(cc.buf.Bytes(), &com)
 	return com, err
 }
 
@@ -87,7 +126,7 @@ func (cc *ChildConn) Read(p Preparer) error {
 		return ErrEmptyBuffer
 	}
 
-	err := json.Unmarshal(cc.buf.Bytes(), p)
+	err := cc.codec.Unmarshal(cc.buf.Bytes(), p)
 	if err != nil {
 		return err
 	}
@@ -112,6 +151,9 @@ type ComConn struct {
 	Raw    *Conn
 	Closed bool
 
+	player     *Player // Set once the connection request has been accepted.
+	playerLock sync.RWMutex
+
 	delayers     []chan struct{}
 	delayersLock sync.RWMutex
 	sendLock     sync.RWMutex
@@ -132,12 +174,12 @@ func (c *ComConn) Read() (*ChildConn, error) {
 		return nil, ErrClientDisconnected
 	}
 
-	buf, err := c.Raw.ReadRaw()
+	buf, codec, err := c.Raw.ReadFrame()
 	if err != nil {
 		return nil, err
 	}
 
-	return NewChildConn(buf, c), nil
+	return NewChildConn(buf, codec, c), nil
 }
 
 // NOTE: Do note use in a concurrent configuration!
@@ -167,6 +209,9 @@ func (c *ComConn) Send(cmd string, v Preparer) error {
 	}
 
 	ch := c.wait()
+	if ch == nil {
+		return ErrClientDisconnected
+	}
 
 	c.sendLock.Lock()
 	err := c.Raw.Send(cmd, v)
@@ -198,8 +243,15 @@ func (c *ComConn) Close() {
 	c.Done()
 }
 
+// wait blocks until the next call to Done. It returns nil if the connection
+// has closed, since nothing would call Done again.
 func (c *ComConn) wait() chan struct{} {
 	c.delayersLock.Lock()
+	if c.Closed {
+		c.delayersLock.Unlock()
+		return nil
+	}
+
 	ch := make(chan struct{})
 
 	c.delayers = append(c.delayers, ch)
@@ -211,6 +263,21 @@ func (c *ComConn) wait() chan struct{} {
 	return ch
 }
 
+// Player returns the player bound to this connection, or nil if the
+// connection hasn't joined the server yet.
+func (c *ComConn) Player() *Player {
+	c.playerLock.RLock()
+	defer c.playerLock.RUnlock()
+
+	return c.player
+}
+
+func (c *ComConn) bind(p *Player) {
+	c.playerLock.Lock()
+	c.player = p
+	c.playerLock.Unlock()
+}
+
 func (c *ComConn) log() *log.Logger {
 	return c.Raw.log
 }
@@ -219,13 +286,47 @@ type Conn struct {
 	NConn net.Conn
 	ID    uint
 
+	// MaxFrameSize is the biggest frame ReadFrame will read, checked before
+	// anything is allocated for it. Zero allows any size, which is only
+	// safe when trusting the other end, such as a client reading assets.
+	MaxFrameSize int
+
+	codec     Codec // Used for sending, frames are read with whichever codec they were sent with.
+	codecLock sync.RWMutex
+
 	connBuf   *bufio.Reader
 	connRLock sync.Mutex
 	connWLock sync.Mutex
 	log       *log.Logger
 }
 
+// Codec returns the codec used to send communications, JSON by default.
+func (c *Conn) Codec() Codec {
+	c.codecLock.RLock()
+	defer c.codecLock.RUnlock()
+
+	if c.codec == nil {
+		return JSONCodec
+	}
+
+	return c.codec
+}
+
+func (c *Conn) SetCodec(codec Codec) {
+	c.codecLock.Lock()
+	c.codec = codec
+	c.codecLock.Unlock()
+}
+
 func (c *Conn) ReadRaw() (*bytes.Buffer, error) {
+	buf, _, err := c.ReadFrame()
+	return buf, err
+}
+
+// ReadFrame reads the next frame along with the codec it was encoded with.
+// Legacy frames start with an ASCII length followed by a newline, anything
+// else starts with a codec tag and a big endian uint32 length.
+func (c *Conn) ReadFrame() (*bytes.Buffer, Codec, error) {
 	if c.connBuf == nil {
 		c.connBuf = bufio.NewReader(c.NConn)
 	}
@@ -233,30 +334,112 @@ func (c *Conn) ReadRaw() (*bytes.Buffer, error) {
 	c.connRLock.Lock()
 	defer c.connRLock.Unlock()
 
-	lenSli, err := c.connBuf.ReadSlice('\n')
+	tag, err := c.connBuf.Peek(1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	codec := JSONCodec
+	var l int
+
+	if tag[0] == errorFrameTag {
+		return nil, nil, c.readErrorFrame()
+	}
+
+	if (tag[0] >= '0' && tag[0] <= '9') || tag[0] == ' ' {
+		lenSli, err := c.connBuf.ReadSlice('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lenSli = bytes.TrimSpace(lenSli)
+		l, err = strconv.Atoi(string(lenSli))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if l < 0 {
+			return nil, nil, ErrFrameTooBig
+		}
+	} else {
+		var ok bool
+
+		codec, ok = codecByTag(tag[0])
+		if !ok {
+			return nil, nil, ErrUnknownCodec
+		}
+
+		var head [5]byte
+
+		_, err = io.ReadFull(c.connBuf, head[:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		l = int(binary.BigEndian.Uint32(head[1:]))
+	}
+
+	if c.MaxFrameSize > 0 && l > c.MaxFrameSize {
+		return nil, nil, ErrFrameTooBig
 	}
 
-	lenSli = bytes.TrimSpace(lenSli)
-	l, err := strconv.Atoi(string(lenSli))
+	buf := make([]byte, l)
+	_, err = io.ReadFull(c.connBuf, buf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	return bytes.NewBuffer(buf), codec, nil
+}
+
+// readErrorFrame reads an error frame and returns the error in it.
+func (c *Conn) readErrorFrame() error {
+	var head [5]byte
+
+	_, err := io.ReadFull(c.connBuf, head[:])
+	if err != nil {
+		return err
+	}
+
+	l := binary.BigEndian.Uint32(head[1:])
+	if l > maxErrorFrameSize || (c.MaxFrameSize > 0 && int(l) > c.MaxFrameSize) {
+		return ErrFrameTooBig
 	}
 
 	buf := make([]byte, l)
 	_, err = io.ReadFull(c.connBuf, buf)
+	if err != nil {
+		return err
+	}
+
+	er := ErrorReply{}
+
+	err = json.Unmarshal(buf, &er)
+	if err != nil {
+		return err
+	}
+
+	return knownProtocolError(er.Code, er.Message)
+}
 
-	return bytes.NewBuffer(buf), nil
+// SendError sends an error frame, which the other end's ReadFrame returns as
+// the error.
+func (c *Conn) SendError(pe *ProtocolError) error {
+	out, err := json.Marshal(&ErrorReply{Code: pe.Code, Message: pe.Message})
+	if err != nil {
+		return err
+	}
+
+	return c.sendTagged(errorFrameTag, out)
 }
 
 func (c *Conn) Read(v Preparer) error {
-	r, err := c.ReadRaw()
+	r, codec, err := c.ReadFrame()
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(r.Bytes(), v)
+	err = codec.Unmarshal(r.Bytes(), v)
 	if err != nil {
 		return err
 	}
@@ -274,12 +457,30 @@ func (c *Conn) ReadCom() (Communication, error) {
 func (c *Conn) Send(cmd string, v Preparer) error {
 	v.Prepare(cmd)
 
-	out, err := json.Marshal(v)
+	codec := c.Codec()
+
+	out, err := codec.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	return c.SendRaw(bytes.NewBuffer(out))
+	if codec.Tag() == 0 {
+		return c.SendRaw(bytes.NewBuffer(out))
+	}
+
+	return c.sendTagged(codec.Tag(), out)
+}
+
+func (c *Conn) sendTagged(tag byte, out []byte) error {
+	c.connWLock.Lock()
+	defer c.connWLock.Unlock()
+
+	buf := make([]byte, 5, 5+len(out))
+	buf[0] = tag
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(out)))
+
+	_, err := c.NConn.Write(append(buf, out...))
+	return err
 }
 
 func (c *Conn) SendRaw(r io.Reader) error {
@@ -308,6 +509,21 @@ func (c *Conn) SendRaw(r io.Reader) error {
 	return err
 }
 
+// SendRawSized streams n bytes from r as a single legacy frame, without
+// buffering them first.
+func (c *Conn) SendRawSized(r io.Reader, n int64) error {
+	c.connWLock.Lock()
+	defer c.connWLock.Unlock()
+
+	_, err := fmt.Fprintf(c.NConn, "%v\n", n)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(c.NConn, r, n)
+	return err
+}
+
 func (c *Conn) SendRawString(s string) error {
 	return c.SendRaw(strings.NewReader(s))
 }
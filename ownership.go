@@ -0,0 +1,177 @@
+package server
+
+// Grab gives the player authority over the entity. If nid is one of their
+// nodes, the entity follows it around on the server until it's released.
+//
+// Players can grab entities which are Grabbable, or which they already own.
+// The first player to grab an entity keeps it until they release it, so when
+// two grab at once the other gets ErrEntityTaken.
+func (r *Room) Grab(p *Player, id, nid uint) error {
+	var node *Node
+
+	if nid != 0 {
+		p.nodesLock.RLock()
+		n, ok := p.nodesMap[nid]
+		if ok {
+			c := *n
+			node = &c
+		}
+		p.nodesLock.RUnlock()
+
+		if !ok {
+			return ErrNodeDoesntExist
+		}
+	}
+
+	r.entitiesLock.Lock()
+	e, ok := r.entities[id]
+
+	switch {
+	case !ok:
+		r.entitiesLock.Unlock()
+		return ErrEntityDoesntExist
+	case e.held && e.Owner != p.ID:
+		r.entitiesLock.Unlock()
+		return ErrEntityTaken
+	case !e.Grabbable && e.Owner != p.ID:
+		r.entitiesLock.Unlock()
+		return ErrEntityNotGrabbable
+	}
+
+	e.Owner = p.ID
+	e.Node = nid
+	e.held = true
+
+	if node != nil {
+		e.offset = e.Position.Sub(node.Position)
+		e.spin = e.Rotation.Sub(node.Rotation)
+	}
+	r.entitiesLock.Unlock()
+
+	r.broadcast(Broadcast{
+		Cmd: OwnershipChangedCmd,
+		Com: &OwnershipChanged{
+			ID:    id,
+			Owner: p.ID,
+			NID:   nid,
+		},
+		From: p.ID,
+	})
+
+	return nil
+}
+
+// Release hands authority over an entity the player grabbed back to whoever
+// had it before, which is the server unless a player spawned it.
+func (r *Room) Release(pid, id uint) error {
+	r.entitiesLock.Lock()
+	e, ok := r.entities[id]
+
+	switch {
+	case !ok:
+		r.entitiesLock.Unlock()
+		return ErrEntityDoesntExist
+	case !e.held || e.Owner != pid:
+		r.entitiesLock.Unlock()
+		return ErrNotEntityOwner
+	}
+
+	e.Owner = e.spawner
+	e.Node = 0
+	e.held = false
+	owner := e.Owner
+	r.entitiesLock.Unlock()
+
+	r.broadcast(Broadcast{
+		Cmd: OwnershipChangedCmd,
+		Com: &OwnershipChanged{
+			ID:    id,
+			Owner: owner,
+		},
+		From: pid,
+	})
+
+	return nil
+}
+
+// releaseHeldBy releases everything the player is holding.
+func (r *Room) releaseHeldBy(pid uint) {
+	for _, e := range r.Entities() {
+		if e.held && e.Owner == pid {
+			r.Release(pid, e.ID)
+		}
+	}
+}
+
+// follow moves whatever the node is holding along with it.
+func (r *Room) follow(n *Node) {
+	type move struct {
+		id                 uint
+		position, rotation Point
+	}
+
+	var moves []move
+
+	r.entitiesLock.RLock()
+	for _, e := range r.entities {
+		if e.held && e.Owner == n.PID && e.Node == n.ID {
+			moves = append(moves, move{e.ID, n.Position.Add(e.offset), n.Rotation.Add(e.spin)})
+		}
+	}
+	r.entitiesLock.RUnlock()
+
+	for _, m := range moves {
+		r.MoveEntity(m.id, m.position, m.rotation)
+	}
+}
+
+func (r *Room) requestOwnership(conn *ChildConn) error {
+	ro := RequestOwnership{}
+
+	err := conn.Read(&ro)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, ro.PID)
+	if err != nil {
+		return err
+	}
+
+	ov := OwnershipVerdict{ID: ro.ID}
+
+	err = r.Grab(p, ro.ID, ro.NID)
+	switch err {
+	case nil:
+		ov.Granted = true
+	case ErrEntityTaken:
+		// Losing a race isn't an error, the player is told who won.
+	default:
+		return err
+	}
+
+	e, err := r.Entity(ro.ID)
+	if err != nil {
+		return err
+	}
+
+	ov.Owner = e.Owner
+
+	return conn.Send(OwnershipVerdictCmd, &ov)
+}
+
+func (r *Room) releaseOwnership(conn *ChildConn) error {
+	ro := ReleaseOwnership{}
+
+	err := conn.Read(&ro)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, ro.PID)
+	if err != nil {
+		return err
+	}
+
+	return r.Release(p.ID, ro.ID)
+}
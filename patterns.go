@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/gnamma/server/internal/pm"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// patternSpecials are the characters which make a pattern more than a plain
+// string to look for.
+const patternSpecials = "^$*+?.([%-"
+
+// find matches the pattern in s from init, finding at most n matches, or all
+// of them if n is negative. Matching stops when the script's time is up, and
+// refuses to find more matches than the script has memory for.
+func (sc *Script) find(l *lua.LState, pattern, s string, init, n int) []*pm.MatchData {
+	if n == 0 {
+		return nil
+	}
+
+	ctx := l.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	most := int(sc.memory / scriptMatchSize)
+	if n < 0 || n > most {
+		n = most + 1
+	}
+
+	mds, err := pm.Find(ctx, pattern, []byte(s), init, n)
+	if err != nil {
+		l.RaiseError("%v", err)
+	}
+
+	if len(mds) > most {
+		l.RaiseError("pattern matches more times than the script has memory for")
+	}
+
+	return mds
+}
+
+// capture returns the ith capture of the match, where zero is the whole match
+// and so is one if the pattern has no captures.
+func capture(l *lua.LState, md *pm.MatchData, s string, i int) lua.LValue {
+	if i == 1 && md.CaptureLength() == 2 {
+		i = 0
+	}
+
+	if 2*i+1 >= md.CaptureLength() {
+		l.RaiseError("invalid capture index")
+	}
+
+	if md.IsPosCapture(2 * i) {
+		return lua.LNumber(md.Capture(2 * i))
+	}
+
+	return lua.LString(s[md.Capture(2*i):md.Capture(2*i+1)])
+}
+
+// pushCaptures pushes the captures of the match, or the whole match if the
+// pattern has none, and returns how many it pushed.
+func pushCaptures(l *lua.LState, md *pm.MatchData, s string) int {
+	n := md.CaptureLength()/2 - 1
+	if n == 0 {
+		n = 1
+	}
+
+	for i := 1; i <= n; i++ {
+		l.Push(capture(l, md, s, i))
+	}
+
+	return n
+}
+
+// startIndex turns a Lua string index into a Go one, counting negative
+// indices back from the end of s.
+func startIndex(s string, i int) int {
+	if i < 0 {
+		i = len(s) + i + 1
+	}
+
+	if i < 1 {
+		i = 1
+	}
+
+	return i - 1
+}
+
+// strFind is string.find, using find to match.
+func (sc *Script) strFind(l *lua.LState) int {
+	s := l.CheckString(1)
+	pattern := l.CheckString(2)
+	init := startIndex(s, l.OptInt(3, 1))
+
+	if init > len(s) {
+		l.Push(lua.LNil)
+		return 1
+	}
+
+	if lua.LVAsBool(l.Get(4)) || !strings.ContainsAny(pattern, patternSpecials) {
+		i := strings.Index(s[init:], pattern)
+		if i < 0 {
+			l.Push(lua.LNil)
+			return 1
+		}
+
+		l.Push(lua.LNumber(init + i + 1))
+		l.Push(lua.LNumber(init + i + len(pattern)))
+		return 2
+	}
+
+	mds := sc.find(l, pattern, s, init, 1)
+	if len(mds) == 0 {
+		l.Push(lua.LNil)
+		return 1
+	}
+
+	md := mds[0]
+	l.Push(lua.LNumber(md.Capture(0) + 1))
+	l.Push(lua.LNumber(md.Capture(1)))
+
+	if md.CaptureLength() == 2 {
+		return 2
+	}
+
+	return 2 + pushCaptures(l, md, s)
+}
+
+// strMatch is string.match, using find to match.
+func (sc *Script) strMatch(l *lua.LState) int {
+	s := l.CheckString(1)
+	pattern := l.CheckString(2)
+	init := startIndex(s, l.OptInt(3, 1))
+
+	mds := sc.find(l, pattern, s, init, 1)
+	if len(mds) == 0 {
+		l.Push(lua.LNil)
+		return 1
+	}
+
+	return pushCaptures(l, mds[0], s)
+}
+
+// strGmatch is string.gmatch, using find to match. Every match is found up
+// front, while the script's time is still being counted.
+func (sc *Script) strGmatch(l *lua.LState) int {
+	s := l.CheckString(1)
+	mds := sc.find(l, l.CheckString(2), s, 0, -1)
+
+	l.Push(l.NewFunction(func(l *lua.LState) int {
+		if len(mds) == 0 {
+			return 0
+		}
+
+		md := mds[0]
+		mds = mds[1:]
+
+		return pushCaptures(l, md, s)
+	}))
+
+	return 1
+}
+
+// strGsub is string.gsub, using find to match and refusing to build a string
+// bigger than the script's memory limit.
+func (sc *Script) strGsub(l *lua.LState) int {
+	s := l.CheckString(1)
+	pattern := l.CheckString(2)
+	l.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	repl := l.Get(3)
+
+	mds := sc.find(l, pattern, s, 0, l.OptInt(4, -1))
+
+	var b strings.Builder
+	write := func(s string) {
+		if int64(b.Len()+len(s)) > sc.memory {
+			l.RaiseError("string.gsub would use more memory than the script is allowed")
+		}
+
+		b.WriteString(s)
+	}
+
+	last := 0
+	for _, md := range mds {
+		start, end := md.Capture(0), md.Capture(1)
+		write(s[last:start])
+		last = end
+
+		var v lua.LValue
+
+		switch repl := repl.(type) {
+		case lua.LString:
+			expand(l, string(repl), md, s, write)
+			continue
+		case *lua.LTable:
+			v = l.GetTable(repl, capture(l, md, s, 1))
+		case *lua.LFunction:
+			l.Push(repl)
+			l.Call(pushCaptures(l, md, s), 1)
+			v = l.Get(-1)
+			l.Pop(1)
+		}
+
+		// Nil or false keeps the match as it was.
+		if lua.LVAsBool(v) {
+			write(lua.LVAsString(v))
+		} else {
+			write(s[start:end])
+		}
+	}
+
+	write(s[last:])
+
+	l.Push(lua.LString(b.String()))
+	l.Push(lua.LNumber(len(mds)))
+	return 2
+}
+
+// expand writes a gsub replacement string with the captures of the match
+// filled in, where %0 to %9 stand for them and %% for a percent sign. It
+// writes a piece at a time, so a replacement which repeats a long capture
+// can't get far past the limit before it's stopped.
+func expand(l *lua.LState, repl string, md *pm.MatchData, s string, write func(string)) {
+	for {
+		i := strings.IndexByte(repl, '%')
+		if i < 0 || i+1 == len(repl) {
+			write(repl)
+			return
+		}
+
+		write(repl[:i])
+		c := repl[i+1]
+		repl = repl[i+2:]
+
+		if c < '0' || c > '9' {
+			write(string(c))
+			continue
+		}
+
+		v := capture(l, md, s, int(c-'0'))
+		if n, ok := v.(lua.LNumber); ok {
+			write(strconv.Itoa(int(n)))
+		} else {
+			write(string(v.(lua.LString)))
+		}
+	}
+}
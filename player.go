@@ -1,6 +1,11 @@
 package server
 
-import "sync"
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type NodeType uint
 
@@ -15,7 +20,36 @@ type Player struct {
 
 	Conn *ComConn `json:"-"`
 
+	// InterestRadius is how far the player can see node updates from their
+	// head. Zero, or anything past the room's radius, uses the room's.
+	InterestRadius float64 `json:"-"`
+
+	// Snapshots is set for players who get batched snapshots every tick
+	// instead of individual node updates.
+	Snapshots     bool `json:"-"`
+	snapshots     *snapshotHistory
+	snapshotsLock sync.Mutex
+
+	chat     chatLimiter
+	chatLock sync.Mutex
+	muted    int32 // Set atomically, non-zero while the player can't chat or talk.
+
+	// Pings is set for players whose clients answer the server's pings.
+	Pings bool `json:"-"`
+
+	// The last round trip and the ping waiting for an answer, under pingLock.
+	ping      time.Duration
+	pingNonce uint64
+	pingSent  time.Time
+	pingLock  sync.Mutex
+
+	room       *Room
+	roomLock   sync.RWMutex
+	registered bool // Whether the client has registered all of its nodes, under nodesLock.
+
 	// TODO: Neaten up this whole system
+	// Nodes and nodesMap are read and written under nodesLock, as node
+	// updates come in over both channels at once.
 	Nodes     []*Node        `json:"nodes"`
 	nodesMap  map[uint]*Node // Map for quick access
 	nodesLock sync.RWMutex
@@ -26,15 +60,114 @@ func (p *Player) Valid() bool {
 	return p.Username != ""
 }
 
+// Room returns the room the player is currently in.
+func (p *Player) Room() *Room {
+	p.roomLock.RLock()
+	defer p.roomLock.RUnlock()
+
+	return p.room
+}
+
+func (p *Player) setRoom(r *Room) {
+	p.roomLock.Lock()
+	p.room = r
+	p.roomLock.Unlock()
+}
+
+// Registered reports whether the client has registered all of its nodes.
+func (p *Player) Registered() bool {
+	p.nodesLock.RLock()
+	defer p.nodesLock.RUnlock()
+
+	return p.registered
+}
+
+func (p *Player) setRegistered() {
+	p.nodesLock.Lock()
+	p.registered = true
+	p.nodesLock.Unlock()
+}
+
+// copy returns what other players are told about the player, with copies of
+// their nodes so it can be sent while they keep moving.
+func (p *Player) copy() Player {
+	p.nodesLock.RLock()
+	defer p.nodesLock.RUnlock()
+
+	var nodes []*Node
+
+	for _, n := range p.Nodes {
+		c := *n
+		nodes = append(nodes, &c)
+	}
+
+	return Player{
+		ID:       p.ID,
+		Username: p.Username,
+		Nodes:    nodes,
+	}
+}
+
+// IP returns the address the player connected from.
+func (p *Player) IP() string {
+	if p.Conn == nil {
+		return ""
+	}
+
+	return remoteIP(p.Conn.Raw.NConn)
+}
+
+// Muted reports whether the player has been stopped from chatting and talking.
+func (p *Player) Muted() bool {
+	return atomic.LoadInt32(&p.muted) != 0
+}
+
+func (p *Player) setMuted(muted bool) {
+	var v int32
+	if muted {
+		v = 1
+	}
+
+	atomic.StoreInt32(&p.muted, v)
+}
+
+// Ping returns the round trip time to the player's client, as of the last
+// ping it answered.
+func (p *Player) Ping() time.Duration {
+	p.pingLock.Lock()
+	defer p.pingLock.Unlock()
+
+	return p.ping
+}
+
+// Head returns a copy of the player's first head node, or nil if they haven't
+// got one.
+func (p *Player) Head() *Node {
+	p.nodesLock.RLock()
+	defer p.nodesLock.RUnlock()
+
+	for _, n := range p.Nodes {
+		if n.Type == HeadNode {
+			c := *n
+			return &c
+		}
+	}
+
+	return nil
+}
+
 func (p *Player) RegisterNode(n Node) (uint, error) {
+	p.nodesLock.Lock()
 	id := p.nodeCount + 1
 
-	p.nodesLock.Lock()
 	_, ok := p.nodesMap[id]
 	if ok {
+		p.nodesLock.Unlock()
 		return 0, ErrNodeAlreadyExists
 	}
 
+	n.updatedAt = time.Now()
+
 	p.Nodes = append(p.Nodes, &n)
 
 	p.nodesMap[id] = &n
@@ -56,6 +189,8 @@ type Node struct {
 	Rotation Point    `json:"rotation"`
 	Asset    string   `json:"asset"`
 	Label    string   `json:"label"`
+
+	updatedAt time.Time // When the server last accepted a move.
 }
 
 type Point struct {
@@ -63,3 +198,7 @@ type Point struct {
 	Y float64 `json:"y"`
 	Z float64 `json:"z"`
 }
+
+func (p Point) Distance(q Point) float64 {
+	return math.Sqrt((p.X-q.X)*(p.X-q.X) + (p.Y-q.Y)*(p.Y-q.Y) + (p.Z-q.Z)*(p.Z-q.Z))
+}
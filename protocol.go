@@ -13,10 +13,40 @@ const (
 	RegisteredNodeCmd     = "registered_node"
 	UpdateNodeCmd         = "update_node"
 	RegisteredAllNodesCmd = "registered_all_nodes"
+	ListRoomsCmd          = "list_rooms"
+	RoomListCmd           = "room_list"
 	JoinRoomCmd           = "join_room"
 	LeaveRoomCmd          = "leave_room"
+	RoomVerdictCmd        = "room_verdict"
+	PlayerJoinedCmd       = "player_joined"
+	PlayerLeftCmd         = "player_left"
 	AssetServerRequestCmd = "asset_server_request"
 	AssetServerAddressCmd = "asset_server_address"
+	UnreliableRequestCmd  = "unreliable_request"
+	UnreliableChannelCmd  = "unreliable_channel"
+	SnapshotCmd           = "snapshot"
+	SnapshotAckCmd        = "snapshot_ack"
+	ErrorCmd              = "error"
+	ServerClosingCmd      = "server_closing"
+	EnvironmentChangedCmd = "environment_changed"
+	SpawnEntityCmd        = "spawn_entity"
+	SpawnedEntityCmd      = "spawned_entity"
+	EntitySpawnedCmd      = "entity_spawned"
+	DespawnEntityCmd      = "despawn_entity"
+	EntityDespawnedCmd    = "entity_despawned"
+	UpdateEntityCmd       = "update_entity"
+	RequestOwnershipCmd   = "request_ownership"
+	OwnershipVerdictCmd   = "ownership_verdict"
+	ReleaseOwnershipCmd   = "release_ownership"
+	OwnershipChangedCmd   = "ownership_changed"
+	ScriptCommandCmd      = "script_command"
+	ScriptMessageCmd      = "script_message"
+	KickedCmd             = "kicked"
+	ChatCmd               = "chat"
+	ChatMessageCmd        = "chat_message"
+	AdminCommandCmd       = "admin_command"
+	AdminResultCmd        = "admin_result"
+	ServerMessageCmd      = "server_message"
 )
 
 type Communication struct {
@@ -32,7 +62,20 @@ func (c *Communication) Prepare(cmd string) {
 type ConnectRequest struct {
 	Communication
 
-	Username string `json:"username"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"` // Password or token, depending on the server.
+	Room       uint     `json:"room"`       // Zero joins the server's default room.
+	Codecs     []string `json:"codecs"`     // Codecs the client supports, most preferred first.
+
+	// Snapshots asks for node updates to be batched into one snapshot per
+	// tick instead of being sent as individual UpdateNodes.
+	Snapshots bool `json:"snapshots"`
+
+	InterestRadius float64 `json:"interest_radius"` // Zero uses the room's radius, which is also the most allowed.
+
+	// Pings asks the server to ping the client to measure its round trip.
+	// Clients which ask must answer each Ping with a Pong with its Nonce.
+	Pings bool `json:"pings"`
 }
 
 type ConnectVerdict struct {
@@ -41,17 +84,23 @@ type ConnectVerdict struct {
 	CanProceed bool     `json:"can_proceed"`
 	Message    string   `json:"message"`
 	PlayerID   uint     `json:"player_id"`
+	RoomID     uint     `json:"room_id"`
+	Codec      string   `json:"codec"` // Codec used by both sides after the verdict.
 	Players    []Player `json:"players"`
+	Entities   []Entity `json:"entities"`
 }
 
 type Ping struct {
 	Communication
+
+	Nonce uint64 `json:"nonce,omitempty"` // Set on pings from the server.
 }
 
 type Pong struct {
 	Communication
 
-	ReceivedAt int64 `json:"received_at"`
+	ReceivedAt int64  `json:"received_at"`
+	Nonce      uint64 `json:"nonce,omitempty"` // The Nonce of the Ping being answered.
 }
 
 type EnvironmentRequest struct {
@@ -63,6 +112,21 @@ type EnvironmentPackage struct {
 
 	AssetKeys map[string]string `json:"asset_keys"`
 	Main      string            `json:"main"`
+
+	// Assets is the manifest of everything on the asset server, by key, so
+	// clients can fetch by hash and skip what they already have.
+	Assets map[string]AssetInfo `json:"assets"`
+
+	Version uint64 `json:"version"`
+}
+
+// EnvironmentChanged is sent when assets have changed on the server. Clients
+// should request the EnvironmentPackage again and fetch whatever they need.
+type EnvironmentChanged struct {
+	Communication
+
+	Version uint64   `json:"version"`
+	Changed []string `json:"changed"` // Keys which were added, changed or removed.
 }
 
 type RegisterNode struct {
@@ -86,6 +150,10 @@ type UpdateNode struct {
 
 	Position Point `json:"position"`
 	Rotation Point `json:"rotation"`
+
+	// Hidden is only set by the server, when the node has gone out of the
+	// recipient's view. They hear nothing more of it until it's back.
+	Hidden bool `json:"hidden"`
 }
 
 type RegisteredAllNodes struct {
@@ -94,14 +162,50 @@ type RegisteredAllNodes struct {
 	PID uint `json:"pid"`
 }
 
+type ListRooms struct {
+	Communication
+}
+
+type RoomList struct {
+	Communication
+
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+type RoomInfo struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	Players int    `json:"players"`
+}
+
 type JoinRoom struct {
 	Communication
 
-	Player Player `json:"player"`
+	RoomID uint `json:"room_id"`
 }
 
 type LeaveRoom struct {
 	Communication
+}
+
+type RoomVerdict struct {
+	Communication
+
+	CanProceed bool     `json:"can_proceed"`
+	Message    string   `json:"message"`
+	RoomID     uint     `json:"room_id"`
+	Players    []Player `json:"players"`
+	Entities   []Entity `json:"entities"`
+}
+
+type PlayerJoined struct {
+	Communication
+
+	Player Player `json:"player"`
+}
+
+type PlayerLeft struct {
+	Communication
 
 	PID uint `json:"pid"`
 }
@@ -118,6 +222,220 @@ type AssetServerAddress struct {
 	Address string
 }
 
+type UnreliableRequest struct {
+	Communication
+}
+
+// UnreliableChannel tells the client where to send node updates over UDP. An
+// empty address means the server doesn't offer an unreliable channel.
+type UnreliableChannel struct {
+	Communication
+
+	Address string `json:"address"`
+	Token   string `json:"token"`
+}
+
+// Snapshot holds every node which changed since the snapshot Base, which is
+// the last one the client acknowledged. A zero Base means the snapshot holds
+// every node in the room.
+type Snapshot struct {
+	Communication
+
+	Seq     uint64      `json:"seq"`
+	Base    uint64      `json:"base"`
+	Nodes   []NodeState `json:"nodes"`
+	Removed []NodeRef   `json:"removed"`
+}
+
+type SnapshotAck struct {
+	Communication
+
+	Seq uint64 `json:"seq"`
+}
+
+type NodeRef struct {
+	PID uint `json:"pid"`
+	NID uint `json:"nid"`
+}
+
+type NodeState struct {
+	NodeRef
+
+	Position Point `json:"position"`
+	Rotation Point `json:"rotation"`
+}
+
+// ErrorReply tells the client why the server refused a communication.
+type ErrorReply struct {
+	Communication
+
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Command string `json:"cmd"` // The command which was refused.
+}
+
+// ServerClosing is sent to every player just before the server shuts down.
+type ServerClosing struct {
+	Communication
+
+	Message string `json:"message"`
+}
+
+// SpawnEntity asks for an entity owned by the player to be added to their
+// room. The server replies with SpawnedEntity, and tells everyone with
+// EntitySpawned.
+type SpawnEntity struct {
+	Communication
+
+	PID    uint   `json:"pid"`
+	Entity Entity `json:"entity"`
+}
+
+type SpawnedEntity struct {
+	Communication
+
+	ID uint `json:"id"`
+}
+
+type EntitySpawned struct {
+	Communication
+
+	Entity Entity `json:"entity"`
+}
+
+type DespawnEntity struct {
+	Communication
+
+	PID uint `json:"pid"`
+	ID  uint `json:"id"`
+}
+
+type EntityDespawned struct {
+	Communication
+
+	ID uint `json:"id"`
+}
+
+// UpdateEntity moves an entity. Players send it for entities they own, and the
+// server sends it to everyone whenever any entity moves.
+type UpdateEntity struct {
+	Communication
+
+	PID uint `json:"pid"`
+	ID  uint `json:"id"`
+
+	Position Point `json:"position"`
+	Rotation Point `json:"rotation"`
+}
+
+// RequestOwnership asks for authority over an entity, such as when the player
+// picks it up. If NID is one of the player's nodes, the entity follows it.
+type RequestOwnership struct {
+	Communication
+
+	PID uint `json:"pid"`
+	ID  uint `json:"id"`
+	NID uint `json:"nid"`
+}
+
+// OwnershipVerdict says whether the player got the entity, and who owns it if
+// they didn't.
+type OwnershipVerdict struct {
+	Communication
+
+	ID      uint `json:"id"`
+	Granted bool `json:"granted"`
+	Owner   uint `json:"owner"`
+}
+
+type ReleaseOwnership struct {
+	Communication
+
+	PID uint `json:"pid"`
+	ID  uint `json:"id"`
+}
+
+// OwnershipChanged is sent to everyone when an entity is grabbed or released.
+type OwnershipChanged struct {
+	Communication
+
+	ID    uint `json:"id"`
+	Owner uint `json:"owner"`
+	NID   uint `json:"nid"`
+}
+
+// ScriptCommand is handled by the room's script, with whatever arguments the
+// script expects.
+type ScriptCommand struct {
+	Communication
+
+	PID  uint              `json:"pid"`
+	Name string            `json:"name"`
+	Args map[string]string `json:"args"`
+}
+
+// ScriptMessage is sent by the room's script.
+type ScriptMessage struct {
+	Communication
+
+	Name string            `json:"name"`
+	Data map[string]string `json:"data"`
+}
+
+// Kicked is sent to a player just before the server disconnects them.
+type Kicked struct {
+	Communication
+
+	Message string `json:"message"`
+}
+
+// Chat is something a player says. Scope is ChatRoom, ChatWhisper or
+// ChatNearby, and To is the player being whispered to.
+type Chat struct {
+	Communication
+
+	PID   uint   `json:"pid"`
+	Scope string `json:"scope"`
+	To    uint   `json:"to"`
+	Text  string `json:"text"`
+}
+
+// ChatMessage is sent to everyone who should hear a Chat, including whoever
+// said it unless it was a whisper.
+type ChatMessage struct {
+	Communication
+
+	From     uint   `json:"from"`
+	Username string `json:"username"`
+	Scope    string `json:"scope"`
+	To       uint   `json:"to"`
+	Text     string `json:"text"`
+}
+
+// AdminCommand runs one of the operator commands, as typed into `gns admin`.
+// Only players whose username is one of the server's operators can send it.
+type AdminCommand struct {
+	Communication
+
+	PID  uint   `json:"pid"`
+	Line string `json:"line"`
+}
+
+// AdminResult is what the command printed.
+type AdminResult struct {
+	Communication
+
+	Output string `json:"output"`
+}
+
+// ServerMessage is a message from whoever runs the server, such as a warning
+// that it's about to restart.
+type ServerMessage struct {
+	Communication
+
+	Message string `json:"message"`
+}
+
 type Preparer interface {
 	Prepare(string)
 }
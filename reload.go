@@ -0,0 +1,218 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// EnvironmentVersion is bumped every time the assets change. It starts at 1.
+func (s *Server) EnvironmentVersion() uint64 {
+	return atomic.LoadUint64(&s.envVersion)
+}
+
+// watchAssets rescans AssetsDir on an interval. When something has changed and
+// every GSML file is still valid, the new manifest is published and everyone
+// is told to fetch the environment again.
+func (s *Server) watchAssets(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	// seen is what was last published, and last the latest scan, which may
+	// have been turned down.
+	seen := s.Assets.Manifest()
+	last := seen
+
+	var rejected *Manifest
+
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		m, err := rescanAssets(string(s.Assets.Dir), last)
+		if err != nil {
+			s.log.Println("Couldn't scan assets:", err)
+			continue
+		}
+
+		last = m
+
+		changed := changedAssets(seen, m)
+		if len(changed) == 0 {
+			rejected = nil
+			continue
+		}
+
+		// Only complain about a broken file once, rather than every tick
+		// until it's fixed.
+		if rejected != nil && len(changedAssets(rejected, m)) == 0 {
+			continue
+		}
+
+		err = s.validateAssets(m, changed)
+		if err != nil {
+			s.log.Println("Not reloading assets:", err)
+			rejected = m
+			continue
+		}
+
+		seen, rejected = m, nil
+		s.reload(m, changed)
+	}
+}
+
+// reload publishes a new manifest and tells every room about it.
+func (s *Server) reload(m *Manifest, changed []string) {
+	s.Assets.setManifest(m)
+	v := atomic.AddUint64(&s.envVersion, 1)
+
+	rooms := s.Rooms()
+
+	// Rooms have to be flattened again if any file they're built from has
+	// changed, and then so has the flattened room.
+	for _, r := range rooms {
+		if !r.dependsOn(changed) {
+			continue
+		}
+
+		err := r.loadScene()
+		if err != nil {
+			s.log.Printf("Couldn't reload room %v: %v", r.ID, err)
+			continue
+		}
+
+		changed = append(changed, r.FlattenedKey())
+	}
+
+	for _, r := range rooms {
+		if r.Opts.Script == "" || !containsString(changed, r.Opts.Script) {
+			continue
+		}
+
+		err := r.loadScript()
+		if err != nil {
+			s.log.Printf("Couldn't reload the script of room %v: %v", r.ID, err)
+		}
+	}
+
+	sort.Strings(changed)
+
+	s.log.Printf("Reloaded environment version %v, changed: %v", v, changed)
+
+	for _, r := range rooms {
+		r.broadcast(Broadcast{
+			Cmd: EnvironmentChangedCmd,
+			Com: &EnvironmentChanged{
+				Version: v,
+				Changed: changed,
+			},
+		})
+	}
+}
+
+// validateAssets checks every changed GSML file still parses, and that no
+// room has lost its file.
+func (s *Server) validateAssets(m *Manifest, changed []string) error {
+	for _, r := range s.Rooms() {
+		if _, ok := m.Assets[r.Opts.Main]; !ok {
+			return &GSMLError{Key: r.Opts.Main, Err: ErrRoomFileMissing}
+		}
+
+		if r.dependsOn(changed) {
+			_, err := parseAsset(string(s.Assets.Dir), r.Opts.Main)
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.Opts.Script != "" && containsString(changed, r.Opts.Script) {
+			err := compileScript(string(s.Assets.Dir), r.Opts.Script)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, key := range changed {
+		if _, ok := m.Assets[key]; !ok || !s.isGSML(key) {
+			continue
+		}
+
+		_, err := parseAsset(string(s.Assets.Dir), key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isGSML reports whether the asset is GSML, either by its extension or
+// because a room uses it.
+func (s *Server) isGSML(key string) bool {
+	if path.Ext(key) == ".gsml" {
+		return true
+	}
+
+	for _, r := range s.Rooms() {
+		if r.Opts.Main == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dependsOn reports whether the room is built from any of the assets.
+func (r *Room) dependsOn(keys []string) bool {
+	scene := r.Scene()
+	if scene == nil {
+		return containsString(keys, r.Opts.Main)
+	}
+
+	for _, f := range scene.Files {
+		if containsString(keys, f) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// changedAssets lists the keys of assets which have been added, removed or
+// changed between two manifests.
+func changedAssets(old, new *Manifest) []string {
+	var changed []string
+
+	for k, ai := range new.Assets {
+		if old == nil || old.Assets[k].Hash != ai.Hash {
+			changed = append(changed, k)
+		}
+	}
+
+	if old != nil {
+		for k := range old.Assets {
+			if _, ok := new.Assets[k]; !ok {
+				changed = append(changed, k)
+			}
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
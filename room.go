@@ -2,39 +2,103 @@ package server
 
 import (
 	"log"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gnamma/server/gsml"
 )
 
+type RoomOptions struct {
+	Name string
+	Main string // Asset key of the GSML file describing the room.
+
+	// InterestRadius limits node updates to players whose head is within
+	// this distance of the node. Zero sends every update to everyone.
+	InterestRadius     float64
+	InterestHysteresis float64
+
+	Limits    Limits
+	Collision Collision
+
+	// MaxSpawned is how many entities each player may have spawned at once.
+	// Zero uses DefaultMaxSpawned.
+	MaxSpawned int
+
+	// Script is the asset key of a Lua script which runs the room's
+	// behaviour, see Script. Empty for a room without one.
+	Script string
+}
+
 type Room struct {
 	*Dispatch
 
+	ID        uint
+	Opts      RoomOptions
 	Broadcast chan Broadcast
 
 	s *Server
 
 	players     map[uint]*Player
-	playerCount uint
+	playersLock sync.RWMutex
+
+	interest *Interest // Nil if every update goes to everyone.
+
+	scene     *gsml.Room // Parsed from Opts.Main, nil until the server starts.
+	collider  *Collider  // Built from the scene, nil without collision.
+	script    *Script    // Nil without a script.
+	sceneLock sync.RWMutex
+
+	entities     map[uint]*Entity
+	entitiesLock sync.RWMutex
+	entityCount  uint
+
+	tickFuncs []TickFunc
+	tickLock  sync.RWMutex
+
+	stopped chan struct{}  // Closed once the broadcast loop has finished.
+	sends   sync.WaitGroup // Broadcasts still being delivered.
 }
 
-func NewRoom(s *Server) *Room {
+func NewRoom(s *Server, id uint, o RoomOptions) *Room {
 	r := &Room{
+		ID:        id,
+		Opts:      o,
 		s:         s,
 		players:   make(map[uint]*Player),
+		entities:  make(map[uint]*Entity),
 		Broadcast: make(chan Broadcast),
+		stopped:   make(chan struct{}),
+	}
+
+	if o.InterestRadius > 0 {
+		r.interest = NewInterest(o.InterestRadius, o.InterestHysteresis)
 	}
 
 	r.Dispatch = &Dispatch{
-		map[string]CommunicationHandler{
-			PingCmd:               r.ping,
-			ConnectRequestCmd:     r.connectRequest,
+		H: map[string]CommunicationHandler{
 			EnvironmentRequestCmd: r.environmentRequest,
 			RegisterNodeCmd:       r.registerNode,
 			UpdateNodeCmd:         r.updateNode,
 			RegisteredAllNodesCmd: r.registeredAllNodes,
+			SnapshotAckCmd:        r.snapshotAck,
+			SpawnEntityCmd:        r.spawnEntity,
+			DespawnEntityCmd:      r.despawnEntity,
+			UpdateEntityCmd:       r.updateEntity,
+			RequestOwnershipCmd:   r.requestOwnership,
+			ReleaseOwnershipCmd:   r.releaseOwnership,
+			ScriptCommandCmd:      r.scriptCommand,
+			ChatCmd:               r.chat,
 		},
+		Metrics: s.Metrics,
 	}
 
-	go r.broadcastLoop()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		r.broadcastLoop()
+	}()
 
 	return r
 }
@@ -43,41 +107,142 @@ func (r *Room) StartUpdateLoop() {
 	wait := time.Second / time.Duration(r.s.Opts.WriteSpeed)
 	log.Println("Updating on an interval of:", wait)
 
+	t := time.NewTicker(wait)
+	defer t.Stop()
+
+	last := time.Now()
+
 	for {
-		for k, p := range r.players {
-			p.Conn.Done()
+		start := time.Now()
 
-			if p.Conn.Closed {
-				log.Println("Hey we're closing!")
-				r.Broadcast <- Broadcast{
-					Cmd: LeaveRoomCmd,
-					Com: &LeaveRoom{PID: p.ID},
-				}
+		var closed []*Player
 
-				log.Println("CLosed!")
+		r.playersLock.RLock()
+		for _, p := range r.players {
+			p.Conn.Done()
 
-				delete(r.players, k)
+			if p.Conn.Closed {
+				closed = append(closed, p)
 			}
 		}
+		r.playersLock.RUnlock()
+
+		for _, p := range closed {
+			log.Println("Removing closed player:", p.ID)
+			r.Leave(p)
+			r.s.disconnected(p)
+		}
+
+		now := time.Now()
+		r.tick(now.Sub(last))
+		last = now
+
+		r.sendSnapshots()
 
-		time.Sleep(wait)
+		r.s.Metrics.ticked(r.Opts.Name, len(r.members()), start)
+
+		select {
+		case <-t.C:
+		case <-r.s.done:
+			return
+		}
 	}
 }
 
 func (r *Room) broadcastLoop() {
+	defer close(r.stopped)
+
 	for {
-		b := <-r.Broadcast
+		var b Broadcast
 
-		if b.Cmd != UpdateNodeCmd {
+		select {
+		case b = <-r.Broadcast:
+		case <-r.s.done:
+			return
+		}
+
+		start := time.Now()
+
+		if b.Cmd != UpdateNodeCmd && b.Cmd != UpdateEntityCmd {
 			log.Println(b.Cmd)
 		}
 
-		for _, p := range r.players {
+		ps := r.members()
+
+		if b.To != 0 {
+			ps = only(ps, b.To)
+		}
+
+		if b.within > 0 {
+			ps = nearby(ps, b.around, b.within)
+		}
+
+		// Players the node has just gone out of view for are told it's
+		// hidden, and hear no more of it until it's back.
+		var left []*Player
+		var hidden UpdateNode
+
+		if un, ok := b.Com.(*UpdateNode); ok {
+			ps = withoutSnapshots(ps)
+
+			if r.interest != nil {
+				ps, left = r.interest.Recipients(un, ps)
+
+				hidden = *un
+				hidden.Hidden = true
+			}
+		}
+
+		if len(ps) == 0 && len(left) == 0 {
+			r.s.Metrics.broadcastSent(b.Cmd, start)
+		}
+
+		// The last send to finish times the broadcast.
+		remaining := int32(len(ps) + len(left))
+
+		for _, p := range left {
+			r.sends.Add(1)
+			go func(p *Player) {
+				defer r.sends.Done()
+				defer func() {
+					if atomic.AddInt32(&remaining, -1) == 0 {
+						r.s.Metrics.broadcastSent(b.Cmd, start)
+					}
+				}()
+
+				if p.Conn.Closed {
+					return
+				}
+
+				// Over the reliable connection, since a lost one would
+				// leave the node frozen where it was last seen.
+				err := p.Conn.Send(UpdateNodeCmd, &hidden)
+				if err != nil {
+					p.Conn.Close()
+				}
+			}(p)
+		}
+
+		for _, p := range ps {
+			r.sends.Add(1)
 			go func(p *Player) { // This is not going to garbage collect well...
+				defer r.sends.Done()
+				defer func() {
+					if atomic.AddInt32(&remaining, -1) == 0 {
+						r.s.Metrics.broadcastSent(b.Cmd, start)
+					}
+				}()
+
 				if p.Conn.Closed {
 					return
 				}
 
+				if un, ok := b.Com.(*UpdateNode); ok && r.s.Unreliable != nil {
+					if r.s.Unreliable.Send(p.ID, *un) == nil {
+						return
+					}
+				}
+
 				log.Println("Sending...")
 				err := p.Conn.Send(b.Cmd, b.Com)
 				log.Println("Sent!")
@@ -90,11 +255,78 @@ func (r *Room) broadcastLoop() {
 		}
 
 		log.Println("Got to the end of this broadcast!")
+
+		if b.last {
+			return
+		}
+	}
+}
+
+// Scene returns the parsed GSML of the room, or nil if it hasn't been loaded.
+func (r *Room) Scene() *gsml.Room {
+	r.sceneLock.RLock()
+	defer r.sceneLock.RUnlock()
+
+	return r.scene
+}
+
+// Collider returns what node updates are resolved against, or nil if the room
+// doesn't have collision.
+func (r *Room) Collider() *Collider {
+	r.sceneLock.RLock()
+	defer r.sceneLock.RUnlock()
+
+	return r.collider
+}
+
+// FlattenedKey is the asset key clients fetch the room from, with everything
+// it includes already put in.
+func (r *Room) FlattenedKey() string {
+	return FlattenedKeyPrefix + r.Opts.Main
+}
+
+// loadScene parses the room's GSML from the assets, and serves the flattened
+// version of it.
+func (r *Room) loadScene() error {
+	scene, err := parseAsset(string(r.s.Assets.Dir), r.Opts.Main)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.s.Assets.Generate(r.FlattenedKey(), scene.GSML())
+	if err != nil {
+		return err
 	}
+
+	var c *Collider
+	if r.Opts.Collision.Enabled {
+		c = NewCollider(scene, r.Opts.Collision)
+	}
+
+	r.sceneLock.Lock()
+	r.scene = scene
+	r.collider = c
+	r.sceneLock.Unlock()
+
+	return nil
+}
+
+// parseAsset parses the GSML asset with the key, along with everything it
+// includes.
+func parseAsset(dir, key string) (*gsml.Room, error) {
+	scene, err := gsml.ParseFS(os.DirFS(dir), key)
+	if err != nil {
+		return nil, &GSMLError{Key: key, Err: err}
+	}
+
+	return scene, nil
 }
 
 func (r *Room) Player(pid uint) (*Player, error) {
+	r.playersLock.RLock()
 	p, ok := r.players[pid]
+	r.playersLock.RUnlock()
+
 	if !ok {
 		return nil, ErrPlayerDoesntExist
 	}
@@ -102,83 +334,121 @@ func (r *Room) Player(pid uint) (*Player, error) {
 	return p, nil
 }
 
+// members returns every player in the room.
+func (r *Room) members() []*Player {
+	r.playersLock.RLock()
+	defer r.playersLock.RUnlock()
+
+	ps := make([]*Player, 0, len(r.players))
+	for _, p := range r.players {
+		ps = append(ps, p)
+	}
+
+	return ps
+}
+
+// Players returns a copy of every player in the room except the one with the
+// given ID.
+func (r *Room) Players(except uint) []Player {
+	r.playersLock.RLock()
+	defer r.playersLock.RUnlock()
+
+	var ps []Player
+
+	for _, p := range r.players {
+		if p.ID == except {
+			continue
+		}
+
+		ps = append(ps, p.copy())
+	}
+
+	return ps
+}
+
+func (r *Room) Info() RoomInfo {
+	r.playersLock.RLock()
+	defer r.playersLock.RUnlock()
+
+	return RoomInfo{
+		ID:      r.ID,
+		Name:    r.Opts.Name,
+		Players: len(r.players),
+	}
+}
+
 func (r *Room) CanJoin(p *Player) bool {
+	r.playersLock.RLock()
 	_, ok := r.players[p.ID]
+	r.playersLock.RUnlock()
 
 	return p.Valid() && !ok
 }
 
-func (r *Room) Join(u string, c *ChildConn) (*Player, error) {
-	p := &Player{
-		Username: u,
-		ID:       r.playerCount + 1, // Don't increment straight away so that to prevent an overflow.
-		nodesMap: make(map[uint]*Node),
-		Conn:     c.Parent(),
-	}
-
+// Join adds the player to the room. Players that have already registered all
+// of their nodes are announced to the rest of the room straight away.
+func (r *Room) Join(p *Player) error {
 	if !r.CanJoin(p) {
-		return nil, ErrPlayerCantJoin
+		return ErrPlayerCantJoin
 	}
 
+	r.playersLock.Lock()
 	r.players[p.ID] = p
+	r.playersLock.Unlock()
 
-	r.playerCount += 1
+	p.setRoom(r)
 
-	return p, nil
-}
+	// Snapshots start from scratch in every room.
+	p.snapshotsLock.Lock()
+	p.snapshots = newSnapshotHistory()
+	p.snapshotsLock.Unlock()
 
-func (r *Room) ping(conn *ChildConn) error {
-	pi := Ping{}
+	if h := p.Head(); h != nil && r.interest != nil {
+		r.interest.Track(p, h.Position)
+	}
 
-	err := conn.Read(&pi)
-	if err != nil {
-		return err
+	if p.Registered() {
+		r.broadcast(Broadcast{
+			Cmd:  PlayerJoinedCmd,
+			Com:  &PlayerJoined{Player: p.copy()},
+			From: p.ID,
+		})
 	}
 
-	po := Pong{
-		ReceivedAt: pi.SentAt,
+	if sc := r.Script(); sc != nil {
+		sc.onJoin(p)
 	}
 
-	return conn.Send(PongCmd, &po)
+	return nil
 }
 
-func (r *Room) connectRequest(conn *ChildConn) error {
-	c := ConnectRequest{}
+// Leave removes the player from the room and lets everyone else know.
+func (r *Room) Leave(p *Player) {
+	r.playersLock.Lock()
+	_, ok := r.players[p.ID]
+	delete(r.players, p.ID)
+	r.playersLock.Unlock()
 
-	err := conn.Read(&c)
-	if err != nil {
-		return err
+	if !ok {
+		return
 	}
 
-	cv := ConnectVerdict{
-		CanProceed: true,
-		Message:    "Welcome to the server!",
+	if r.interest != nil {
+		r.interest.Forget(p.ID)
 	}
 
-	p, err := r.Join(c.Username, conn)
-	if err != nil {
-		cv = ConnectVerdict{
-			CanProceed: false,
-			Message:    "Sorry. Connection rejected.",
-		}
-	} else {
-		cv.PlayerID = p.ID
-		conn.log().Println("Connected player:", p)
-
-		var ps []Player
-
-		for _, p := range r.players {
-			if p.ID == cv.PlayerID {
-				continue
-			}
+	r.releaseHeldBy(p.ID)
+	r.despawnSpawnedBy(p.ID)
 
-			ps = append(ps, *p)
-		}
-
-		cv.Players = ps
+	if sc := r.Script(); sc != nil {
+		sc.onLeave(p)
 	}
 
-	return conn.Send(ConnectVerdictCmd, &cv)
+	r.broadcast(Broadcast{
+		Cmd:  PlayerLeftCmd,
+		Com:  &PlayerLeft{PID: p.ID},
+		From: p.ID,
+	})
 }
 
 func (r *Room) environmentRequest(conn *ChildConn) error {
@@ -189,11 +459,18 @@ func (r *Room) environmentRequest(conn *ChildConn) error {
 		return err
 	}
 
+	world := r.Opts.Main
+	if r.Scene() != nil {
+		world = r.FlattenedKey()
+	}
+
 	ep := EnvironmentPackage{
 		AssetKeys: map[string]string{
-			"world": "room.gsml", // TODO: Do something here
+			"world": world,
 		},
-		Main: "world",
+		Main:    "world",
+		Version: r.s.EnvironmentVersion(),
+		Assets:  r.s.Assets.Assets(),
 	}
 
 	return conn.Send(EnvironmentPackageCmd, &ep)
@@ -207,9 +484,19 @@ func (r *Room) registerNode(conn *ChildConn) error {
 		return err
 	}
 
-	p, ok := r.players[rn.PID]
-	if !ok {
-		return ErrPlayerDoesntExist
+	p, err := sender(conn, rn.PID)
+	if err != nil {
+		return err
+	}
+
+	rn.Node.Position, err = r.Opts.Limits.Place(rn.Node.Position)
+	if err != nil {
+		return err
+	}
+
+	err = r.Opts.Limits.Rotate(rn.Node.Rotation)
+	if err != nil {
+		return err
 	}
 
 	nid, err := p.RegisterNode(rn.Node)
@@ -217,6 +504,10 @@ func (r *Room) registerNode(conn *ChildConn) error {
 		return err
 	}
 
+	if rn.Node.Type == HeadNode && r.interest != nil {
+		r.interest.Track(p, rn.Node.Position)
+	}
+
 	return conn.Send(RegisteredNodeCmd, &RegisteredNode{
 		NID: nid,
 	})
@@ -230,22 +521,81 @@ func (r *Room) updateNode(conn *ChildConn) error {
 		return err
 	}
 
+	_, err = sender(conn, un.PID)
+	if err != nil {
+		return err
+	}
+
+	return r.UpdateNode(un)
+}
+
+// UpdateNode moves a node and lets everyone in the room know. It is shared by
+// the reliable and unreliable channels.
+func (r *Room) UpdateNode(un UpdateNode) error {
 	p, err := r.Player(un.PID)
 	if err != nil {
 		return err
 	}
 
+	err = r.Opts.Limits.Rotate(un.Rotation)
+	if err != nil {
+		return err
+	}
+
+	// Only the server hides nodes.
+	un.Hidden = false
+
+	c := r.Collider()
+
+	// The check and the move have to happen together, or an update on the
+	// other channel could slip in between them.
+	p.nodesLock.Lock()
 	n, ok := p.nodesMap[un.NID]
 	if !ok {
+		p.nodesLock.Unlock()
 		return ErrNodeDoesntExist
 	}
 
+	// Updates can't arrive any faster than they're read, so don't let
+	// two landing together look like a teleport.
+	now := time.Now()
+	dt := now.Sub(n.updatedAt)
+	if min := time.Second / time.Duration(r.s.Opts.ReadSpeed); dt < min {
+		dt = min
+	}
+
+	un.Position, err = r.Opts.Limits.Check(n.Position, un.Position, dt)
+	if err != nil {
+		p.nodesLock.Unlock()
+		return err
+	}
+
+	if c != nil {
+		un.Position = c.Resolve(n.Position, un.Position)
+	}
+
 	n.Position = un.Position
 	n.Rotation = un.Rotation
+	n.updatedAt = now
+
+	moved := *n
+	p.nodesLock.Unlock()
+
+	r.s.Metrics.nodeUpdated()
 
-	r.Broadcast <- Broadcast{
+	if moved.Type == HeadNode && r.interest != nil {
+		r.interest.Track(p, moved.Position)
+	}
+
+	r.broadcast(Broadcast{
 		Cmd: UpdateNodeCmd,
 		Com: &un,
+	})
+
+	r.follow(&moved)
+
+	if sc := r.Script(); sc != nil {
+		sc.onNodeUpdate(p, moved)
 	}
 
 	return nil
@@ -259,17 +609,39 @@ func (r *Room) registeredAllNodes(conn *ChildConn) error {
 		return err
 	}
 
-	p, err := r.Player(ran.PID)
+	p, err := sender(conn, ran.PID)
 	if err != nil {
 		return err
 	}
 
-	r.Broadcast <- Broadcast{
-		Cmd: JoinRoomCmd,
-		Com: &JoinRoom{
-			Player: *p,
+	p.setRegistered()
+
+	r.broadcast(Broadcast{
+		Cmd: PlayerJoinedCmd,
+		Com: &PlayerJoined{
+			Player: p.copy(),
 		},
 		From: p.ID,
+	})
+
+	return nil
+}
+
+// broadcast queues b, unless the room has stopped broadcasting because the
+// server is shutting down.
+func (r *Room) broadcast(b Broadcast) {
+	select {
+	case r.Broadcast <- b:
+	case <-r.stopped:
+	}
+}
+
+// only returns the player with the ID, if they're one of ps.
+func only(ps []*Player, pid uint) []*Player {
+	for _, p := range ps {
+		if p.ID == pid {
+			return []*Player{p}
+		}
 	}
 
 	return nil
@@ -279,4 +651,12 @@ type Broadcast struct {
 	Cmd  string
 	Com  Preparer
 	From uint
+	To   uint // Only sends to this player if set.
+
+	// Only sends to players whose heads are within this distance of around,
+	// if set.
+	within float64
+	around Point
+
+	last bool // Stops the broadcast loop once it's been sent.
 }
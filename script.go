@@ -0,0 +1,752 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	runtimemetrics "runtime/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// DefaultScriptTimeout is how long a script gets to handle each hook.
+	DefaultScriptTimeout = 50 * time.Millisecond
+
+	// DefaultScriptStackSize is how many values a script can have on its
+	// stack at once.
+	DefaultScriptStackSize = 64 * 1024
+
+	// DefaultScriptMemory is how many bytes a script can allocate in one
+	// hook, and hold on to between them.
+	DefaultScriptMemory = 64 << 20
+
+	scriptCallDepth = 200 // How deep scripts can call functions.
+
+	// scriptMemoryCheck is how often the memory a hook has allocated is
+	// checked while it runs.
+	scriptMemoryCheck = time.Millisecond
+
+	// scriptMatchSize is more than the memory finding each match of a
+	// pattern takes.
+	scriptMatchSize = 256
+)
+
+// Script runs a room's Lua script. The script can define any of these global
+// functions, which the server calls when something happens in the room:
+//
+//	on_join(player)
+//	on_leave(player)
+//	on_node_update(player, node)
+//	on_tick(dt)
+//
+// Players are tables with an id and username, and nodes have an id, type,
+// label, x, y, z, rx, ry and rz. dt is in seconds.
+//
+// Scripts reach the room through the global room table:
+//
+//	room.id, room.name
+//	room.players()                    -- Every player in the room.
+//	room.send(pid, name, data)        -- A ScriptMessage to one player.
+//	room.broadcast(name, data)        -- A ScriptMessage to everyone.
+//	room.spawn(entity)                -- Takes asset, label, x, y, z and grabbable, returns the ID.
+//	room.move(id, x, y, z, rx, ry, rz)
+//	room.despawn(id)
+//	room.kick(pid, reason)
+//	room.command(name, fn)            -- fn(player, args) handles ScriptCommands with the name.
+//
+// Scripts only get the base, table, string, math and coroutine libraries,
+// without anything that loads code or touches files. Every call into a script
+// is stopped after ScriptTimeout, and it can't use more than ScriptStackSize
+// stack slots.
+//
+// A call which allocates more than ScriptMemory fails. Allocations are counted
+// across the whole server while the script runs, so that limit is a rough one
+// and only ever fails the call. A script which holds on to more than
+// ScriptMemory between calls is stopped for good. The string and table
+// functions which could build a huge string in one go refuse to, and pattern
+// matching stops along with the call when its time is up.
+type Script struct {
+	Key string
+
+	r         *Room
+	l         *lua.LState // Nil once the script is closed.
+	lock      sync.Mutex
+	timeout   time.Duration
+	memory    int64 // Limit in bytes.
+	allocated int64 // Since the script's size was last measured.
+	commands  map[string]*lua.LFunction
+	spawned   map[uint]struct{}
+	log       *log.Logger
+}
+
+// loadScript runs the room's script, replacing the one already running.
+func (r *Room) loadScript() error {
+	if r.Opts.Script == "" {
+		return nil
+	}
+
+	src, err := fs.ReadFile(os.DirFS(string(r.s.Assets.Dir)), r.Opts.Script)
+	if err != nil {
+		return &ScriptError{Key: r.Opts.Script, Err: err}
+	}
+
+	sc, err := newScript(r, r.Opts.Script, src)
+	if err != nil {
+		return err
+	}
+
+	r.sceneLock.Lock()
+	old := r.script
+	r.script = sc
+	r.sceneLock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+// Script returns the room's script, or nil if it hasn't got one.
+func (r *Room) Script() *Script {
+	r.sceneLock.RLock()
+	defer r.sceneLock.RUnlock()
+
+	return r.script
+}
+
+// compileScript checks the script parses, without running it.
+func compileScript(dir, key string) error {
+	src, err := fs.ReadFile(os.DirFS(dir), key)
+	if err != nil {
+		return &ScriptError{Key: key, Err: err}
+	}
+
+	chunk, err := parse.Parse(bytes.NewReader(src), key)
+	if err == nil {
+		_, err = lua.Compile(chunk, key)
+	}
+
+	if err != nil {
+		return &ScriptError{Key: key, Err: err}
+	}
+
+	return nil
+}
+
+func newScript(r *Room, key string, src []byte) (*Script, error) {
+	sc := &Script{
+		Key:      key,
+		r:        r,
+		timeout:  r.s.Opts.ScriptTimeout,
+		memory:   r.s.Opts.ScriptMemory,
+		commands: make(map[string]*lua.LFunction),
+		spawned:  make(map[uint]struct{}),
+		log:      log.New(os.Stdout, "script "+key+": ", logFlags),
+	}
+
+	sc.l = lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallDepth,
+		RegistryMaxSize: r.s.Opts.ScriptStackSize,
+	})
+
+	sc.sandbox()
+	sc.l.SetGlobal("room", sc.api())
+
+	fn, err := sc.l.Load(bytes.NewReader(src), key)
+	if err == nil {
+		err = sc.call(fn)
+	}
+
+	if err != nil {
+		sc.Close()
+		return nil, &ScriptError{Key: key, Err: err}
+	}
+
+	return sc, nil
+}
+
+// sandbox opens the libraries scripts are allowed, and takes away the parts of
+// them which aren't safe.
+func (sc *Script) sandbox() {
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+	} {
+		sc.l.Push(sc.l.NewFunction(lib.open))
+		sc.l.Push(lua.LString(lib.name))
+		sc.l.Call(1, 0)
+	}
+
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		sc.l.SetGlobal(name, lua.LNil)
+	}
+
+	sc.limitLibraries()
+
+	sc.l.SetGlobal("print", sc.l.NewFunction(func(l *lua.LState) int {
+		var b bytes.Buffer
+
+		for i := 1; i <= l.GetTop(); i++ {
+			if i > 1 {
+				b.WriteByte('\t')
+			}
+
+			b.WriteString(l.ToStringMeta(l.Get(i)).String())
+		}
+
+		sc.log.Println(b.String())
+		return 0
+	}))
+}
+
+// Close stops the script and removes everything it spawned.
+func (sc *Script) Close() {
+	sc.lock.Lock()
+	if sc.l != nil {
+		sc.l.Close()
+		sc.l = nil
+	}
+
+	spawned := sc.spawned
+	sc.spawned = make(map[uint]struct{})
+	sc.lock.Unlock()
+
+	for id := range spawned {
+		sc.r.Despawn(id)
+	}
+}
+
+// call runs fn within the script's time and memory limits. The lock must be
+// held, unless the script is still being loaded. It returns ErrScriptMemory if
+// the script has to be stopped.
+func (sc *Script) call(fn lua.LValue, args ...lua.LValue) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sc.timeout)
+	defer cancel()
+
+	start := heapAllocated()
+	var over int32
+
+	// The context is checked before every instruction, so cancelling it is
+	// how a call that's allocating too much gets stopped.
+	go func() {
+		t := time.NewTicker(scriptMemoryCheck)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+
+			if heapAllocated()-start > sc.memory {
+				atomic.StoreInt32(&over, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	sc.l.SetContext(ctx)
+	err := sc.l.CallByParam(lua.P{Fn: fn, Protect: true}, args...)
+	sc.l.RemoveContext()
+	cancel()
+
+	// The heap is shared with the rest of the server, so going over only
+	// fails the call. Only what the script itself holds on to stops it.
+	allocated := heapAllocated() - start
+	if atomic.LoadInt32(&over) == 1 || allocated > sc.memory {
+		err = ErrScriptAllocated
+		allocated = sc.memory
+	}
+
+	// Measuring the script takes as long as it's big, so only do it once it
+	// could have grown by a good part of its limit.
+	sc.allocated += allocated
+	if sc.allocated > sc.memory/4 {
+		sc.allocated = 0
+
+		if sc.size() > sc.memory {
+			return ErrScriptMemory
+		}
+	}
+
+	return err
+}
+
+// kill stops a script which has gone over its memory limit. The lock must be
+// held.
+func (sc *Script) kill() {
+	sc.log.Println("Stopping script:", ErrScriptMemory)
+
+	sc.l.Close()
+	sc.l = nil
+
+	for id := range sc.spawned {
+		sc.r.Despawn(id)
+	}
+
+	sc.spawned = make(map[uint]struct{})
+}
+
+// heapAllocated is how many bytes the server has allocated since it started.
+func heapAllocated() int64 {
+	s := []runtimemetrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	runtimemetrics.Read(s)
+
+	return int64(s[0].Value.Uint64())
+}
+
+// size measures how many bytes the script is holding on to, from everything
+// its globals, registry and commands can reach. Strings are counted every time
+// they're reachable, so it errs on the high side, and it stops counting once
+// the script is over its limit.
+func (sc *Script) size() int64 {
+	todo := []lua.LValue{sc.l.G.Global, sc.l.G.Registry}
+	for _, fn := range sc.commands {
+		todo = append(todo, fn)
+	}
+
+	seen := make(map[lua.LValue]bool)
+	var n int64
+
+	for len(todo) > 0 && n <= sc.memory {
+		v := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+
+		n += 16
+
+		switch v := v.(type) {
+		case lua.LString:
+			n += int64(len(v))
+		case *lua.LTable:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+
+			v.ForEach(func(k, e lua.LValue) {
+				n += 16
+				todo = append(todo, k, e)
+			})
+
+			if v.Metatable != nil {
+				todo = append(todo, v.Metatable)
+			}
+		case *lua.LFunction:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+
+			for _, uv := range v.Upvalues {
+				todo = append(todo, uv.Value())
+			}
+
+			if v.Env != nil {
+				todo = append(todo, v.Env)
+			}
+		case *lua.LState:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+
+			for i := 1; i <= v.GetTop(); i++ {
+				todo = append(todo, v.Get(i))
+			}
+		}
+	}
+
+	return n
+}
+
+// limitLibraries swaps the string and table functions which can build a
+// string of any size in one call for ones which refuse to go past the
+// script's memory limit, and the pattern functions for ones which stop when
+// the script's time is up.
+func (sc *Script) limitLibraries() {
+	limit := func(lib, name string, size func(l *lua.LState) int64) {
+		t := sc.l.GetGlobal(lib).(*lua.LTable)
+		fn := t.RawGetString(name).(*lua.LFunction).GFunction
+
+		t.RawSetString(name, sc.l.NewFunction(func(l *lua.LState) int {
+			if size(l) > sc.memory {
+				l.RaiseError("%v.%v would use more memory than the script is allowed", lib, name)
+			}
+
+			return fn(l)
+		}))
+	}
+
+	limit(lua.StringLibName, "rep", func(l *lua.LState) int64 {
+		s, n := int64(len(l.CheckString(1))), int64(l.CheckInt(2))
+		if s == 0 || n <= 0 {
+			return 0
+		}
+
+		// Dividing can't overflow where multiplying could.
+		if n > sc.memory/s {
+			return sc.memory + 1
+		}
+
+		return s * n
+	})
+
+	limit(lua.StringLibName, "format", formatSize)
+
+	limit(lua.TabLibName, "concat", func(l *lua.LState) int64 {
+		t := l.CheckTable(1)
+		sep := int64(len(l.OptString(2, "")))
+		j := l.OptInt(4, t.Len())
+
+		var n int64
+		for i := l.OptInt(3, 1); i <= j && i <= t.Len() && n <= sc.memory; i++ {
+			n += sep + int64(len(lua.LVAsString(t.RawGetInt(i))))
+		}
+
+		return n
+	})
+
+	str := sc.l.GetGlobal(lua.StringLibName).(*lua.LTable)
+	for name, fn := range map[string]lua.LGFunction{
+		"find":   sc.strFind,
+		"match":  sc.strMatch,
+		"gmatch": sc.strGmatch,
+		"gfind":  sc.strGmatch,
+		"gsub":   sc.strGsub,
+	} {
+		str.RawSetString(name, sc.l.NewFunction(fn))
+	}
+}
+
+// formatDirective is the most one directive of string.format can add beyond
+// the length of its argument, with the width and precision Lua allows.
+const formatDirective = 512
+
+// formatSize is the most string.format could make from its arguments. Like
+// Lua, it refuses widths and precisions of more than two digits, which Go's
+// fmt would otherwise pad out to a megabyte each.
+func formatSize(l *lua.LState) int64 {
+	f := l.CheckString(1)
+	n := int64(len(f))
+
+	digits := func(i int) int {
+		j := i
+		for j < len(f) && f[j] >= '0' && f[j] <= '9' {
+			j++
+		}
+
+		if j-i > 2 {
+			l.RaiseError("invalid format (width or precision too long)")
+		}
+
+		return j
+	}
+
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			continue
+		}
+
+		if i+1 < len(f) && f[i+1] == '%' {
+			i++
+			continue
+		}
+
+		i++
+		for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+			i++
+		}
+
+		i = digits(i)
+		if i < len(f) && f[i] == '.' {
+			i = digits(i + 1)
+		}
+
+		// Go's fmt can take widths from arguments and pick arguments by
+		// index, printing the same one any number of times. Lua can't.
+		if i < len(f) && (f[i] == '*' || f[i] == '[') {
+			l.RaiseError("invalid format (%q in directive)", f[i])
+		}
+
+		n += formatDirective
+	}
+
+	// Each argument is printed at most once, quoted at worst four times
+	// as long.
+	for i := 2; i <= l.GetTop(); i++ {
+		n += formatDirective
+
+		if s, ok := l.Get(i).(lua.LString); ok {
+			n += 4 * int64(len(s))
+		}
+	}
+
+	return n
+}
+
+// hook calls the global function with the name, if the script defined it.
+// Errors are logged rather than returned, since there's nobody to return them
+// to.
+func (sc *Script) hook(name string, args ...func(l *lua.LState) lua.LValue) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if sc.l == nil {
+		return
+	}
+
+	fn, ok := sc.l.GetGlobal(name).(*lua.LFunction)
+	if !ok {
+		return
+	}
+
+	vals := make([]lua.LValue, len(args))
+	for i, a := range args {
+		vals[i] = a(sc.l)
+	}
+
+	err := sc.call(fn, vals...)
+	if err != nil {
+		sc.log.Printf("%v: %v", name, err)
+	}
+
+	if err == ErrScriptMemory {
+		sc.kill()
+	}
+}
+
+func (sc *Script) onJoin(p *Player) {
+	sc.hook("on_join", playerValue(p))
+}
+
+func (sc *Script) onLeave(p *Player) {
+	sc.hook("on_leave", playerValue(p))
+}
+
+func (sc *Script) onNodeUpdate(p *Player, n Node) {
+	sc.hook("on_node_update", playerValue(p), nodeValue(n))
+}
+
+func (sc *Script) onTick(dt time.Duration) {
+	sc.hook("on_tick", func(*lua.LState) lua.LValue { return lua.LNumber(dt.Seconds()) })
+}
+
+// Command runs the handler the script registered for the command.
+func (sc *Script) Command(p *Player, name string, args map[string]string) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	fn, ok := sc.commands[name]
+	if !ok || sc.l == nil {
+		return ErrUnknownScriptCommand
+	}
+
+	t := sc.l.NewTable()
+	for k, v := range args {
+		t.RawSetString(k, lua.LString(v))
+	}
+
+	err := sc.call(fn, playerValue(p)(sc.l), t)
+	if err != nil {
+		sc.log.Printf("command %v: %v", name, err)
+
+		if err == ErrScriptMemory {
+			sc.kill()
+		}
+
+		return ErrScriptFailed
+	}
+
+	return nil
+}
+
+// api builds the room table scripts use.
+func (sc *Script) api() *lua.LTable {
+	r := sc.r
+	t := sc.l.NewTable()
+
+	t.RawSetString("id", lua.LNumber(r.ID))
+	t.RawSetString("name", lua.LString(r.Opts.Name))
+
+	sc.l.SetFuncs(t, map[string]lua.LGFunction{
+		"players": func(l *lua.LState) int {
+			ps := r.members()
+
+			sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+
+			list := l.NewTable()
+			for _, p := range ps {
+				list.Append(playerValue(p)(l))
+			}
+
+			l.Push(list)
+			return 1
+		},
+		"send": func(l *lua.LState) int {
+			pid := uint(l.CheckNumber(1))
+
+			r.broadcast(Broadcast{
+				Cmd: ScriptMessageCmd,
+				Com: &ScriptMessage{
+					Name: l.CheckString(2),
+					Data: stringMap(l, l.OptTable(3, l.NewTable())),
+				},
+				To: pid,
+			})
+
+			return 0
+		},
+		"broadcast": func(l *lua.LState) int {
+			r.broadcast(Broadcast{
+				Cmd: ScriptMessageCmd,
+				Com: &ScriptMessage{
+					Name: l.CheckString(1),
+					Data: stringMap(l, l.OptTable(2, l.NewTable())),
+				},
+			})
+
+			return 0
+		},
+		"spawn": func(l *lua.LState) int {
+			e := l.CheckTable(1)
+
+			position := Point{
+				X: float64(lua.LVAsNumber(e.RawGetString("x"))),
+				Y: float64(lua.LVAsNumber(e.RawGetString("y"))),
+				Z: float64(lua.LVAsNumber(e.RawGetString("z"))),
+			}
+			if !position.Finite() {
+				l.RaiseError("%v", ErrNodeNotFinite)
+			}
+
+			id := r.Spawn(Entity{
+				Asset:     lua.LVAsString(e.RawGetString("asset")),
+				Label:     lua.LVAsString(e.RawGetString("label")),
+				Position:  position,
+				Grabbable: lua.LVAsBool(e.RawGetString("grabbable")),
+			})
+
+			sc.spawned[id] = struct{}{}
+
+			l.Push(lua.LNumber(id))
+			return 1
+		},
+		"move": func(l *lua.LState) int {
+			err := r.MoveEntity(uint(l.CheckNumber(1)),
+				Point{X: float64(l.CheckNumber(2)), Y: float64(l.CheckNumber(3)), Z: float64(l.CheckNumber(4))},
+				Point{X: float64(l.OptNumber(5, 0)), Y: float64(l.OptNumber(6, 0)), Z: float64(l.OptNumber(7, 0))},
+			)
+			if err != nil {
+				l.RaiseError("%v", err)
+			}
+
+			return 0
+		},
+		"despawn": func(l *lua.LState) int {
+			id := uint(l.CheckNumber(1))
+			delete(sc.spawned, id)
+
+			err := r.Despawn(id)
+			if err != nil {
+				l.RaiseError("%v", err)
+			}
+
+			return 0
+		},
+		"kick": func(l *lua.LState) int {
+			p, err := r.Player(uint(l.CheckNumber(1)))
+			if err != nil {
+				l.RaiseError("%v", err)
+			}
+
+			r.s.Kick(p, l.OptString(2, "Kicked by the room."))
+			return 0
+		},
+		"command": func(l *lua.LState) int {
+			sc.commands[l.CheckString(1)] = l.CheckFunction(2)
+			return 0
+		},
+	})
+
+	return t
+}
+
+func playerValue(p *Player) func(l *lua.LState) lua.LValue {
+	return func(l *lua.LState) lua.LValue {
+		t := l.NewTable()
+		t.RawSetString("id", lua.LNumber(p.ID))
+		t.RawSetString("username", lua.LString(p.Username))
+
+		return t
+	}
+}
+
+func nodeValue(n Node) func(l *lua.LState) lua.LValue {
+	return func(l *lua.LState) lua.LValue {
+		t := l.NewTable()
+
+		for k, v := range map[string]float64{
+			"id": float64(n.ID), "type": float64(n.Type),
+			"x": n.Position.X, "y": n.Position.Y, "z": n.Position.Z,
+			"rx": n.Rotation.X, "ry": n.Rotation.Y, "rz": n.Rotation.Z,
+		} {
+			t.RawSetString(k, lua.LNumber(v))
+		}
+
+		t.RawSetString("label", lua.LString(n.Label))
+
+		return t
+	}
+}
+
+// stringMap turns a table into the data of a ScriptMessage.
+func stringMap(l *lua.LState, t *lua.LTable) map[string]string {
+	m := make(map[string]string)
+
+	t.ForEach(func(k, v lua.LValue) {
+		m[fmt.Sprint(k)] = l.ToStringMeta(v).String()
+	})
+
+	return m
+}
+
+func (r *Room) scriptCommand(conn *ChildConn) error {
+	sc := ScriptCommand{}
+
+	err := conn.Read(&sc)
+	if err != nil {
+		return err
+	}
+
+	p, err := sender(conn, sc.PID)
+	if err != nil {
+		return err
+	}
+
+	script := r.Script()
+	if script == nil {
+		return ErrUnknownScriptCommand
+	}
+
+	return script.Command(p, sc.Name, sc.Args)
+}
@@ -1,14 +1,24 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
-	"net"
+	"math"
+	"net/http"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	DefaultReadSpeed  = 60
 	DefaultWriteSpeed = 60
+
+	DefaultRoomName = "lobby"
+	DefaultRoomMain = "room.gsml"
 )
 
 var (
@@ -22,23 +32,149 @@ type Options struct {
 	WriteSpeed  float64
 	ReadSpeed   float64
 
+	// MaxFrameSize is the biggest communication the server reads from a
+	// player, in bytes. Zero uses the default.
+	MaxFrameSize int
+
 	AssetsDir  string
 	AssetsAddr string
+
+	// AssetsHTTP serves assets over HTTP rather than the framed protocol, and
+	// AssetsURL is advertised to clients in its place if set, such as the
+	// URL of a CDN in front of the server.
+	AssetsHTTP bool
+	AssetsURL  string
+
+	// WatchAssets is how often AssetsDir is checked for changes, which are
+	// pushed to players. Zero never checks.
+	WatchAssets time.Duration
+
+	// UnreliableAddr is the UDP address node updates can be sent to. Leave
+	// empty to keep everything on the reliable connection.
+	UnreliableAddr string
+
+	// TLS encrypts the game, asset and WebSocket listeners. Nil leaves them
+	// in plaintext.
+	TLS *TLSOptions
+
+	// Authenticator checks the credentials clients connect with. Anyone with
+	// a username can join if it's nil.
+	Authenticator Authenticator
+
+	// WebSocketAddr is the address browser clients connect to. Leave empty to
+	// only accept TCP connections.
+	WebSocketAddr string
+
+	// WebSocketOrigins are the pages served from other hosts, such as
+	// "https://example.com", which may connect over WebSockets. Only pages
+	// from the server's own host can otherwise.
+	WebSocketOrigins []string
+
+	// Chat limits what players can say to each other.
+	Chat ChatOptions
+
+	// Voice controls how far players can be heard over the unreliable
+	// channel.
+	Voice VoiceOptions
+
+	// Operators are the usernames which can run admin commands from their
+	// client. They need a UserAuthenticator, or anyone could claim to be
+	// one.
+	Operators []string
+
+	// BansFile keeps bans between restarts. Leave empty to forget them when
+	// the server stops.
+	BansFile string
+
+	// AdminSocket is the path of a Unix socket which takes admin commands,
+	// as sent by `gns admin`. Leave empty to go without.
+	AdminSocket string
+
+	// MetricsAddr is the address to serve Prometheus metrics on, at
+	// /metrics. Leave empty to go without.
+	MetricsAddr string
+
+	// StatusAddr is the address of the HTTP status API, see StatusHandler.
+	// Leave empty to go without. StatusToken has to be sent with requests
+	// which change anything, which are refused if it's empty.
+	StatusAddr  string
+	StatusToken string
+
+	// PingInterval is how often players are pinged to measure their round
+	// trip time. Zero uses the default.
+	PingInterval time.Duration
+
+	// ScriptTimeout is how long room scripts get to handle each hook,
+	// ScriptStackSize is how many values they can have on their stack and
+	// ScriptMemory is how many bytes they can allocate in one hook or hold
+	// on to between them. Zero uses the defaults.
+	ScriptTimeout   time.Duration
+	ScriptStackSize int
+	ScriptMemory    int64
+
+	// Rooms hosted by the server. The first room is the default one which
+	// players join when they connect without asking for a specific room.
+	Rooms []RoomOptions
 }
 
 type Server struct {
 	Opts Options
 
-	Netw   *Networker
-	Room   *Room
-	Assets *AssetServer
+	Netw       *Networker
+	Lobby      *Room
+	Assets     *AssetServer
+	Unreliable *UnreliableServer // Nil unless Options.UnreliableAddr is set.
+	WebSocket  *WebSocketServer  // Nil unless Options.WebSocketAddr is set.
+
+	Dispatch *Dispatch // Commands which aren't tied to a room.
+	Metrics  *Metrics
+
+	Bans *BanList
 
 	Ready chan struct{}
 
+	rooms     map[uint]*Room
+	roomsLock sync.RWMutex
+	roomCount uint
+
+	playerCount uint
+	playerLock  sync.Mutex
+
+	operators     map[string]uint // The player connected as each operator.
+	operatorsLock sync.Mutex
+
+	connCount  uint64
+	envVersion uint64
+
+	ln        listener
+	adminLn   listener
+	statusLn  listener
+	metricsLn listener
+	started   time.Time // Set when Go is called.
+	conns     map[*ComConn]struct{}
+	connsLock sync.Mutex
+
+	closing   chan struct{} // Closed once Shutdown is called.
+	closeOnce sync.Once
+	done      chan struct{} // Closed to stop the rooms.
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+
+	tlsConf *tls.Config
+	tlsErr  error
+	tlsOnce sync.Once
+
 	log *log.Logger
 }
 
-func New(o Options) *Server {
+// New sets up a server with the options, filling in defaults for any left
+// out. It refuses options which would leave the server open to abuse.
+func New(o Options) (*Server, error) {
+	// Anyone could take an operator's username if nobody checks it's theirs.
+	if len(o.Operators) > 0 && !identifiesUsers(o.Authenticator) {
+		return nil, ErrOperatorsNeedAuth
+	}
+
 	if o.WriteSpeed == 0 {
 		o.WriteSpeed = DefaultWriteSpeed
 	}
@@ -47,46 +183,579 @@ func New(o Options) *Server {
 		o.ReadSpeed = DefaultReadSpeed
 	}
 
+	if o.MaxFrameSize == 0 {
+		o.MaxFrameSize = DefaultMaxFrameSize
+	}
+
+	if o.PingInterval == 0 {
+		o.PingInterval = DefaultPingInterval
+	}
+
+	if o.ScriptTimeout == 0 {
+		o.ScriptTimeout = DefaultScriptTimeout
+	}
+
+	if o.ScriptStackSize == 0 {
+		o.ScriptStackSize = DefaultScriptStackSize
+	}
+
+	if o.ScriptMemory == 0 {
+		o.ScriptMemory = DefaultScriptMemory
+	}
+
+	o.Chat.defaults()
+	o.Voice.defaults()
+
+	if len(o.Rooms) == 0 {
+		o.Rooms = []RoomOptions{
+			{Name: DefaultRoomName, Main: DefaultRoomMain},
+		}
+	}
+
 	s := &Server{
 		Opts:   o,
 		Ready:  make(chan struct{}),
 		Assets: NewAssetServer(o.AssetsAddr, o.AssetsDir),
+		rooms:  make(map[uint]*Room),
+
+		operators: make(map[string]uint),
+		Bans:      &BanList{Path: o.BansFile},
+
+		envVersion: 1,
+
+		conns:   make(map[*ComConn]struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
 
 		log: log.New(os.Stdout, "server: ", logFlags),
 	}
 
+	s.Metrics = NewMetrics()
+	s.Assets.Metrics = s.Metrics
+
+	s.Assets.HTTP = o.AssetsHTTP
+	s.Assets.PublicURL = o.AssetsURL
+
 	s.Netw = &Networker{s: s}
-	s.Room = NewRoom(s)
 
-	return s
+	if o.UnreliableAddr != "" {
+		s.Unreliable = NewUnreliableServer(s, o.UnreliableAddr)
+	}
+
+	if o.WebSocketAddr != "" {
+		s.WebSocket = NewWebSocketServer(s, o.WebSocketAddr)
+		s.WebSocket.Origins = o.WebSocketOrigins
+	}
+
+	s.Dispatch = &Dispatch{
+		H: map[string]CommunicationHandler{
+			PingCmd:           s.ping,
+			ConnectRequestCmd: s.connectRequest,
+			ListRoomsCmd:      s.listRooms,
+			JoinRoomCmd:       s.joinRoom,
+			LeaveRoomCmd:      s.leaveRoom,
+
+			UnreliableRequestCmd:  s.unreliableRequest,
+			AssetServerRequestCmd: s.assetServerRequest,
+			AdminCommandCmd:       s.adminCommand,
+			PongCmd:               s.pong,
+		},
+		Metrics: s.Metrics,
+	}
+
+	for _, ro := range o.Rooms {
+		r := s.AddRoom(ro)
+
+		if s.Lobby == nil {
+			s.Lobby = r
+		}
+	}
+
+	return s, nil
+}
+
+// AddRoom creates a new room and starts updating it. It is safe to call while
+// the server is running.
+func (s *Server) AddRoom(o RoomOptions) *Room {
+	s.roomsLock.Lock()
+	id := s.roomCount + 1
+
+	r := NewRoom(s, id, o)
+	s.rooms[id] = r
+	s.roomCount += 1
+	s.roomsLock.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		r.StartUpdateLoop()
+	}()
+
+	return r
+}
+
+func (s *Server) Room(id uint) (*Room, error) {
+	s.roomsLock.RLock()
+	r, ok := s.rooms[id]
+	s.roomsLock.RUnlock()
+
+	if !ok {
+		return nil, ErrRoomDoesntExist
+	}
+
+	return r, nil
+}
+
+// Rooms returns every room on the server, ordered by ID.
+func (s *Server) Rooms() []*Room {
+	s.roomsLock.RLock()
+	rs := make([]*Room, 0, len(s.rooms))
+
+	for _, r := range s.rooms {
+		rs = append(rs, r)
+	}
+	s.roomsLock.RUnlock()
+
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ID < rs[j].ID })
+
+	return rs
+}
+
+// Move takes the player out of their current room and puts them into r.
+func (s *Server) Move(p *Player, r *Room) error {
+	old := p.Room()
+	if old == r {
+		return nil
+	}
+
+	if !r.CanJoin(p) {
+		return ErrPlayerCantJoin
+	}
+
+	if old != nil {
+		old.Leave(p)
+	}
+
+	return r.Join(p)
+}
+
+// Handle routes a communication either to the server's own dispatch or to the
+// room the sending player is currently in.
+func (s *Server) Handle(cmd string, conn *ChildConn) error {
+	if _, ok := s.Dispatch.H[cmd]; ok {
+		return s.Dispatch.Handle(cmd, conn)
+	}
+
+	p := conn.Parent().Player()
+	if p == nil {
+		return ErrPlayerNotConnected
+	}
+
+	r := p.Room()
+	if r == nil {
+		return ErrPlayerNotConnected
+	}
+
+	return r.Handle(cmd, conn)
 }
 
 func (s *Server) Listen() error {
-	ln, err := net.Listen(ConnectionType, s.Opts.Addr)
+	conf, err := s.loadTLS()
 	if err != nil {
 		return err
 	}
 
-	go func() { s.Ready <- struct{}{} }()
+	ln, err := listen(s.Opts.Addr, conf)
+	if err != nil {
+		return err
+	}
 
-	go s.Room.StartUpdateLoop()
+	err = s.ln.set(ln)
+	if err != nil {
+		return err
+	}
 
-	ids := uint(0)
+	go func() { s.Ready <- struct{}{} }()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			return err
+			return s.ln.err(err)
 		}
 
-		go s.Netw.Handle(conn, ids)
-
-		ids += 1
+		go s.Netw.Handle(conn, s.nextConnID())
 	}
 }
 
+// nextConnID hands out connection IDs across every listener, starting at 0.
+func (s *Server) nextConnID() uint {
+	return uint(atomic.AddUint64(&s.connCount, 1) - 1)
+}
+
 func (s *Server) Go() error {
-	go s.Assets.Listen()
+	s.started = time.Now()
+
+	conf, err := s.loadTLS()
+	if err != nil {
+		return err
+	}
+
+	s.Assets.TLS = conf
+
+	err = s.Assets.Scan()
+	if err != nil {
+		return err
+	}
+
+	err = s.Bans.Load()
+	if err != nil {
+		return err
+	}
+
+	// Don't start at all rather than serve a room nobody can load.
+	for _, r := range s.Rooms() {
+		err = r.loadScene()
+		if err != nil {
+			return err
+		}
+
+		err = r.loadScript()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Opts.WatchAssets > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.watchAssets(s.Opts.WatchAssets)
+		}()
+	}
+
+	if s.WebSocket != nil {
+		s.WebSocket.TLS = conf
+	}
+
+	s.serve("Asset server", s.Assets.Listen)
+
+	if s.Unreliable != nil {
+		s.serve("Unreliable server", s.Unreliable.Listen)
+	}
+
+	if s.WebSocket != nil {
+		s.serve("WebSocket server", s.WebSocket.Listen)
+	}
+
+	if s.Opts.AdminSocket != "" {
+		err = s.listenAdmin()
+		if err != nil {
+			return err
+		}
+
+		s.serve("Admin socket", s.serveAdmin)
+	}
+
+	if s.Opts.StatusAddr != "" {
+		err = s.listenHTTP(s.Opts.StatusAddr, conf, &s.statusLn)
+		if err != nil {
+			return err
+		}
+
+		s.serve("Status API", s.serveHTTP(&s.statusLn, s.StatusHandler()))
+	}
+
+	if s.Opts.MetricsAddr != "" {
+		err = s.listenHTTP(s.Opts.MetricsAddr, conf, &s.metricsLn)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.Metrics.Handler())
+
+		s.serve("Metrics", s.serveHTTP(&s.metricsLn, mux))
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.pingPlayers(s.Opts.PingInterval)
+	}()
 
 	return s.Listen()
 }
+
+// loadTLS reads the certificates the first time it's called.
+func (s *Server) loadTLS() (*tls.Config, error) {
+	s.tlsOnce.Do(func() {
+		s.tlsConf, s.tlsErr = s.Opts.TLS.Config()
+	})
+
+	return s.tlsConf, s.tlsErr
+}
+
+func (s *Server) newPlayer(u string, c *ComConn) *Player {
+	s.playerLock.Lock()
+	defer s.playerLock.Unlock()
+
+	s.playerCount += 1
+
+	return &Player{
+		Username: u,
+		ID:       s.playerCount,
+		nodesMap: make(map[uint]*Node),
+		Conn:     c,
+	}
+}
+
+// disconnected cleans up after a player whose connection has closed.
+func (s *Server) disconnected(p *Player) {
+	s.releaseOperator(p)
+
+	if s.Unreliable != nil {
+		s.Unreliable.Forget(p.ID)
+	}
+}
+
+// Kick tells the player why and disconnects them. They're taken out of their
+// room on its next tick.
+func (s *Server) Kick(p *Player, reason string) error {
+	// Write straight out, as the room might be what's kicking them and so
+	// wouldn't flush a delayed send.
+	err := p.Conn.Raw.Send(KickedCmd, &Kicked{Message: reason})
+	p.Conn.Close()
+
+	return err
+}
+
+func (s *Server) ping(conn *ChildConn) error {
+	pi := Ping{}
+
+	err := conn.Read(&pi)
+	if err != nil {
+		return err
+	}
+
+	po := Pong{
+		ReceivedAt: pi.SentAt,
+	}
+
+	return conn.Send(PongCmd, &po)
+}
+
+func (s *Server) connectRequest(conn *ChildConn) error {
+	c := ConnectRequest{}
+
+	err := conn.Read(&c)
+	if err != nil {
+		return err
+	}
+
+	codec := negotiateCodec(c.Codecs)
+
+	cv := ConnectVerdict{}
+
+	p, r, msg := s.admit(c, conn.Parent())
+	if p == nil {
+		cv.Message = msg
+	} else {
+		conn.Parent().bind(p)
+		conn.log().Printf("Connected player %q (%v)", p.Username, p.ID)
+
+		cv = ConnectVerdict{
+			CanProceed: true,
+			Message:    msg,
+			PlayerID:   p.ID,
+			RoomID:     r.ID,
+			Codec:      codec.Name(),
+			Players:    r.Players(p.ID),
+			Entities:   r.Entities(),
+		}
+	}
+
+	if !cv.CanProceed {
+		// Rejected connections aren't in a room, so nothing would ever flush
+		// a delayed send. Write the verdict straight out instead.
+		return conn.Parent().Raw.Send(ConnectVerdictCmd, &cv)
+	}
+
+	err = conn.Send(ConnectVerdictCmd, &cv)
+	if err != nil {
+		return err
+	}
+
+	// The verdict itself goes out in JSON, so only switch once it's sent.
+	conn.Parent().Raw.SetCodec(codec)
+
+	return nil
+}
+
+// admit lets the connection join as a player. If it can't, the message
+// explains why.
+func (s *Server) admit(c ConnectRequest, conn *ComConn) (*Player, *Room, string) {
+	if conn.Player() != nil {
+		return nil, nil, "Sorry. This connection has already joined."
+	}
+
+	if c.Username == "" {
+		return nil, nil, "Sorry. A username is required."
+	}
+
+	if b, ok := s.Bans.Match(c.Username, remoteIP(conn.Raw.NConn)); ok {
+		conn.log().Printf("Rejected %q: banned as %v", c.Username, b.Target())
+		return nil, nil, "Sorry. " + banMessage(b)
+	}
+
+	r := s.Lobby
+	if math.IsNaN(c.InterestRadius) || math.IsInf(c.InterestRadius, 0) || c.InterestRadius < 0 {
+		return nil, nil, "Sorry. The interest radius has to be a positive number."
+	}
+
+	if c.Room != 0 {
+		var err error
+
+		r, err = s.Room(c.Room)
+		if err != nil {
+			return nil, nil, "Sorry. That room does not exist."
+		}
+	}
+
+	if s.Opts.Authenticator != nil {
+		err := s.Opts.Authenticator.Authenticate(c.Username, c.Credential)
+		if err != nil {
+			conn.log().Printf("Rejected %q: %v", c.Username, err)
+			return nil, nil, fmt.Sprintf("Sorry. %v.", err)
+		}
+	}
+
+	p := s.newPlayer(c.Username, conn)
+	p.InterestRadius = c.InterestRadius
+	p.Snapshots = c.Snapshots
+	p.Pings = c.Pings
+
+	if !s.claimOperator(p) {
+		conn.log().Printf("Rejected %q: already connected as an operator", c.Username)
+		return nil, nil, "Sorry. That operator is already connected."
+	}
+
+	err := r.Join(p)
+	if err != nil {
+		s.releaseOperator(p)
+		return nil, nil, "Sorry. Unable to join the room."
+	}
+
+	return p, r, "Welcome to the server!"
+}
+
+func (s *Server) listRooms(conn *ChildConn) error {
+	lr := ListRooms{}
+
+	err := conn.Read(&lr)
+	if err != nil {
+		return err
+	}
+
+	rl := RoomList{}
+
+	for _, r := range s.Rooms() {
+		rl.Rooms = append(rl.Rooms, r.Info())
+	}
+
+	return conn.Send(RoomListCmd, &rl)
+}
+
+func (s *Server) joinRoom(conn *ChildConn) error {
+	jr := JoinRoom{}
+
+	err := conn.Read(&jr)
+	if err != nil {
+		return err
+	}
+
+	r, err := s.Room(jr.RoomID)
+	if err != nil {
+		return conn.Send(RoomVerdictCmd, &RoomVerdict{
+			CanProceed: false,
+			Message:    "Sorry. That room does not exist.",
+		})
+	}
+
+	return s.moveTo(conn, r)
+}
+
+func (s *Server) leaveRoom(conn *ChildConn) error {
+	lr := LeaveRoom{}
+
+	err := conn.Read(&lr)
+	if err != nil {
+		return err
+	}
+
+	return s.moveTo(conn, s.Lobby)
+}
+
+func (s *Server) moveTo(conn *ChildConn, r *Room) error {
+	p := conn.Parent().Player()
+	if p == nil {
+		return ErrPlayerNotConnected
+	}
+
+	err := s.Move(p, r)
+	if err != nil {
+		return conn.Send(RoomVerdictCmd, &RoomVerdict{
+			CanProceed: false,
+			Message:    "Sorry. Unable to join that room.",
+		})
+	}
+
+	return conn.Send(RoomVerdictCmd, &RoomVerdict{
+		CanProceed: true,
+		Message:    fmt.Sprintf("Welcome to %v!", r.Opts.Name),
+		RoomID:     r.ID,
+		Players:    r.Players(p.ID),
+		Entities:   r.Entities(),
+	})
+}
+
+func (s *Server) unreliableRequest(conn *ChildConn) error {
+	ur := UnreliableRequest{}
+
+	err := conn.Read(&ur)
+	if err != nil {
+		return err
+	}
+
+	p := conn.Parent().Player()
+	if p == nil {
+		return ErrPlayerNotConnected
+	}
+
+	uc := UnreliableChannel{}
+
+	if s.Unreliable != nil {
+		uc.Token, err = s.Unreliable.Open(p)
+		if err != nil {
+			return err
+		}
+
+		uc.Address = s.Unreliable.Addr
+	}
+
+	return conn.Send(UnreliableChannelCmd, &uc)
+}
+
+// assetServerRequest tells the client where to fetch assets from. There's
+// only the one asset server for now, so the region is ignored.
+func (s *Server) assetServerRequest(conn *ChildConn) error {
+	ar := AssetServerRequest{}
+
+	err := conn.Read(&ar)
+	if err != nil {
+		return err
+	}
+
+	return conn.Send(AssetServerAddressCmd, &AssetServerAddress{
+		Address: s.Assets.URL(),
+	})
+}
@@ -2,15 +2,43 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/gnamma/server/gsml"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	serverAddr = "localhost:3445"
 	assetsAddr = "localhost:3554"
+	udpAddr    = "localhost:3665"
+	wsAddr     = "localhost:3776"
+	metrics    = "localhost:3893"
 	files      = "test"
 
 	server *Server
@@ -20,13 +48,27 @@ var (
 func TestMain(m *testing.M) {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	server = New(Options{
+	var err error
+
+	server, err = New(Options{
 		Name:        "Test Server",
 		Description: "Used for testing",
 		Addr:        serverAddr,
 		AssetsDir:   files,
 		AssetsAddr:  assetsAddr,
+
+		UnreliableAddr: udpAddr,
+		WebSocketAddr:  wsAddr,
+		MetricsAddr:    metrics,
+
+		Rooms: []RoomOptions{
+			{Name: "lobby", Main: "main"},
+			{Name: "arena", Main: "main"},
+		},
 	})
+	if err != nil {
+		log.Fatal("Couldn't create server:", err)
+	}
 
 	client = &Client{
 		Addr:       serverAddr,
@@ -38,6 +80,8 @@ func TestMain(m *testing.M) {
 
 	<-server.Ready
 	<-server.Assets.Ready
+	<-server.Unreliable.Ready
+	<-server.WebSocket.Ready
 
 	os.Exit(m.Run())
 }
@@ -60,6 +104,50 @@ func TestRequestEnvironment(t *testing.T) {
 	}
 }
 
+func TestAssetManifest(t *testing.T) {
+	er, err := client.Environment()
+	if err != nil {
+		t.Fatal("Client could not get environment from server:", err)
+	}
+
+	ai, ok := er.Assets["main"]
+	if !ok || ai.Size != 14 || ai.Hash != hashOf([]byte("<room></room>\n")) {
+		t.Fatalf("Manifest is missing main or it's wrong: %+v", er.Assets)
+	}
+
+	dir, err := ioutil.TempDir("", "gns-cache")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &Client{AssetsAddr: assetsAddr, CacheDir: dir}
+
+	r, err := cc.AssetByHash(ai.Hash)
+	if err != nil {
+		t.Fatal("Client couldn't fetch asset by hash:", err)
+	}
+
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "<room></room>\n" {
+		t.Fatalf("Asset fetched by hash is not the same: %q", b)
+	}
+
+	// The second time it should come out of the cache, even with the
+	// server gone.
+	cc.AssetsAddr = "localhost:1"
+
+	_, err = cc.AssetByHash(ai.Hash)
+	if err != nil {
+		t.Fatal("Asset wasn't cached:", err)
+	}
+
+	_, err = client.Asset(HashKeyPrefix + hashOf([]byte("nothing")))
+	if err != ErrAssetNotFound {
+		t.Fatal("Expected ErrAssetNotFound for an unknown hash, got:", err)
+	}
+}
+
 func TestAssetRequest(t *testing.T) {
 	r, err := client.Asset("main")
 	if err != nil {
@@ -77,6 +165,148 @@ func TestAssetRequest(t *testing.T) {
 	}
 }
 
+func TestAssetErrors(t *testing.T) {
+	for key, want := range map[string]error{
+		"missing":   ErrAssetNotFound,
+		".":         ErrAssetForbidden,
+		"../main":   ErrAssetForbidden,
+		".htpasswd": ErrAssetForbidden,
+	} {
+		_, err := client.Asset(key)
+		if err != want {
+			t.Fatalf("Expected %v for %q, got: %v", want, key, err)
+		}
+	}
+
+	// Fill every transfer slot so the next request is turned away.
+	for i := 0; i < cap(server.Assets.transfers); i++ {
+		server.Assets.transfers <- struct{}{}
+	}
+
+	_, err := client.Asset("main")
+
+	for i := 0; i < cap(server.Assets.transfers); i++ {
+		<-server.Assets.transfers
+	}
+
+	if err != ErrAssetServerBusy {
+		t.Fatal("Expected the asset server to be busy, got:", err)
+	}
+
+	// None of that should have stopped the server.
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := client.Asset("main")
+			if err != nil {
+				t.Error("Client could not retrieve asset after errors:", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestAssetServerAddress(t *testing.T) {
+	addr, err := client.AssetServer()
+	if err != nil {
+		t.Fatal("Couldn't get the asset server's address:", err)
+	}
+
+	if addr != assetsAddr {
+		t.Fatalf("Expected asset server at %v, got %v", assetsAddr, addr)
+	}
+}
+
+func TestHTTPAssets(t *testing.T) {
+	as := NewAssetServer("localhost:3558", files)
+	as.HTTP = true
+
+	go as.Listen()
+	defer as.Close()
+
+	<-as.Ready
+
+	get := func(h map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", as.URL()+"main", nil)
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+
+		// Compression is checked by hand, so don't let the transport
+		// undo it.
+		res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatal("Couldn't request asset:", err)
+		}
+
+		return res
+	}
+
+	res := get(nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	etag := res.Header.Get("ETag")
+	if string(body) != "<room></room>\n" || etag == "" || res.Header.Get("Last-Modified") == "" {
+		t.Fatalf("Unexpected response: %v %q %v", res.Status, body, res.Header)
+	}
+
+	res = get(map[string]string{"If-None-Match": etag})
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatal("Expected a cached asset not to be sent again, got:", res.Status)
+	}
+
+	res = get(map[string]string{"Range": "bytes=1-4"})
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent || string(body) != "room" {
+		t.Fatalf("Expected part of the asset, got: %v %q", res.Status, body)
+	}
+
+	res = get(map[string]string{"Accept-Encoding": "gzip"})
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("Expected a gzipped asset, got:", res.Header)
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal("Couldn't read gzipped asset:", err)
+	}
+
+	body, _ = ioutil.ReadAll(gz)
+	if string(body) != "<room></room>\n" {
+		t.Fatalf("Gzipped asset is not the same: %q", body)
+	}
+
+	hc := &Client{AssetsAddr: as.URL()}
+
+	r, err := hc.Asset("main")
+	if err != nil {
+		t.Fatal("Client couldn't get asset over HTTP:", err)
+	}
+
+	body, _ = ioutil.ReadAll(r)
+	if string(body) != "<room></room>\n" {
+		t.Fatalf("Asset is not the same over HTTP: %q", body)
+	}
+
+	_, err = hc.Asset("missing")
+	if err != ErrAssetNotFound {
+		t.Fatal("Expected ErrAssetNotFound over HTTP, got:", err)
+	}
+}
+
 func TestPing(t *testing.T) {
 	_, err := client.Ping()
 	if err != nil {
@@ -134,3 +364,2405 @@ func TestNodes(t *testing.T) {
 		log.Fatal("Couldn't register nodes:", err)
 	}
 }
+
+func TestRooms(t *testing.T) {
+	rs, err := client.Rooms()
+	if err != nil {
+		t.Fatal("Client could not list rooms:", err)
+	}
+
+	if len(rs) != 2 {
+		t.Fatalf("Wrong number of rooms, expected 2, got %v", len(rs))
+	}
+
+	if rs[0].Name != "lobby" || rs[1].Name != "arena" {
+		t.Fatalf("Wrong rooms, got %v", rs)
+	}
+}
+
+func TestJoinRoom(t *testing.T) {
+	if client.Room != server.Lobby.ID {
+		t.Fatalf("Client should start in the lobby, got room %v", client.Room)
+	}
+
+	err := client.JoinRoom(2)
+	if err != nil {
+		t.Fatal("Client could not join room:", err)
+	}
+
+	if client.Room != 2 {
+		t.Fatalf("Wrong room, expected 2, got %v", client.Room)
+	}
+
+	r, err := server.Room(2)
+	if err != nil {
+		t.Fatal("Server lost the room:", err)
+	}
+
+	if r.Info().Players != 1 || server.Lobby.Info().Players != 0 {
+		t.Fatalf("Player wasn't moved between rooms")
+	}
+
+	_, err = client.Environment()
+	if err != nil {
+		t.Fatal("Client could not get environment from new room:", err)
+	}
+
+	err = client.JoinRoom(42)
+	if err != ErrClientRoomRejected {
+		t.Fatalf("Expected to be rejected from a missing room, got %v", err)
+	}
+
+	err = client.LeaveRoom()
+	if err != nil {
+		t.Fatal("Client could not leave room:", err)
+	}
+
+	if client.Room != server.Lobby.ID {
+		t.Fatalf("Client should be back in the lobby, got room %v", client.Room)
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	un := UpdateNode{
+		PID:      3,
+		NID:      300,
+		Position: Point{1.5, -2, 0.25},
+	}
+	un.Prepare(UpdateNodeCmd)
+
+	out, err := BinaryCodec.Marshal(&un)
+	if err != nil {
+		t.Fatal("Couldn't marshal update:", err)
+	}
+
+	com := Communication{}
+	err = BinaryCodec.Unmarshal(out, &com)
+	if err != nil || com.Command != UpdateNodeCmd {
+		t.Fatalf("Couldn't read command back, got %q: %v", com.Command, err)
+	}
+
+	got := UpdateNode{}
+	err = BinaryCodec.Unmarshal(out, &got)
+	if err != nil {
+		t.Fatal("Couldn't unmarshal update:", err)
+	}
+
+	if got != un {
+		t.Fatalf("Update changed on the wire, expected %v, got %v", un, got)
+	}
+
+	bc := &Client{
+		Addr:       serverAddr,
+		Username:   "art3mis",
+		AssetsAddr: assetsAddr,
+		Codec:      BinaryCodecName,
+	}
+
+	err = bc.Connect()
+	if err != nil {
+		t.Fatal("Binary client could not connect:", err)
+	}
+
+	if bc.conn.Raw.Codec() != BinaryCodec {
+		t.Fatalf("Binary codec wasn't negotiated, got %v", bc.conn.Raw.Codec().Name())
+	}
+
+	_, err = bc.Ping()
+	if err != nil {
+		t.Fatal("Binary client could not ping the server:", err)
+	}
+
+	err = bc.RegisterNodes([]*Node{{Type: HeadNode, Label: "binary head"}})
+	if err != nil {
+		t.Fatal("Binary client could not register nodes:", err)
+	}
+}
+
+func TestUnreliableUpdate(t *testing.T) {
+	if client.udp == nil {
+		t.Fatal("Client didn't open an unreliable channel")
+	}
+
+	n := lockedNode(client.player, 1)
+	n.Position = Point{5, 6, 7}
+
+	err := client.UpdateNode(n)
+	if err != nil {
+		t.Fatal("Client could not send update:", err)
+	}
+
+	p, err := server.Lobby.Player(client.player.ID)
+	if err != nil {
+		t.Fatal("Player isn't in the lobby:", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if lockedNode(p, 1).Position == n.Position {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Node never moved, expected %v, got %v", n.Position, lockedNode(p, 1).Position)
+}
+
+// lockedNode copies one of the player's nodes while nothing can move it.
+func lockedNode(p *Player, id uint) Node {
+	p.nodesLock.RLock()
+	defer p.nodesLock.RUnlock()
+
+	return *p.nodesMap[id]
+}
+
+// TestConcurrentNodeUpdates moves one node over both channels at once. It's
+// only useful with -race.
+func TestConcurrentNodeUpdates(t *testing.T) {
+	if client.udp == nil {
+		t.Fatal("Client didn't open an unreliable channel")
+	}
+
+	n := lockedNode(client.player, 1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			m := n
+			m.Position = Point{5, 6, 7 + float64(i%2)/10}
+
+			err := client.UpdateNode(m)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 50; i++ {
+			err := client.conn.Send(UpdateNodeCmd, &UpdateNode{
+				PID:      client.player.ID,
+				NID:      n.ID,
+				Position: Point{5, 6, 7 - float64(i%2)/10},
+				Rotation: n.Rotation,
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal("Client could not send update:", err)
+	}
+
+	p, err := server.Lobby.Player(client.player.ID)
+	if err != nil {
+		t.Fatal("Player isn't in the lobby:", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if lockedNode(p, 1).Position.Distance(Point{5, 6, 7}) <= 0.1 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Node never settled near", Point{5, 6, 7}, "got", lockedNode(p, 1).Position)
+}
+
+func TestUnreliableFlood(t *testing.T) {
+	r := server.AddRoom(RoomOptions{Name: "flood", Main: "main"})
+
+	c := &Client{
+		Addr:       serverAddr,
+		Username:   "flood",
+		AssetsAddr: assetsAddr,
+		Room:       r.ID,
+	}
+
+	err := c.Connect()
+	if err != nil {
+		t.Fatal("Flooding client could not connect:", err)
+	}
+
+	if c.udp == nil {
+		t.Fatal("Flooding client has no unreliable channel")
+	}
+
+	n := &Node{Type: HeadNode}
+
+	err = c.RegisterNodes([]*Node{n})
+	if err != nil {
+		t.Fatal("Flooding client could not register nodes:", err)
+	}
+
+	p, err := r.Player(c.player.ID)
+	if err != nil {
+		t.Fatal("Flooding player isn't in the room:", err)
+	}
+
+	// Each update moves a little further, so how far the node got shows
+	// how many were let through.
+	for i := 1; i <= 100; i++ {
+		m := *n
+		m.Position = Point{float64(i) / 1000, 0, 0}
+
+		err := c.UpdateNode(m)
+		if err != nil {
+			t.Fatal("Flooding client could not send update:", err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	x := lockedNode(p, n.ID).Position.X
+	if x == 0 || x >= 0.1 {
+		t.Fatal("Flooding client should be limited, but the node got to", x)
+	}
+
+	// Once the flood is over, updates get through again.
+	m := *n
+	m.Position = Point{0.1, 0, 0}
+
+	err = c.UpdateNode(m)
+	if err != nil {
+		t.Fatal("Flooding client could not send update:", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if lockedNode(p, n.ID).Position.Distance(m.Position) < 1e-6 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Node never moved after the flood, got", lockedNode(p, n.ID).Position)
+}
+
+func TestWebSocket(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+wsAddr+"/", nil)
+	if err != nil {
+		t.Fatal("Couldn't dial WebSocket server:", err)
+	}
+	defer ws.Close()
+
+	cr := ConnectRequest{Username: "aech"}
+	cr.Prepare(ConnectRequestCmd)
+
+	err = ws.WriteJSON(&cr)
+	if err != nil {
+		t.Fatal("Couldn't send connect request:", err)
+	}
+
+	cv := ConnectVerdict{}
+
+	err = ws.ReadJSON(&cv)
+	if err != nil {
+		t.Fatal("Couldn't read connect verdict:", err)
+	}
+
+	if !cv.CanProceed || cv.RoomID != server.Lobby.ID {
+		t.Fatalf("Browser client wasn't let into the lobby: %v", cv.Message)
+	}
+
+	_, err = server.Lobby.Player(cv.PlayerID)
+	if err != nil {
+		t.Fatal("Browser client isn't in the same room as native clients:", err)
+	}
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	h := http.Header{"Origin": {"http://" + wsAddr}}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+wsAddr+"/", h)
+	if err != nil {
+		t.Fatal("Page from the server's own host couldn't connect:", err)
+	}
+	defer ws.Close()
+
+	h = http.Header{"Origin": {"https://elsewhere.example"}}
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+wsAddr+"/", h)
+	if err == nil {
+		t.Fatal("Page from another host was let in")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("Page from another host wasn't forbidden:", err)
+	}
+
+	// A message bigger than any frame can be should close the connection
+	// rather than be read into memory.
+	err = ws.WriteMessage(websocket.TextMessage, make([]byte, server.Opts.MaxFrameSize+2))
+	if err != nil {
+		t.Fatal("Couldn't send message:", err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatal("Oversized message didn't close the connection:", err)
+	}
+}
+
+func TestInterest(t *testing.T) {
+	in := NewInterest(10, 0.1)
+
+	near := &Player{ID: 1}
+	far := &Player{ID: 2}
+	owner := &Player{ID: 3}
+	headless := &Player{ID: 4}
+
+	in.Track(near, Point{0, 0, 0})
+	in.Track(far, Point{20, 0, 0})
+	in.Track(owner, Point{-50, 0, 0})
+
+	ps := []*Player{near, far, owner, headless}
+
+	steps := []struct {
+		x    float64
+		sees []uint
+		left []uint
+	}{
+		{5, []uint{1, 3, 4}, nil},
+		{10.5, []uint{1, 2, 3, 4}, nil}, // Still in view of 1 thanks to hysteresis.
+		{11.5, []uint{2, 3, 4}, []uint{1}},
+		{10.5, []uint{2, 3, 4}, nil}, // Has to come back within the radius to be seen again.
+		{40, []uint{3, 4}, []uint{2}},
+	}
+
+	for _, s := range steps {
+		var got, gone []uint
+
+		see, left := in.Recipients(&UpdateNode{PID: 3, NID: 1, Position: Point{s.x, 0, 0}}, ps)
+		for _, p := range see {
+			got = append(got, p.ID)
+		}
+		for _, p := range left {
+			gone = append(gone, p.ID)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(s.sees) || fmt.Sprint(gone) != fmt.Sprint(s.left) {
+			t.Fatalf("Wrong recipients for node at x=%v, expected %v and %v left, got %v and %v left", s.x, s.sees, s.left, got, gone)
+		}
+	}
+
+	// A player who gets a head stops seeing what's out of range.
+	in.Track(headless, Point{0, 0, 0})
+
+	_, left := in.Recipients(&UpdateNode{PID: 3, NID: 1, Position: Point{40, 0, 0}}, ps)
+	if len(left) != 1 || left[0] != headless {
+		t.Fatal("Node out of range wasn't hidden from a player who got a head:", left)
+	}
+
+	in.Recipients(&UpdateNode{PID: 3, NID: 1, Position: Point{0, 0, 0}}, ps)
+	in.Forget(owner.ID)
+
+	for pid, vis := range in.visible {
+		if len(vis) != 0 {
+			t.Fatalf("Player %v can still see nodes of a player who left: %v", pid, vis)
+		}
+	}
+}
+
+func TestHiddenNodes(t *testing.T) {
+	r := server.AddRoom(RoomOptions{Name: "hidden", Main: "main", InterestRadius: 10})
+
+	var cs []*Client
+	var heads []*Node
+
+	for _, name := range []string{"watcher", "wanderer"} {
+		c := &Client{
+			Addr:       serverAddr,
+			Username:   name,
+			AssetsAddr: assetsAddr,
+			Room:       r.ID,
+		}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Client could not connect:", err)
+		}
+
+		head := &Node{Type: HeadNode}
+
+		err = c.RegisterNodes([]*Node{head})
+		if err != nil {
+			t.Fatal("Client could not register nodes:", err)
+		}
+
+		cs = append(cs, c)
+		heads = append(heads, head)
+	}
+
+	watcher, wanderer := cs[0], cs[1]
+
+	// Waits for the next update about the wanderer's head.
+	next := func() UpdateNode {
+		got := make(chan UpdateNode)
+
+		go func() {
+			for {
+				un := UpdateNode{}
+
+				err := watcher.ExpectAndRead(UpdateNodeCmd, &un)
+				if err == nil && un.PID == wanderer.player.ID {
+					got <- un
+					return
+				}
+			}
+		}()
+
+		select {
+		case un := <-got:
+			return un
+		case <-time.After(2 * time.Second):
+			t.Fatal("Watcher never heard about the wanderer")
+		}
+
+		return UpdateNode{}
+	}
+
+	for _, x := range []float64{5, 30} {
+		n := *heads[1]
+		n.Position = Point{x, 0, 0}
+
+		err := wanderer.UpdateNode(n)
+		if err != nil {
+			t.Fatal("Wanderer could not send update:", err)
+		}
+
+		un := next()
+		if un.Position.X != x || un.Hidden != (x > 10) {
+			t.Fatalf("Wrong update for the wanderer at x=%v: %+v", x, un)
+		}
+	}
+}
+
+func TestInterestRadius(t *testing.T) {
+	in := NewInterest(10, 0.1)
+
+	greedy := &Player{ID: 1, InterestRadius: 1e12}
+	modest := &Player{ID: 2, InterestRadius: 2}
+
+	in.Track(greedy, Point{0, 0, 0})
+	in.Track(modest, Point{0, 0, 0})
+
+	got, _ := in.Recipients(&UpdateNode{PID: 3, NID: 1, Position: Point{50, 0, 0}}, []*Player{greedy, modest})
+	if len(got) != 0 {
+		t.Fatal("Asking for a radius bigger than the room's wasn't capped")
+	}
+
+	got, _ = in.Recipients(&UpdateNode{PID: 3, NID: 1, Position: Point{5, 0, 0}}, []*Player{greedy, modest})
+	if len(got) != 1 || got[0] != greedy {
+		t.Fatal("Wrong recipients for a node between the radii:", got)
+	}
+
+	in.Forget(greedy.ID)
+
+	if in.maxRadius != 2 {
+		t.Fatalf("Search radius didn't shrink when the furthest seeing player left, got %v", in.maxRadius)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	sc := &Client{
+		Addr:       serverAddr,
+		Username:   "shoto",
+		AssetsAddr: assetsAddr,
+		Room:       2,
+		Snapshots:  true,
+	}
+
+	err := sc.Connect()
+	if err != nil {
+		t.Fatal("Snapshot client could not connect:", err)
+	}
+
+	head := &Node{Type: HeadNode, Label: "snapshot head"}
+
+	err = sc.RegisterNodes([]*Node{head})
+	if err != nil {
+		t.Fatal("Snapshot client could not register nodes:", err)
+	}
+
+	ref := NodeRef{PID: sc.player.ID, NID: head.ID}
+
+	// Wait until the registered node shows up.
+	for i := 0; ; i++ {
+		state, err := sc.Snapshot()
+		if err != nil {
+			t.Fatal("Couldn't read snapshot:", err)
+		}
+
+		if _, ok := state[ref]; ok {
+			break
+		}
+
+		if i > 100 {
+			t.Fatal("Registered node never showed up in a snapshot")
+		}
+	}
+
+	head.Position = Point{1, 2, 3}
+
+	err = sc.UpdateNode(*head)
+	if err != nil {
+		t.Fatal("Couldn't update node:", err)
+	}
+
+	for i := 0; ; i++ {
+		state, err := sc.Snapshot()
+		if err != nil {
+			t.Fatal("Couldn't read snapshot:", err)
+		}
+
+		if state[ref].Position == head.Position {
+			break
+		}
+
+		if i > 100 {
+			t.Fatal("Node update never showed up in a snapshot")
+		}
+	}
+}
+
+func TestOversizedFrames(t *testing.T) {
+	for _, head := range [][]byte{
+		{'B', 0xff, 0xff, 0xff, 0xf0},
+		{'!', 0xff, 0xff, 0xff, 0xf0},
+		[]byte("4294967280\n"),
+		[]byte("-5\n"),
+	} {
+		conn, err := net.Dial(ConnectionType, serverAddr)
+		if err != nil {
+			t.Fatal("Couldn't connect:", err)
+		}
+
+		_, err = conn.Write(head)
+		if err != nil {
+			t.Fatal("Couldn't write frame header:", err)
+		}
+
+		// The server should give up on the connection rather than wait
+		// for the rest of the frame.
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("Server is waiting for the rest of a %q frame", head)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestForgedPlayer(t *testing.T) {
+	err := client.conn.Send(UpdateNodeCmd, &UpdateNode{
+		PID: client.player.ID + 100,
+		NID: 1,
+	})
+	if err != nil {
+		t.Fatal("Couldn't send forged update:", err)
+	}
+
+	pe, cmd, err := client.NextError()
+	if err != nil {
+		t.Fatal("Couldn't read error reply:", err)
+	}
+
+	if pe.Code != ErrWrongPlayer.Code || cmd != UpdateNodeCmd {
+		t.Fatalf("Wrong error reply, got %v for %v", pe.Code, cmd)
+	}
+}
+
+func TestEntities(t *testing.T) {
+	arena, err := server.Room(2)
+	if err != nil {
+		t.Fatal("Server lost the room:", err)
+	}
+
+	door := arena.Spawn(Entity{Asset: "door.obj", Label: "door"})
+	defer arena.Despawn(door)
+
+	ec := &Client{
+		Addr:       serverAddr,
+		Username:   "aech",
+		AssetsAddr: assetsAddr,
+		Room:       2,
+	}
+
+	err = ec.Connect()
+	if err != nil {
+		t.Fatal("Entity client could not connect:", err)
+	}
+
+	if len(ec.Entities) != 1 || ec.Entities[0].ID != door || ec.Entities[0].Owner != 0 {
+		t.Fatalf("Door wasn't sent with the verdict: %+v", ec.Entities)
+	}
+
+	crate := &Entity{Asset: "crate.obj", Position: Point{1, 0, 1}}
+
+	err = ec.SpawnEntity(crate)
+	if err != nil {
+		t.Fatal("Couldn't spawn crate:", err)
+	}
+
+	es := EntitySpawned{}
+	err = ec.ExpectAndRead(EntitySpawnedCmd, &es)
+	if err != nil || es.Entity.ID != crate.ID || es.Entity.Owner != ec.player.ID {
+		t.Fatalf("Wrong spawn broadcast, got %+v: %v", es.Entity, err)
+	}
+
+	err = ec.UpdateEntity(Entity{ID: door, Position: Point{5, 0, 0}})
+	if err != nil {
+		t.Fatal("Couldn't send door update:", err)
+	}
+
+	pe, _, err := ec.NextError()
+	if err != nil || pe.Code != ErrNotEntityOwner.Code {
+		t.Fatalf("Expected to not own the door, got %v: %v", pe, err)
+	}
+
+	// Scripts move entities from the room's tick.
+	var once sync.Once
+	arena.OnTick(func(r *Room, dt time.Duration) {
+		once.Do(func() { r.MoveEntity(door, Point{0, 2, 0}, Point{}) })
+	})
+
+	ue := UpdateEntity{}
+	err = ec.ExpectAndRead(UpdateEntityCmd, &ue)
+	if err != nil || ue.ID != door || ue.Position != (Point{0, 2, 0}) {
+		t.Fatalf("Wrong door update, got %+v: %v", ue, err)
+	}
+
+	err = ec.LeaveRoom()
+	if err != nil {
+		t.Fatal("Entity client could not leave room:", err)
+	}
+
+	_, err = arena.Entity(crate.ID)
+	if err != ErrEntityDoesntExist {
+		t.Fatalf("Crate should have gone with its owner, got %v", err)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	arena, err := server.Room(2)
+	if err != nil {
+		t.Fatal("Server lost the room:", err)
+	}
+
+	ball := arena.Spawn(Entity{Asset: "ball.obj", Position: Point{0, 1, 1}, Grabbable: true})
+	defer arena.Despawn(ball)
+
+	var cs []*Client
+	var arms []*Node
+
+	for _, name := range []string{"art3mis", "daito"} {
+		c := &Client{
+			Addr:       serverAddr,
+			Username:   name,
+			AssetsAddr: assetsAddr,
+			Room:       2,
+		}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Client could not connect:", err)
+		}
+
+		arm := &Node{Type: ArmNode, Position: Point{0, 1, 0}}
+
+		err = c.RegisterNodes([]*Node{arm})
+		if err != nil {
+			t.Fatal("Client could not register nodes:", err)
+		}
+
+		cs = append(cs, c)
+		arms = append(arms, arm)
+	}
+
+	// Both grab at once, and only one can have it.
+	granted := make([]bool, len(cs))
+	var wg sync.WaitGroup
+
+	for i, c := range cs {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+
+			ok, err := c.RequestOwnership(ball, arms[i].ID)
+			if err != nil {
+				t.Error("Couldn't request ownership:", err)
+			}
+
+			granted[i] = ok
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	if granted[0] == granted[1] {
+		t.Fatalf("Exactly one player should get the ball, got %v", granted)
+	}
+
+	winner, arm := cs[0], arms[0]
+	if granted[1] {
+		winner, arm = cs[1], arms[1]
+	}
+
+	arm.Position = Point{0, 2, 0}
+
+	err = winner.UpdateNode(*arm)
+	if err != nil {
+		t.Fatal("Couldn't move arm:", err)
+	}
+
+	for i := 0; ; i++ {
+		e, err := arena.Entity(ball)
+		if err != nil {
+			t.Fatal("Ball went missing:", err)
+		}
+
+		if e.Owner == winner.player.ID && e.Position == (Point{0, 2, 1}) {
+			break
+		}
+
+		if i > 100 {
+			t.Fatalf("Ball didn't follow the arm: %+v", e)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Holding the ball doesn't make it theirs to get rid of.
+	err = winner.DespawnEntity(ball)
+	if err != nil {
+		t.Fatal("Couldn't send despawn:", err)
+	}
+
+	pe, cmd, err := winner.NextError()
+	if err != nil || pe.Code != ErrNotEntityOwner.Code || cmd != DespawnEntityCmd {
+		t.Fatal("Expected despawning a grabbed entity to be refused, got:", pe, cmd, err)
+	}
+
+	_, err = arena.Entity(ball)
+	if err != nil {
+		t.Fatal("Grabbed ball was despawned:", err)
+	}
+
+	// Leaving lets go of everything.
+	winner.conn.Close()
+
+	for i := 0; ; i++ {
+		e, err := arena.Entity(ball)
+		if err != nil {
+			t.Fatal("Ball went missing:", err)
+		}
+
+		if e.Owner == 0 && e.Node == 0 {
+			break
+		}
+
+		if i > 200 {
+			t.Fatalf("Ball wasn't released on disconnect: %+v", e)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScript(t *testing.T) {
+	r := server.AddRoom(RoomOptions{Name: "scripted", Main: "main", Script: "room.lua"})
+
+	err := r.loadScript()
+	if err != nil {
+		t.Fatal("Couldn't load script:", err)
+	}
+
+	sc := &Client{
+		Addr:       serverAddr,
+		Username:   "h",
+		AssetsAddr: assetsAddr,
+		Room:       r.ID,
+	}
+
+	err = sc.Connect()
+	if err != nil {
+		t.Fatal("Script client could not connect:", err)
+	}
+
+	sm := ScriptMessage{}
+	err = sc.ExpectAndRead(ScriptMessageCmd, &sm)
+	if err != nil || sm.Name != "welcome" || sm.Data["name"] != "h" || sm.Data["joined"] != "1" {
+		t.Fatalf("Wrong welcome, got %+v: %v", sm, err)
+	}
+
+	err = sc.ScriptCommand("spin", map[string]string{"height": "3"})
+	if err != nil {
+		t.Fatal("Couldn't send command:", err)
+	}
+
+	err = sc.ExpectAndRead(ScriptMessageCmd, &sm)
+	if err != nil || sm.Name != "spun" || sm.Data["by"] != "h" {
+		t.Fatalf("Wrong reply to spin, got %+v: %v", sm, err)
+	}
+
+	es := r.Entities()
+	if len(es) != 1 || es[0].Asset != "top.obj" || es[0].Position.Y != 3 {
+		t.Fatalf("Script didn't spawn the top: %+v", es)
+	}
+
+	for cmd, code := range map[string]string{
+		"hang":    ErrScriptFailed.Code,
+		"recurse": ErrScriptFailed.Code,
+		"escape":  ErrScriptFailed.Code,
+		"dance":   ErrUnknownScriptCommand.Code,
+	} {
+		err = sc.ScriptCommand(cmd, nil)
+		if err != nil {
+			t.Fatal("Couldn't send command:", err)
+		}
+
+		pe, _, err := sc.NextError()
+		if err != nil || pe.Code != code {
+			t.Fatalf("Expected %v from %v, got %v: %v", code, cmd, pe, err)
+		}
+	}
+
+	// Whatever a script spawned goes with it.
+	r.Script().Close()
+
+	if es := r.Entities(); len(es) != 0 {
+		t.Fatalf("Closed script left entities behind: %+v", es)
+	}
+}
+
+func TestScriptMemory(t *testing.T) {
+	r := server.AddRoom(RoomOptions{Name: "greedy", Main: "main"})
+
+	for name, src := range map[string]string{
+		"rep":    `local s = string.rep("x", 1e12)`,
+		"method": `local s = ("x"):rep(1e12)`,
+		"format": `local s = string.format("%099999d", 1)`,
+		"gsub":   `local s = string.rep("x", 1e4):gsub("x", string.rep("y", 1e4))`,
+		"match":  `local s = string.rep("x", 1e6):gsub("", "")`,
+		"concat": `local s, t = string.rep("x", 1e6), {} for i = 1, 1e4 do t[i] = s end local c = table.concat(t)`,
+		"double": `local s = "x" while true do s = s .. s end`,
+		"huge":   `local s = string.rep("xxxx", 2^62)`,
+		"star":   `local s = string.format("%*d", 1e9, 1)`,
+		"expand": `local s = string.rep("x", 1e4):gsub(".+", string.rep("%0", 1e4))`,
+		"slow":   `local s = string.rep("a", 3e4):find(string.rep("a*", 10) .. "b")`,
+		"deep":   `local s = string.rep("a", 1e5):find(".*b")`,
+	} {
+		sc, err := newScript(r, name+".lua", []byte(src))
+		if err == nil {
+			sc.Close()
+			t.Fatalf("Script %v wasn't stopped", name)
+		}
+	}
+
+	// Garbage counts against a call, but only fails that call.
+	sc, err := newScript(r, "churn.lua", []byte(`
+function on_tick()
+  for i = 1, 100 do local s = string.rep("x", 1e6) .. i end
+end
+`))
+	if err != nil {
+		t.Fatal("Couldn't load script:", err)
+	}
+
+	sc.memory = 8 << 20
+
+	for i := 0; i < 10; i++ {
+		sc.onTick(time.Millisecond)
+	}
+
+	sc.lock.Lock()
+	stopped := sc.l == nil
+	sc.lock.Unlock()
+	sc.Close()
+
+	if stopped {
+		t.Fatal("Script which only made garbage was stopped for good")
+	}
+
+	// Patterns still work as Lua's do.
+	sc, err = newScript(r, "patterns.lua", []byte(`
+local s, n = ("hello world"):gsub("(%w+)", "<%1>")
+assert(s == "<hello> <world>" and n == 2, s)
+assert(("hello world"):gsub("o", {o = "0"}) == "hell0 w0rld")
+assert(("abc"):gsub("%w", function(c) return c:upper() end) == "ABC")
+assert(("abc"):gsub("", "-") == "-a-b-c-")
+assert(("abc"):gsub("b", "%%") == "a%c")
+assert(("hello"):gsub("l", "L", 1) == "heLlo")
+assert(("key = value"):match("(%w+) = (%w+)") == "key")
+assert(select(2, ("key = value"):match("(%w+) = (%w+)")) == "value")
+assert(("hello"):find("l") == 3)
+assert(select(3, ("hello"):find("(l+)")) == "ll")
+assert(("a.b"):find(".", 1, true) == 2)
+assert(("hello"):find("xyz") == nil)
+assert(("hello"):match("()ll()") == 3)
+local words = {}
+for w in ("one two three"):gmatch("%a+") do words[#words + 1] = w end
+assert(#words == 3 and words[3] == "three")
+`))
+	if err != nil {
+		t.Fatal("Patterns don't work:", err)
+	}
+	sc.Close()
+
+	sc, err = newScript(r, "hoard.lua", []byte(`
+t = {}
+function on_tick()
+  for i = 1, 20000 do t[#t + 1] = {i} end
+end
+`))
+	if err != nil {
+		t.Fatal("Couldn't load script:", err)
+	}
+	defer sc.Close()
+
+	sc.memory = 8 << 20
+
+	for i := 0; i < 100; i++ {
+		sc.onTick(time.Millisecond)
+
+		sc.lock.Lock()
+		stopped := sc.l == nil
+		sc.lock.Unlock()
+
+		if stopped {
+			return
+		}
+	}
+
+	t.Fatal("Script which held on to more and more memory wasn't stopped")
+}
+
+func TestChat(t *testing.T) {
+	server.Opts.Chat.Filter = func(from *Player, text string) (string, error) {
+		if strings.Contains(text, "spam") {
+			return "", errors.New("no spam")
+		}
+
+		return strings.Replace(text, "darn", "****", -1), nil
+	}
+	defer func() { server.Opts.Chat.Filter = nil }()
+
+	r := server.AddRoom(RoomOptions{Name: "chat", Main: "main"})
+
+	var cs []*Client
+
+	for i, name := range []string{"wade", "samantha"} {
+		c := &Client{
+			Addr:       serverAddr,
+			Username:   name,
+			AssetsAddr: assetsAddr,
+			Room:       r.ID,
+		}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Chat client could not connect:", err)
+		}
+
+		err = c.RegisterNodes([]*Node{{Type: HeadNode, Position: Point{float64(i) * 3, 2, 0}}})
+		if err != nil {
+			t.Fatal("Chat client could not register nodes:", err)
+		}
+
+		cs = append(cs, c)
+	}
+
+	wade, sam := cs[0], cs[1]
+
+	for _, send := range []func() error{
+		func() error { return wade.Chat("darn it") },
+		func() error { return wade.Whisper(sam.player.ID, "psst") },
+		func() error { return wade.ChatNearby("over here") },
+	} {
+		err := send()
+		if err != nil {
+			t.Fatal("Couldn't chat:", err)
+		}
+	}
+
+	// Messages can overtake each other on the way in.
+	got := make(map[string]ChatMessage)
+
+	for i := 0; i < 3; i++ {
+		cm := ChatMessage{}
+
+		err := sam.ExpectAndRead(ChatMessageCmd, &cm)
+		if err != nil {
+			t.Fatal("Couldn't read chat:", err)
+		}
+
+		got[cm.Scope] = cm
+	}
+
+	if got[ChatRoom].Text != "**** it" || got[ChatRoom].From != wade.player.ID || got[ChatRoom].Username != "wade" {
+		t.Fatalf("Wrong room chat: %+v", got[ChatRoom])
+	}
+
+	if got[ChatWhisper].Text != "psst" || got[ChatWhisper].To != sam.player.ID {
+		t.Fatalf("Wrong whisper: %+v", got[ChatWhisper])
+	}
+
+	if got[ChatNearby].Text != "over here" {
+		t.Fatalf("Wrong nearby chat: %+v", got[ChatNearby])
+	}
+
+	for text, code := range map[string]string{
+		"more spam":              ErrChatFiltered.Code,
+		strings.Repeat("a", 501): ErrChatTooLong.Code,
+		"   ":                    ErrChatEmpty.Code,
+	} {
+		err := wade.Chat(text)
+		if err != nil {
+			t.Fatal("Couldn't chat:", err)
+		}
+
+		pe, _, err := wade.NextError()
+		if err != nil || pe.Code != code {
+			t.Fatalf("Expected %v, got %v: %v", code, pe, err)
+		}
+	}
+
+	// Four of the five messages allowed at once have been used, so one more
+	// gets through, along with another if the test is slow.
+	for _, text := range []string{"one", "two", "three"} {
+		err := wade.Chat(text)
+		if err != nil {
+			t.Fatal("Couldn't chat:", err)
+		}
+	}
+
+	pe, _, err := wade.NextError()
+	if err != nil || pe.Code != ErrChatTooFast.Code {
+		t.Fatalf("Expected to be rate limited, got %v: %v", pe, err)
+	}
+
+	far := &Player{ID: 3, Nodes: []*Node{{Type: HeadNode, Position: Point{50, 2, 0}}}}
+	near := &Player{ID: 4, Nodes: []*Node{{Type: HeadNode, Position: Point{5, 2, 0}}}}
+
+	if ps := nearby([]*Player{far, near, {ID: 5}}, Point{0, 2, 0}, 10); len(ps) != 1 || ps[0] != near {
+		t.Fatalf("Wrong players nearby: %v", ps)
+	}
+}
+
+func TestVoice(t *testing.T) {
+	r := server.AddRoom(RoomOptions{Name: "voice", Main: "main"})
+
+	var cs []*Client
+
+	// Two units apart is half volume, and a hundred is out of range.
+	for i, x := range []float64{0, 2, 100} {
+		c := &Client{
+			Addr:       serverAddr,
+			Username:   fmt.Sprint("voice", i),
+			AssetsAddr: assetsAddr,
+			Room:       r.ID,
+		}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Voice client could not connect:", err)
+		}
+
+		if c.Voice() == nil {
+			t.Fatal("Voice client has no unreliable channel")
+		}
+
+		err = c.RegisterNodes([]*Node{{Type: HeadNode, Position: Point{x, 2, 0}}})
+		if err != nil {
+			t.Fatal("Voice client could not register nodes:", err)
+		}
+
+		cs = append(cs, c)
+	}
+
+	speaker, near, far := cs[0], cs[1], cs[2]
+
+	// Synthetic frames, it's all opaque to the server anyway.
+	frame := func(i int) []byte {
+		return append([]byte{0xfc, 0xff, 0xfe}, bytes.Repeat([]byte{byte(i)}, 100)...)
+	}
+
+	for i := 0; i < 5; i++ {
+		err := speaker.SendVoice(frame(i))
+		if err != nil {
+			t.Fatal("Couldn't send voice:", err)
+		}
+	}
+
+	select {
+	case vf := <-near.Voice():
+		if vf.PID != speaker.player.ID || vf.Gain != 0.5 || !bytes.Equal(vf.Data, frame(int(vf.Data[3]))) {
+			t.Fatalf("Wrong frame relayed: %+v", vf)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Nearby player never heard the speaker")
+	}
+
+	select {
+	case vf := <-far.Voice():
+		t.Fatalf("Player out of range heard %+v", vf)
+	case vf := <-speaker.Voice():
+		t.Fatalf("Speaker heard themselves: %+v", vf)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err := speaker.SendVoice(make([]byte, MaxVoiceFrameSize+1))
+	if err != nil {
+		t.Fatal("Couldn't send voice:", err)
+	}
+
+	select {
+	case vf := <-near.Voice():
+		if len(vf.Data) > MaxVoiceFrameSize {
+			t.Fatal("Oversized frame was relayed")
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Drain what's left, then flood well past the burst.
+	for len(near.Voice()) > 0 {
+		<-near.Voice()
+	}
+
+	for i := 0; i < 100; i++ {
+		err := speaker.SendVoice(frame(i))
+		if err != nil {
+			t.Fatal("Couldn't send voice:", err)
+		}
+	}
+
+	heard := 0
+	timeout := time.After(500 * time.Millisecond)
+
+	for waiting := true; waiting; {
+		select {
+		case <-near.Voice():
+			heard++
+		case <-timeout:
+			waiting = false
+		}
+	}
+
+	if heard == 0 || heard >= voiceBuffer {
+		t.Fatal("Flooding speaker should be limited, but relayed", heard, "frames")
+	}
+}
+
+func TestModeration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gns-moderation")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bans := filepath.Join(dir, "bans.json")
+	socket := filepath.Join(dir, "gns.sock")
+
+	o := Options{
+		Name:        "Moderation Test Server",
+		Addr:        "localhost:3450",
+		AssetsDir:   files,
+		AssetsAddr:  "localhost:3561",
+		Operators:   []string{"sorrento"},
+		BansFile:    bans,
+		AdminSocket: socket,
+	}
+
+	_, err = New(o)
+	if err != ErrOperatorsNeedAuth {
+		t.Fatal("Expected operators without an authenticator to be refused, got:", err)
+	}
+
+	// Anyone with a shared password could log in as an operator.
+	o.Authenticator = &PasswordAuthenticator{Password: "ioi"}
+
+	_, err = New(o)
+	if err != ErrOperatorsNeedAuth {
+		t.Fatal("Expected operators with a shared password to be refused, got:", err)
+	}
+
+	secret := []byte("ioi")
+	o.Authenticator = &TokenAuthenticator{Secret: secret}
+
+	ss, err := New(o)
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	go ss.Go()
+	defer ss.Shutdown(context.Background())
+
+	<-ss.Ready
+	<-ss.Assets.Ready
+
+	connect := func(u string) (*Client, error) {
+		c := &Client{
+			Addr:       ss.Opts.Addr,
+			AssetsAddr: ss.Opts.AssetsAddr,
+			Username:   u,
+			Credential: IssueToken(secret, u, time.Now().Add(time.Hour)),
+		}
+		return c, c.Connect()
+	}
+
+	cs := make(map[string]*Client)
+	for _, u := range []string{"sorrento", "wade", "aech"} {
+		c, err := connect(u)
+		if err != nil {
+			t.Fatal("Client could not connect:", err)
+		}
+
+		cs[u] = c
+	}
+
+	op, wade, aech := cs["sorrento"], cs["wade"], cs["aech"]
+
+	_, err = wade.Admin("players")
+	if pe, ok := err.(*ProtocolError); !ok || pe.Code != ErrNotOperator.Code {
+		t.Fatal("Expected a player who isn't an operator to be refused, got:", err)
+	}
+
+	_, err = connect("sorrento")
+	if re, ok := err.(*RejectedError); !ok || re.Message != "Sorry. That operator is already connected." {
+		t.Fatal("Expected a second connection as an operator to be refused, got:", err)
+	}
+
+	out, err := op.Admin("players")
+	if err != nil || strings.Count(out, "\n") != 2 || !strings.Contains(out, "\twade\t127.0.0.1\t") {
+		t.Fatalf("Wrong players listed: %q, %v", out, err)
+	}
+
+	out, err = op.Admin("mute aech")
+	if err != nil || out != "Muted 1 player" {
+		t.Fatalf("Couldn't mute: %q, %v", out, err)
+	}
+
+	err = aech.Chat("Hello?")
+	if err != nil {
+		t.Fatal("Couldn't send chat:", err)
+	}
+
+	pe, _, err := aech.NextError()
+	if err != nil || pe.Code != ErrMuted.Code {
+		t.Fatal("Expected muted player's chat to be refused, got:", pe, err)
+	}
+
+	_, err = DialAdmin(socket, "unmute aech")
+	if err != nil {
+		t.Fatal("Couldn't unmute over the admin socket:", err)
+	}
+
+	err = aech.Chat("Hello!")
+	if err != nil {
+		t.Fatal("Couldn't send chat:", err)
+	}
+
+	cm := ChatMessage{}
+	err = aech.ExpectAndRead(ChatMessageCmd, &cm)
+	if err != nil || cm.Text != "Hello!" {
+		t.Fatal("Unmuted player's chat wasn't sent:", cm, err)
+	}
+
+	_, err = op.Admin("kick wade Griefing the lobby")
+	if err != nil {
+		t.Fatal("Couldn't kick:", err)
+	}
+
+	k := Kicked{}
+	err = wade.ExpectAndRead(KickedCmd, &k)
+	if err != nil || k.Message != "Griefing the lobby" {
+		t.Fatal("Kicked player wasn't told why:", k, err)
+	}
+
+	_, err = DialAdmin(socket, "ban wade Still griefing")
+	if err != nil {
+		t.Fatal("Couldn't ban over the admin socket:", err)
+	}
+
+	_, err = DialAdmin(socket, "ban 10.0.0.0/8")
+	if err != nil {
+		t.Fatal("Couldn't ban a range:", err)
+	}
+
+	_, err = connect("wade")
+	re, ok := err.(*RejectedError)
+	if !ok || re.Message != "Sorry. You have been banned: Still griefing" {
+		t.Fatal("Expected banned player to be rejected, got:", err)
+	}
+
+	l := &BanList{Path: bans}
+
+	err = l.Load()
+	if err != nil {
+		t.Fatal("Couldn't load the bans back:", err)
+	}
+
+	if _, ok := l.Match("someone", "10.1.2.3"); !ok || len(l.List()) != 2 {
+		t.Fatal("Bans weren't saved:", l.List())
+	}
+
+	_, err = DialAdmin(socket, "unban wade")
+	if err != nil {
+		t.Fatal("Couldn't unban:", err)
+	}
+
+	_, err = DialAdmin(socket, "unban wade")
+	if err == nil || err.Error() != ErrNotBanned.Error() {
+		t.Fatal("Expected to be told wade isn't banned, got:", err)
+	}
+
+	_, err = DialAdmin(socket, "teleport wade")
+	if err == nil {
+		t.Fatal("Unknown admin command didn't fail")
+	}
+
+	_, err = connect("wade")
+	if err != nil {
+		t.Fatal("Unbanned player couldn't connect:", err)
+	}
+
+	// Everyone is on the same address, so this bans them all.
+	err = ss.Lobby.BanIP(aech.player.ID, "Botting")
+	if err != nil {
+		t.Fatal("Couldn't ban by address:", err)
+	}
+
+	err = op.ExpectAndRead(KickedCmd, &k)
+	if err != nil || k.Message != "You have been banned: Botting" {
+		t.Fatal("Player on a banned address wasn't kicked:", k, err)
+	}
+
+	_, err = connect("art3mis")
+	if _, ok := err.(*RejectedError); !ok {
+		t.Fatal("Expected player on a banned address to be rejected, got:", err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ss, err := New(Options{
+		Name:         "Status Test Server",
+		Description:  "Watched by a dashboard",
+		Addr:         "localhost:3451",
+		AssetsDir:    files,
+		AssetsAddr:   "localhost:3562",
+		StatusAddr:   "localhost:3891",
+		StatusToken:  "s3cret",
+		PingInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	go ss.Go()
+	defer ss.Shutdown(context.Background())
+
+	<-ss.Ready
+	<-ss.Assets.Ready
+
+	var cs []*Client
+	for _, u := range []string{"daito", "shoto"} {
+		c := &Client{Addr: ss.Opts.Addr, AssetsAddr: ss.Opts.AssetsAddr, Username: u}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Client could not connect:", err)
+		}
+
+		cs = append(cs, c)
+	}
+
+	err = cs[0].RegisterNodes([]*Node{{Type: HeadNode}, {Type: ArmNode}})
+	if err != nil {
+		t.Fatal("Couldn't register nodes:", err)
+	}
+
+	url := "http://" + ss.Opts.StatusAddr
+
+	var st ServerStatus
+
+	// Wait for both clients to answer a ping.
+	for start := time.Now(); ; {
+		res, err := http.Get(url + "/status")
+		if err != nil {
+			t.Fatal("Couldn't get the status:", err)
+		}
+
+		st = ServerStatus{}
+		err = json.NewDecoder(res.Body).Decode(&st)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal("Couldn't decode the status:", err)
+		}
+
+		ps := st.Rooms[0].Players
+		if len(ps) == 2 && ps[0].Ping > 0 && ps[1].Ping > 0 {
+			break
+		}
+
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Players never got a ping: %+v", st)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ps := st.Rooms[0].Players
+	if st.Name != ss.Opts.Name || st.Description != ss.Opts.Description || st.Players != 2 || st.Uptime <= 0 ||
+		ps[0].Username != "daito" || ps[0].Nodes != 2 || ps[1].Nodes != 0 || ps[0].IP != "127.0.0.1" ||
+		st.Assets.Count != len(ss.Assets.Assets()) || st.Assets.Size <= 0 {
+		t.Fatalf("Wrong status: %+v", st)
+	}
+
+	// A pong for a ping the server never sent says nothing about the round
+	// trip, however long ago it claims the ping was received.
+	err = cs[1].conn.Raw.Send(PongCmd, &Pong{ReceivedAt: 1, Nonce: 1})
+	if err != nil {
+		t.Fatal("Couldn't send pong:", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	for _, p := range ss.players() {
+		if p.Ping() <= 0 || p.Ping() > time.Second {
+			t.Fatalf("Wrong round trip for %v: %v", p.Username, p.Ping())
+		}
+	}
+
+	post := func(path, token, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, url+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Couldn't post:", err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if code := post("/broadcast", "", `{"message": "Hi"}`); code != http.StatusUnauthorized {
+		t.Fatal("Expected broadcasting without the token to be refused, got", code)
+	}
+
+	if code := post("/broadcast", "s3cret", `{"message": "Restarting in 5 minutes"}`); code != http.StatusNoContent {
+		t.Fatal("Couldn't broadcast, got", code)
+	}
+
+	for _, c := range cs {
+		sm := ServerMessage{}
+
+		err := c.ExpectAndRead(ServerMessageCmd, &sm)
+		if err != nil || sm.Message != "Restarting in 5 minutes" {
+			t.Fatalf("%v didn't get the message: %v", c.Username, err)
+		}
+	}
+
+	if code := post("/kick", "s3cret", `{"pid": 1000}`); code != http.StatusNotFound {
+		t.Fatal("Expected kicking a player who isn't there to fail, got", code)
+	}
+
+	if code := post("/kick", "s3cret", fmt.Sprintf(`{"pid": %v, "reason": "AFK"}`, cs[1].player.ID)); code != http.StatusNoContent {
+		t.Fatal("Couldn't kick, got", code)
+	}
+
+	k := Kicked{}
+	err = cs[1].ExpectAndRead(KickedCmd, &k)
+	if err != nil || k.Message != "AFK" {
+		t.Fatal("Kicked player wasn't told why:", k, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	err := client.conn.Send("no_such_command", &Ping{})
+	if err != nil {
+		t.Fatal("Couldn't send command:", err)
+	}
+
+	want := []string{
+		"gns_connections_open ",
+		`gns_commands_total{command="connect_request"} `,
+		`gns_commands_total{command="unknown"} `,
+		`gns_command_errors_total{command="unknown"} `,
+		`gns_command_duration_seconds_count{command="ping"} `,
+		"gns_node_updates_total ",
+		`gns_broadcast_duration_seconds_count{command="player_joined"} `,
+		`gns_room_tick_duration_seconds_count{room="lobby"} `,
+		`gns_players{room="lobby"} `,
+		`gns_asset_requests_total{result="ok"} `,
+		`gns_asset_requests_total{result="not_found"} `,
+		"gns_asset_transfer_bytes_count ",
+	}
+
+	var missing []string
+
+	// The unknown command is handled in the background, so give it a moment.
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+		res, err := http.Get("http://" + metrics + "/metrics")
+		if err != nil {
+			t.Fatal("Couldn't get the metrics:", err)
+		}
+
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal("Couldn't read the metrics:", err)
+		}
+
+		if bytes.Contains(b, []byte("no_such_command")) {
+			t.Fatal("Unknown command got its own label")
+		}
+
+		missing = nil
+		for _, m := range want {
+			if !bytes.Contains(b, []byte("\n"+m)) {
+				missing = append(missing, m)
+			}
+		}
+
+		if len(missing) == 0 {
+			return
+		}
+	}
+
+	t.Fatal("Metrics are missing:", missing)
+}
+
+func TestLimits(t *testing.T) {
+	l := Limits{
+		MaxSpeed: 10,
+		Min:      Point{-5, 0, -5},
+		Max:      Point{5, 10, 5},
+	}
+
+	_, err := l.Check(Point{}, Point{1, 1, 1}, time.Second)
+	if err != nil {
+		t.Fatal("Valid move was rejected:", err)
+	}
+
+	_, err = l.Check(Point{}, Point{0, 0, 6}, time.Second)
+	if err != ErrNodeOutOfBounds {
+		t.Fatalf("Expected out of bounds, got %v", err)
+	}
+
+	_, err = l.Check(Point{}, Point{0, 2, 0}, 100*time.Millisecond)
+	if err != ErrNodeTooFast {
+		t.Fatalf("Expected too fast, got %v", err)
+	}
+
+	l.Clamp = true
+
+	to, err := l.Check(Point{}, Point{0, 2, 0}, 100*time.Millisecond)
+	if err != nil || to != (Point{0, 1, 0}) {
+		t.Fatalf("Expected to be clamped to 1 unit, got %v: %v", to, err)
+	}
+
+	to, err = l.Check(Point{4, 0, 0}, Point{6, 0, 0}, time.Second)
+	if err != nil || to != (Point{5, 0, 0}) {
+		t.Fatalf("Expected to be clamped to the edge, got %v: %v", to, err)
+	}
+
+	// NaN compares false with everything, so it would get past both the
+	// bounds and the speed check.
+	for _, p := range []Point{{math.NaN(), 0, 0}, {0, math.Inf(1), 0}} {
+		_, err = l.Check(Point{}, p, time.Second)
+		if err != ErrNodeNotFinite {
+			t.Fatalf("Expected %v to be rejected, got %v", p, err)
+		}
+
+		_, err = (Limits{}).Place(p)
+		if err != ErrNodeNotFinite {
+			t.Fatalf("Expected %v to be rejected without limits, got %v", p, err)
+		}
+	}
+}
+
+func TestRegisterOutOfBounds(t *testing.T) {
+	ss, err := New(Options{
+		Name:       "Bounds Test Server",
+		Addr:       "localhost:3452",
+		AssetsDir:  files,
+		AssetsAddr: "localhost:3563",
+		Rooms: []RoomOptions{
+			{Name: "box", Main: "main", Limits: Limits{Min: Point{-5, 0, -5}, Max: Point{5, 10, 5}}},
+		},
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	go ss.Go()
+	defer ss.Shutdown(context.Background())
+
+	<-ss.Ready
+	<-ss.Assets.Ready
+
+	c := &Client{Addr: ss.Opts.Addr, AssetsAddr: ss.Opts.AssetsAddr, Username: "i-r0k"}
+
+	err = c.Connect()
+	if err != nil {
+		t.Fatal("Client could not connect:", err)
+	}
+
+	err = c.conn.Send(RegisterNodeCmd, &RegisterNode{
+		PID:  c.player.ID,
+		Node: Node{Type: HeadNode, Position: Point{0, 0, 100}},
+	})
+	if err != nil {
+		t.Fatal("Couldn't send node:", err)
+	}
+
+	pe, cmd, err := c.NextError()
+	if err != nil {
+		t.Fatal("Couldn't read error reply:", err)
+	}
+
+	if pe.Code != ErrNodeOutOfBounds.Code || cmd != RegisterNodeCmd {
+		t.Fatalf("Node outside the world was registered, got %v for %v", pe.Code, cmd)
+	}
+
+	err = c.RegisterNodes([]*Node{{Type: HeadNode, Position: Point{0, 1, 0}}})
+	if err != nil {
+		t.Fatal("Node inside the world wasn't registered:", err)
+	}
+}
+
+func TestNonFiniteRotation(t *testing.T) {
+	r := server.AddRoom(RoomOptions{Name: "spinning", Main: "main"})
+
+	var cs []*Client
+	for _, codec := range []string{BinaryCodecName, JSONCodecName} {
+		c := &Client{
+			Addr:       serverAddr,
+			Username:   "spinner-" + codec,
+			AssetsAddr: assetsAddr,
+			Room:       r.ID,
+			Codec:      codec,
+		}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Client could not connect:", err)
+		}
+
+		cs = append(cs, c)
+	}
+
+	bc, jc := cs[0], cs[1]
+
+	err := bc.conn.Send(RegisterNodeCmd, &RegisterNode{
+		PID:  bc.player.ID,
+		Node: Node{Type: HeadNode, Rotation: Point{math.NaN(), 0, 0}},
+	})
+	if err != nil {
+		t.Fatal("Couldn't send node:", err)
+	}
+
+	pe, cmd, err := bc.NextError()
+	if err != nil || pe.Code != ErrNodeNotFinite.Code || cmd != RegisterNodeCmd {
+		t.Fatal("Expected a NaN rotation to be refused, got:", pe, cmd, err)
+	}
+
+	err = bc.RegisterNodes([]*Node{{Type: HeadNode}})
+	if err != nil {
+		t.Fatal("Binary client could not register nodes:", err)
+	}
+
+	err = bc.conn.Send(UpdateNodeCmd, &UpdateNode{
+		PID:      bc.player.ID,
+		NID:      1,
+		Rotation: Point{0, math.Inf(1), 0},
+	})
+	if err != nil {
+		t.Fatal("Couldn't send update:", err)
+	}
+
+	pe, cmd, err = bc.NextError()
+	if err != nil || pe.Code != ErrNodeNotFinite.Code || cmd != UpdateNodeCmd {
+		t.Fatal("Expected an infinite rotation to be refused, got:", pe, cmd, err)
+	}
+
+	// Had it gone out, the JSON client couldn't have been sent it.
+	_, err = jc.Ping()
+	if err != nil {
+		t.Fatal("JSON client was disconnected:", err)
+	}
+
+	if p, err := r.Player(jc.player.ID); err != nil || p == nil {
+		t.Fatal("JSON client left the room:", err)
+	}
+
+	// Entities are sent to everyone joining, so one with a NaN would lock
+	// JSON clients out of the room.
+	err = bc.conn.Send(SpawnEntityCmd, &SpawnEntity{
+		PID:    bc.player.ID,
+		Entity: Entity{Asset: "crate.obj", Rotation: Point{math.NaN(), 0, 0}},
+	})
+	if err != nil {
+		t.Fatal("Couldn't send entity:", err)
+	}
+
+	pe, cmd, err = bc.NextError()
+	if err != nil || pe.Code != ErrNodeNotFinite.Code || cmd != SpawnEntityCmd {
+		t.Fatal("Expected an entity with a NaN rotation to be refused, got:", pe, cmd, err)
+	}
+
+	e := Entity{Asset: "crate.obj"}
+
+	err = bc.SpawnEntity(&e)
+	if err != nil {
+		t.Fatal("Couldn't spawn entity:", err)
+	}
+
+	e.Rotation = Point{0, 0, math.NaN()}
+
+	err = bc.UpdateEntity(e)
+	if err != nil {
+		t.Fatal("Couldn't send entity update:", err)
+	}
+
+	pe, cmd, err = bc.NextError()
+	if err != nil || pe.Code != ErrNodeNotFinite.Code || cmd != UpdateEntityCmd {
+		t.Fatal("Expected an entity update with a NaN rotation to be refused, got:", pe, cmd, err)
+	}
+
+	late := &Client{Addr: serverAddr, Username: "spinner-late", AssetsAddr: assetsAddr, Room: r.ID}
+
+	err = late.Connect()
+	if err != nil {
+		t.Fatal("JSON client couldn't join after the entity was spawned:", err)
+	}
+}
+
+func TestSpawnLimits(t *testing.T) {
+	ss, err := New(Options{
+		Name:       "Spawn Limits Test Server",
+		Addr:       "localhost:3453",
+		AssetsDir:  files,
+		AssetsAddr: "localhost:3564",
+		Rooms: []RoomOptions{{
+			Name:       "box",
+			Main:       "main",
+			Limits:     Limits{Min: Point{-5, 0, -5}, Max: Point{5, 10, 5}},
+			MaxSpawned: 2,
+		}},
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	go ss.Go()
+	defer ss.Shutdown(context.Background())
+
+	<-ss.Ready
+	<-ss.Assets.Ready
+
+	c := &Client{Addr: ss.Opts.Addr, AssetsAddr: ss.Opts.AssetsAddr, Username: "daito"}
+
+	err = c.Connect()
+	if err != nil {
+		t.Fatal("Client could not connect:", err)
+	}
+
+	refused := func(e Entity, code string) {
+		err := c.conn.Send(SpawnEntityCmd, &SpawnEntity{PID: c.player.ID, Entity: e})
+		if err != nil {
+			t.Fatal("Couldn't send entity:", err)
+		}
+
+		pe, cmd, err := c.NextError()
+		if err != nil {
+			t.Fatal("Couldn't read error reply:", err)
+		}
+
+		if pe.Code != code || cmd != SpawnEntityCmd {
+			t.Fatalf("Expected %v, got %v for %v", code, pe.Code, cmd)
+		}
+	}
+
+	refused(Entity{Asset: "crate.obj", Position: Point{0, 0, 100}}, ErrNodeOutOfBounds.Code)
+
+	for i := 0; i < 2; i++ {
+		err = c.SpawnEntity(&Entity{Asset: "crate.obj", Position: Point{0, 1, 0}})
+		if err != nil {
+			t.Fatal("Couldn't spawn entity:", err)
+		}
+	}
+
+	refused(Entity{Asset: "crate.obj", Position: Point{0, 1, 0}}, ErrTooManyEntities.Code)
+}
+
+func TestCollision(t *testing.T) {
+	scene, err := gsml.Parse(strings.NewReader(`<room>
+  <box name="wall" x="2" y="2" scale-y="4" scale-z="4"/>
+  <el y="3">
+    <plane name="shelf" x="-2" scale-x="2" scale-y="5" scale-z="2"/>
+  </el>
+</room>`))
+	if err != nil {
+		t.Fatal("Couldn't parse room:", err)
+	}
+
+	c := NewCollider(scene, Collision{Enabled: true})
+	if len(c.Boxes) != 2 || c.Boxes[1] != (AABB{Point{-3, 3, -1}, Point{-1, 3, 1}}) {
+		t.Fatalf("Wrong boxes: %+v", c.Boxes)
+	}
+
+	to := c.Resolve(Point{0, 1, 0}, Point{3, 1, 1})
+	if to.X > 1.5 || to.X < 1.49 || to.Y != 1 || to.Z != 1 {
+		t.Fatalf("Expected to slide along the wall, got %v", to)
+	}
+
+	to = c.Resolve(Point{-2, 4, 0}, Point{-2, 2, 0})
+	if to.Y < 3 || to.Y > 3.01 {
+		t.Fatalf("Expected to land on the shelf, got %v", to)
+	}
+
+	to = c.Resolve(Point{0, 1, 0}, Point{0, -1, 0})
+	if to != (Point{0, 0, 0}) {
+		t.Fatalf("Expected to stop at the floor, got %v", to)
+	}
+
+	to = c.Resolve(Point{2, 1, 0}, Point{4, 1, 0})
+	if to != (Point{4, 1, 0}) {
+		t.Fatalf("Expected to get out of the wall, got %v", to)
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	pw := &PasswordAuthenticator{Password: "hunter2"}
+
+	if pw.Authenticate("sorrento", "hunter2") != nil || pw.Authenticate("sorrento", "hunter3") != ErrWrongPassword {
+		t.Fatal("Password authenticator let the wrong people in")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("copper key"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Couldn't hash password:", err)
+	}
+
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal("Couldn't create htpasswd file:", err)
+	}
+	defer os.Remove(f.Name())
+
+	fmt.Fprintf(f, "# players\nparzival:%s\n", hash)
+	f.Close()
+
+	ht, err := NewHtpasswdAuthenticator(f.Name())
+	if err != nil {
+		t.Fatal("Couldn't load htpasswd file:", err)
+	}
+
+	if ht.Authenticate("parzival", "copper key") != nil {
+		t.Fatal("Htpasswd authenticator rejected the right password")
+	}
+
+	if ht.Authenticate("parzival", "jade key") != ErrWrongPassword || ht.Authenticate("nolan", "copper key") != ErrWrongPassword {
+		t.Fatal("Htpasswd authenticator let the wrong people in")
+	}
+
+	secret := []byte("anorak")
+	tok := &TokenAuthenticator{Secret: secret}
+
+	if tok.Authenticate("parzival", IssueToken(secret, "parzival", time.Now().Add(time.Hour))) != nil {
+		t.Fatal("Token authenticator rejected a valid token")
+	}
+
+	cases := map[string]error{
+		IssueToken(secret, "art3mis", time.Now().Add(time.Hour)):         ErrInvalidLoginToken,
+		IssueToken([]byte("ioi"), "parzival", time.Now().Add(time.Hour)): ErrInvalidLoginToken,
+		IssueToken(secret, "parzival", time.Now().Add(-time.Hour)):       ErrTokenExpired,
+		"not a token": ErrInvalidLoginToken,
+	}
+
+	for c, want := range cases {
+		if err := tok.Authenticate("parzival", c); err != want {
+			t.Fatalf("Expected %v for token %q, got %v", want, c, err)
+		}
+	}
+}
+
+func TestConnectCredentials(t *testing.T) {
+	server.Opts.Authenticator = &PasswordAuthenticator{Password: "hunter2"}
+	defer func() { server.Opts.Authenticator = nil }()
+
+	c := &Client{
+		Addr:       serverAddr,
+		Username:   "i-r0k",
+		Credential: "hunter3",
+	}
+
+	err := c.Connect()
+
+	re, ok := err.(*RejectedError)
+	if !ok || re.Message != "Sorry. Invalid username or password." {
+		t.Fatalf("Expected to be rejected with a reason, got %v", err)
+	}
+
+	c = &Client{
+		Addr:       serverAddr,
+		Username:   "i-r0k",
+		Credential: "hunter2",
+	}
+
+	err = c.Connect()
+	if err != nil {
+		t.Fatal("Client with the right password couldn't connect:", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gns-tls")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+
+	ts, err := New(Options{
+		Name:       "TLS Test Server",
+		Addr:       "localhost:3446",
+		AssetsDir:  files,
+		AssetsAddr: "localhost:3555",
+		TLS: &TLSOptions{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: certFile,
+		},
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	go ts.Go()
+	defer ts.Shutdown(context.Background())
+
+	<-ts.Ready
+	<-ts.Assets.Ready
+
+	conf, err := ClientTLSConfig(certFile, certFile, keyFile)
+	if err != nil {
+		t.Fatal("Couldn't load client TLS configuration:", err)
+	}
+
+	tc := &Client{
+		Addr:       ts.Opts.Addr,
+		AssetsAddr: ts.Opts.AssetsAddr,
+		Username:   "daito",
+		TLS:        conf,
+	}
+
+	err = tc.Connect()
+	if err != nil {
+		t.Fatal("Client could not connect over TLS:", err)
+	}
+
+	r, err := tc.Asset("main")
+	if err != nil {
+		t.Fatal("Client could not retrieve asset over TLS:", err)
+	}
+
+	buf := bytes.Buffer{}
+	buf.ReadFrom(r)
+
+	if buf.String() != "<room></room>\n" {
+		t.Fatalf("Asset is not the same over TLS!")
+	}
+
+	// Without a client certificate the handshake should be refused.
+	anon, err := ClientTLSConfig(certFile, "", "")
+	if err != nil {
+		t.Fatal("Couldn't load client TLS configuration:", err)
+	}
+
+	conn, err := tls.Dial(ConnectionType, ts.Opts.AssetsAddr, anon)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	if err == nil {
+		t.Fatal("Server accepted a client without a certificate")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ss, err := New(Options{
+		Name:           "Shutdown Test Server",
+		Addr:           "localhost:3447",
+		AssetsDir:      files,
+		AssetsAddr:     "localhost:3556",
+		UnreliableAddr: "localhost:3666",
+		WebSocketAddr:  "localhost:3777",
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- ss.Go() }()
+
+	<-ss.Ready
+	<-ss.Assets.Ready
+	<-ss.Unreliable.Ready
+	<-ss.WebSocket.Ready
+
+	var cs []*Client
+	for _, u := range []string{"aech", "shoto"} {
+		c := &Client{Addr: ss.Opts.Addr, AssetsAddr: ss.Opts.AssetsAddr, Username: u}
+
+		err := c.Connect()
+		if err != nil {
+			t.Fatal("Client could not connect:", err)
+		}
+
+		cs = append(cs, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = ss.Shutdown(ctx)
+	if err != nil {
+		t.Fatal("Server didn't shut down cleanly:", err)
+	}
+
+	for _, c := range cs {
+		sc := ServerClosing{}
+
+		err := c.ExpectAndRead(ServerClosingCmd, &sc)
+		if err != nil || sc.Message == "" {
+			t.Fatalf("%v wasn't told the server was closing: %v", c.Username, err)
+		}
+	}
+
+	if err := <-stopped; err != ErrServerClosed {
+		t.Fatal("Expected Go to return ErrServerClosed, got:", err)
+	}
+
+	_, err = net.Dial(ConnectionType, ss.Opts.Addr)
+	if err == nil {
+		t.Fatal("Server is still accepting connections")
+	}
+}
+
+func TestHotReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gns-assets")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	room := filepath.Join(dir, "room.gsml")
+	ioutil.WriteFile(room, []byte("<room></room>\n"), 0644)
+
+	hs, err := New(Options{
+		Name:        "Hot Reload Test Server",
+		Addr:        "localhost:3448",
+		AssetsDir:   dir,
+		AssetsAddr:  "localhost:3559",
+		WatchAssets: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	go hs.Go()
+	defer hs.Shutdown(context.Background())
+
+	<-hs.Ready
+	<-hs.Assets.Ready
+
+	hc := &Client{Addr: hs.Opts.Addr, Username: "i-r0k"}
+
+	err = hc.Connect()
+	if err != nil {
+		t.Fatal("Client could not connect:", err)
+	}
+
+	ep, err := hc.Environment()
+	if err != nil {
+		t.Fatal("Client could not get environment:", err)
+	}
+
+	if ep.AssetKeys["world"] != "flattened/room.gsml" {
+		t.Fatal("Expected the world to be the flattened room, got:", ep.AssetKeys["world"])
+	}
+
+	ioutil.WriteFile(room, []byte("<room><box></box></room>\n"), 0644)
+
+	ec := EnvironmentChanged{}
+
+	err = hc.ExpectAndRead(EnvironmentChangedCmd, &ec)
+	if err != nil {
+		t.Fatal("Client wasn't told the environment changed:", err)
+	}
+
+	if ec.Version <= ep.Version || strings.Join(ec.Changed, ",") != "flattened/room.gsml,room.gsml" {
+		t.Fatalf("Unexpected change after version %v: %+v", ep.Version, ec)
+	}
+
+	changed, err := hc.Environment()
+	if err != nil {
+		t.Fatal("Client could not get the new environment:", err)
+	}
+
+	if changed.Version != ec.Version || changed.Assets["room.gsml"].Hash == ep.Assets["room.gsml"].Hash {
+		t.Fatalf("Environment wasn't updated: %+v", changed)
+	}
+
+	// A broken file is left out until it's fixed.
+	ioutil.WriteFile(room, []byte("<room><box></room>\n"), 0644)
+	time.Sleep(100 * time.Millisecond)
+
+	if hs.EnvironmentVersion() != ec.Version {
+		t.Fatal("Environment was reloaded with a broken GSML file")
+	}
+
+	// Changes made while it's broken go out once it's fixed.
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("remember the box\n"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(room, []byte("<room><box></box><box></box></room>\n"), 0644)
+
+	err = hc.ExpectAndRead(EnvironmentChangedCmd, &ec)
+	if err != nil {
+		t.Fatal("Client wasn't told the environment changed:", err)
+	}
+
+	if strings.Join(ec.Changed, ",") != "flattened/room.gsml,notes.txt,room.gsml" {
+		t.Fatalf("Change made while the room was broken was lost: %+v", ec)
+	}
+}
+
+func TestRescanAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gns-assets")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "model.obj")
+	ioutil.WriteFile(file, []byte("v 0 0 0\n"), 0644)
+
+	m, err := ScanAssets(dir)
+	if err != nil {
+		t.Fatal("Couldn't scan assets:", err)
+	}
+
+	// A file which hasn't been touched isn't read again, so a made up hash
+	// sticks.
+	ai := m.Assets["model.obj"]
+	ai.Hash = "unread"
+	m.Assets["model.obj"] = ai
+
+	m, err = rescanAssets(dir, m)
+	if err != nil {
+		t.Fatal("Couldn't rescan assets:", err)
+	}
+
+	if m.Assets["model.obj"].Hash != "unread" {
+		t.Fatal("Unchanged file was hashed again")
+	}
+
+	ioutil.WriteFile(file, []byte("v 0 0 0\nv 1 0 0\n"), 0644)
+
+	m, err = rescanAssets(dir, m)
+	if err != nil {
+		t.Fatal("Couldn't rescan assets:", err)
+	}
+
+	if m.Assets["model.obj"].Hash != hashOf([]byte("v 0 0 0\nv 1 0 0\n")) {
+		t.Fatal("Changed file wasn't hashed again")
+	}
+}
+
+func TestHTTPAssetMetrics(t *testing.T) {
+	as := NewAssetServer("", files)
+	as.Metrics = NewMetrics()
+
+	get := func(key string, h map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+key, nil)
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		as.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := get("main", nil)
+	if w.Code != http.StatusOK {
+		t.Fatal("Couldn't get asset:", w.Code)
+	}
+
+	get("main", map[string]string{"If-None-Match": w.Header().Get("ETag")})
+	get("missing", nil)
+
+	w = httptest.NewRecorder()
+	as.Metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := []string{
+		`gns_asset_requests_total{result="ok"} 1`,
+		`gns_asset_requests_total{result="not_modified"} 1`,
+		`gns_asset_requests_total{result="not_found"} 1`,
+		fmt.Sprint("gns_asset_transfer_bytes_sum ", len("<room></room>\n")),
+	}
+
+	for _, m := range want {
+		if !strings.Contains(w.Body.String(), "\n"+m+"\n") {
+			t.Fatal("Metrics are missing:", m)
+		}
+	}
+}
+
+func TestChangedAsset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gns-assets")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "model.obj")
+	ioutil.WriteFile(file, []byte("v 0 0 0\n"), 0644)
+
+	as := NewAssetServer("", dir)
+
+	err = as.Scan()
+	if err != nil {
+		t.Fatal("Couldn't scan assets:", err)
+	}
+
+	ai := as.Manifest().Assets["model.obj"]
+
+	get := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		as.ServeHTTP(w, httptest.NewRequest("GET", "/"+key, nil))
+
+		return w
+	}
+
+	w := get(HashKeyPrefix + ai.Hash)
+	if w.Code != http.StatusOK || w.Body.String() != "v 0 0 0\n" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("Unexpected response: %v %q %v", w.Code, w.Body, w.Header())
+	}
+
+	// Same size and time, so it looks untouched.
+	fi, _ := os.Stat(file)
+	ioutil.WriteFile(file, []byte("v 1 1 1\n"), 0644)
+	os.Chtimes(file, fi.ModTime(), fi.ModTime())
+
+	w = get(HashKeyPrefix + ai.Hash)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Changed file was served under its old hash: %v %q", w.Code, w.Body)
+	}
+
+	ioutil.WriteFile(file, []byte("v 0 0 0\nv 1 0 0\n"), 0644)
+
+	w = get("model.obj")
+	if w.Code != http.StatusOK || w.Body.String() != "v 0 0 0\nv 1 0 0\n" {
+		t.Fatalf("Changed file wasn't served by its key: %v %q", w.Code, w.Body)
+	}
+
+	if w.Header().Get("ETag") == `"`+ai.Hash+`"` || w.Header().Get("Cache-Control") != "" {
+		t.Fatal("Changed file was served as if it hadn't changed:", w.Header())
+	}
+}
+
+func TestBrokenRoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gns-assets")
+	if err != nil {
+		t.Fatal("Couldn't create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "room.gsml"), []byte("<room>\n  <box x=\"left\"/>\n</room>\n"), 0644)
+
+	bs, err := New(Options{
+		Name:       "Broken Test Server",
+		Addr:       "localhost:3449",
+		AssetsDir:  dir,
+		AssetsAddr: "localhost:3560",
+	})
+	if err != nil {
+		t.Fatal("Couldn't create server:", err)
+	}
+
+	err = bs.Go()
+
+	if ge, ok := err.(*GSMLError); !ok || ge.Key != "room.gsml" {
+		t.Fatal("Expected the server to refuse to start with a broken room, got:", err)
+	}
+
+	if !strings.Contains(err.Error(), "room.gsml:2:") {
+		t.Fatal("Error doesn't say where the problem is:", err)
+	}
+}
+
+// writeTestCert creates a self signed certificate for localhost which can
+// also act as its own CA and client certificate.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Couldn't generate key:", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Couldn't create certificate:", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Couldn't marshal key:", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Shutdown stops the server gracefully. It stops accepting connections, tells
+// every player the server is going away once whatever was already being
+// broadcast has gone out, then closes every connection and waits for the
+// server's goroutines to finish. If ctx ends first, Shutdown returns its error
+// without waiting any longer.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsLock.Lock()
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.connsLock.Unlock()
+
+	s.ln.Close()
+	s.adminLn.Close()
+	s.statusLn.Close()
+	s.metricsLn.Close()
+	s.Assets.Close()
+
+	if s.Unreliable != nil {
+		s.Unreliable.Close()
+	}
+
+	if s.WebSocket != nil {
+		s.WebSocket.Close()
+	}
+
+	var err error
+
+	for _, r := range s.Rooms() {
+		err = r.drain(ctx)
+		if err != nil {
+			break
+		}
+	}
+
+	s.stopOnce.Do(func() { close(s.done) })
+
+	s.connsLock.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.connsLock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// serve runs one of the server's listeners in the background.
+func (s *Server) serve(name string, listen func() error) {
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		err := listen()
+		if err != nil && err != ErrServerClosed {
+			s.log.Printf("%v stopped: %v", name, err)
+		}
+	}()
+}
+
+// track keeps hold of a connection so Shutdown can close it. It returns false
+// if the server is already shutting down, in which case the connection should
+// be dropped.
+func (s *Server) track(c *ComConn) bool {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	select {
+	case <-s.closing:
+		return false
+	default:
+	}
+
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+
+	return true
+}
+
+func (s *Server) untrack(c *ComConn) {
+	s.connsLock.Lock()
+	delete(s.conns, c)
+	s.connsLock.Unlock()
+
+	s.wg.Done()
+}
+
+// drain sends the room the going away notice after every broadcast already
+// queued, then waits for it to be delivered.
+func (r *Room) drain(ctx context.Context) error {
+	b := Broadcast{
+		Cmd:  ServerClosingCmd,
+		Com:  &ServerClosing{Message: "The server is shutting down."},
+		last: true,
+	}
+
+	select {
+	case r.Broadcast <- b:
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		<-r.stopped
+		r.sends.Wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// listener remembers an open listener so that it can be closed from another
+// goroutine, even before it has been opened.
+type listener struct {
+	ln     net.Listener
+	closed bool
+	lock   sync.Mutex
+}
+
+// set stores the listener, closing it straight away if Close was called first.
+func (l *listener) set(ln net.Listener) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		ln.Close()
+		return ErrServerClosed
+	}
+
+	l.ln = ln
+
+	return nil
+}
+
+func (l *listener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+
+	if l.ln == nil {
+		return nil
+	}
+
+	return l.ln.Close()
+}
+
+// err turns the error from a failed Accept into ErrServerClosed if that's
+// because the listener was closed.
+func (l *listener) err(err error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return ErrServerClosed
+	}
+
+	return err
+}
@@ -0,0 +1,166 @@
+package server
+
+const (
+	// maxUnackedSnapshots is how many snapshots are kept around waiting for
+	// an acknowledgement before the oldest are forgotten.
+	maxUnackedSnapshots = 32
+)
+
+type snapshotView map[NodeRef]NodeState
+
+// snapshotHistory remembers what was sent to a player so that each snapshot
+// only needs to hold what changed since the last one they acknowledged.
+type snapshotHistory struct {
+	seq   uint64
+	acked uint64
+	sent  map[uint64]snapshotView
+}
+
+func newSnapshotHistory() *snapshotHistory {
+	return &snapshotHistory{
+		sent: make(map[uint64]snapshotView),
+	}
+}
+
+// next diffs the view against the acknowledged base. It returns false if
+// there is nothing new to send.
+func (h *snapshotHistory) next(view snapshotView) (Snapshot, bool) {
+	sn := Snapshot{}
+
+	base, ok := h.sent[h.acked]
+	if ok {
+		sn.Base = h.acked
+	}
+
+	for k, ns := range view {
+		old, ok := base[k]
+		if !ok || old != ns {
+			sn.Nodes = append(sn.Nodes, ns)
+		}
+	}
+
+	for k := range base {
+		if _, ok := view[k]; !ok {
+			sn.Removed = append(sn.Removed, k)
+		}
+	}
+
+	if sn.Base != 0 && len(sn.Nodes) == 0 && len(sn.Removed) == 0 {
+		return sn, false
+	}
+
+	h.seq += 1
+	sn.Seq = h.seq
+	h.sent[h.seq] = view
+
+	if old := h.seq - maxUnackedSnapshots; old > h.acked {
+		delete(h.sent, old)
+	}
+
+	return sn, true
+}
+
+func (h *snapshotHistory) ack(seq uint64) {
+	if _, ok := h.sent[seq]; !ok || seq <= h.acked {
+		return
+	}
+
+	for s := range h.sent {
+		if s < seq {
+			delete(h.sent, s)
+		}
+	}
+
+	h.acked = seq
+}
+
+// view is everything the player should know about. It goes through interest
+// management in the same way individual updates do.
+func (r *Room) view(p *Player, ps []*Player) snapshotView {
+	view := make(snapshotView)
+
+	for _, o := range ps {
+		o.nodesLock.RLock()
+		for _, n := range o.Nodes {
+			ns := NodeState{
+				NodeRef:  NodeRef{PID: o.ID, NID: n.ID},
+				Position: n.Position,
+				Rotation: n.Rotation,
+			}
+
+			if r.interest != nil {
+				un := &UpdateNode{PID: o.ID, NID: n.ID, Position: n.Position}
+				if see, _ := r.interest.Recipients(un, []*Player{p}); len(see) == 0 {
+					continue
+				}
+			}
+
+			view[ns.NodeRef] = ns
+		}
+		o.nodesLock.RUnlock()
+	}
+
+	return view
+}
+
+// sendSnapshots is called every tick to send each player who asked for
+// snapshots whatever has changed.
+func (r *Room) sendSnapshots() {
+	ps := r.members()
+
+	for _, p := range ps {
+		if !p.Snapshots || p.Conn.Closed {
+			continue
+		}
+
+		view := r.view(p, ps)
+
+		p.snapshotsLock.Lock()
+		sn, ok := p.snapshots.next(view)
+		p.snapshotsLock.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		go func(p *Player) {
+			err := p.Conn.Send(SnapshotCmd, &sn)
+			if err != nil {
+				p.Conn.Close()
+			}
+		}(p)
+	}
+}
+
+func (r *Room) snapshotAck(conn *ChildConn) error {
+	sa := SnapshotAck{}
+
+	err := conn.Read(&sa)
+	if err != nil {
+		return err
+	}
+
+	p := conn.Parent().Player()
+	if p == nil {
+		return ErrPlayerNotConnected
+	}
+
+	p.snapshotsLock.Lock()
+	p.snapshots.ack(sa.Seq)
+	p.snapshotsLock.Unlock()
+
+	return nil
+}
+
+// withoutSnapshots drops the players who get node updates through snapshots.
+func withoutSnapshots(ps []*Player) []*Player {
+	out := ps[:0]
+
+	for _, p := range ps {
+		if !p.Snapshots {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultPingInterval = 5 * time.Second
+
+// ServerStatus is what the status API says the server is doing.
+type ServerStatus struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	StartedAt   time.Time    `json:"started_at"`
+	Uptime      float64      `json:"uptime"` // In seconds.
+	Players     int          `json:"players"`
+	Rooms       []RoomStatus `json:"rooms"`
+	Assets      AssetStats   `json:"assets"`
+}
+
+type RoomStatus struct {
+	ID      uint           `json:"id"`
+	Name    string         `json:"name"`
+	Main    string         `json:"main"`
+	Players []PlayerStatus `json:"players"`
+}
+
+type PlayerStatus struct {
+	ID       uint    `json:"id"`
+	Username string  `json:"username"`
+	IP       string  `json:"ip"`
+	Nodes    int     `json:"nodes"`
+	Ping     float64 `json:"ping"` // Round trip in milliseconds, zero until the client has answered a ping.
+	Muted    bool    `json:"muted"`
+}
+
+type AssetStats struct {
+	Dir   string `json:"dir"`
+	Count int    `json:"count"`
+	Size  int64  `json:"size"` // Of every asset together, in bytes.
+}
+
+// Status describes the server, its rooms and everyone in them.
+func (s *Server) Status() ServerStatus {
+	ss := ServerStatus{
+		Name:        s.Opts.Name,
+		Description: s.Opts.Description,
+		Rooms:       []RoomStatus{},
+		Assets:      AssetStats{Dir: string(s.Assets.Dir)},
+	}
+
+	if !s.started.IsZero() {
+		ss.StartedAt = s.started
+		ss.Uptime = time.Since(s.started).Seconds()
+	}
+
+	for _, r := range s.Rooms() {
+		rs := RoomStatus{
+			ID:      r.ID,
+			Name:    r.Opts.Name,
+			Main:    r.Opts.Main,
+			Players: []PlayerStatus{},
+		}
+
+		ps := r.members()
+		sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+
+		for _, p := range ps {
+			p.nodesLock.RLock()
+			nodes := len(p.Nodes)
+			p.nodesLock.RUnlock()
+
+			rs.Players = append(rs.Players, PlayerStatus{
+				ID:       p.ID,
+				Username: p.Username,
+				IP:       p.IP(),
+				Nodes:    nodes,
+				Ping:     float64(p.Ping()) / float64(time.Millisecond),
+				Muted:    p.Muted(),
+			})
+		}
+
+		ss.Players += len(rs.Players)
+		ss.Rooms = append(ss.Rooms, rs)
+	}
+
+	for _, ai := range s.Assets.Assets() {
+		ss.Assets.Count++
+		ss.Assets.Size += ai.Size
+	}
+
+	return ss
+}
+
+// Announce sends a message from the server to everyone in the room.
+func (r *Room) Announce(message string) {
+	r.broadcast(Broadcast{
+		Cmd: ServerMessageCmd,
+		Com: &ServerMessage{Message: message},
+	})
+}
+
+// Announce sends a message from the server to everyone on it.
+func (s *Server) Announce(message string) {
+	for _, r := range s.Rooms() {
+		r.Announce(message)
+	}
+}
+
+// KickRequest is posted to /kick.
+type KickRequest struct {
+	PID    uint   `json:"pid"`
+	Reason string `json:"reason"`
+}
+
+// BroadcastRequest is posted to /broadcast. Room is the ID of the room to send
+// the message to, or zero for every room.
+type BroadcastRequest struct {
+	Message string `json:"message"`
+	Room    uint   `json:"room"`
+}
+
+// StatusHandler serves the status API:
+//
+//	GET  /status     The ServerStatus.
+//	POST /kick       Kick a player, given a KickRequest.
+//	POST /broadcast  Send a message to players, given a BroadcastRequest.
+//
+// POSTs need an "Authorization: Bearer <token>" header with the server's
+// StatusToken, and are refused without one set.
+func (s *Server) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, s.Status())
+	})
+
+	mux.HandleFunc("/kick", s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		kr := KickRequest{}
+
+		if !readJSON(w, r, &kr) {
+			return
+		}
+
+		if kr.Reason == "" {
+			kr.Reason = "Kicked by an operator."
+		}
+
+		for _, p := range s.players() {
+			if r := p.Room(); r != nil && p.ID == kr.PID {
+				r.Kick(p.ID, kr.Reason)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		http.Error(w, ErrPlayerDoesntExist.Error(), http.StatusNotFound)
+	}))
+
+	mux.HandleFunc("/broadcast", s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		br := BroadcastRequest{}
+
+		if !readJSON(w, r, &br) {
+			return
+		}
+
+		if strings.TrimSpace(br.Message) == "" {
+			http.Error(w, "Message is empty", http.StatusBadRequest)
+			return
+		}
+
+		if br.Room == 0 {
+			s.Announce(br.Message)
+		} else {
+			room, err := s.Room(br.Room)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			room.Announce(br.Message)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	return mux
+}
+
+// authorized only lets POSTs with the status token through to the handler.
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if s.Opts.StatusToken == "" {
+			http.Error(w, "No status token is set, so nothing can be changed", http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Opts.StatusToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJSON decodes the request's body, replying with why if it can't.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(v)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// listenHTTP opens the listener for one of the server's HTTP APIs up front,
+// so a bad address stops the server from starting.
+func (s *Server) listenHTTP(addr string, conf *tls.Config, l *listener) error {
+	ln, err := listen(addr, conf)
+	if err != nil {
+		return err
+	}
+
+	return l.set(ln)
+}
+
+// serveHTTP returns a function which serves the handler on the listener until
+// the server shuts down.
+func (s *Server) serveHTTP(l *listener, h http.Handler) func() error {
+	return func() error {
+		srv := &http.Server{
+			Handler:           h,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func() {
+			<-s.closing
+			srv.Close()
+		}()
+
+		err := srv.Serve(l.ln)
+		if err == http.ErrServerClosed {
+			return ErrServerClosed
+		}
+
+		return l.err(err)
+	}
+}
+
+// pingPlayers pings every player whose client asked for it on the interval, to
+// keep their round trip times up to date.
+func (s *Server) pingPlayers(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		for _, p := range s.players() {
+			if p.Pings {
+				s.sendPing(p)
+			}
+		}
+	}
+}
+
+// sendPing pings the player with a fresh nonce, remembering when it was sent.
+// Only the server's clock is used, so clients can't make up their round trip.
+func (s *Server) sendPing(p *Player) {
+	var b [8]byte
+
+	_, err := rand.Read(b[:])
+	if err != nil {
+		s.log.Println("Couldn't make a ping nonce:", err)
+		return
+	}
+
+	p.pingLock.Lock()
+	p.pingNonce = binary.LittleEndian.Uint64(b[:])
+	p.pingSent = time.Now()
+	pi := Ping{Nonce: p.pingNonce}
+	p.pingLock.Unlock()
+
+	// Write straight out, so waiting for the room's next tick isn't counted
+	// in the round trip.
+	p.Conn.Raw.Send(PingCmd, &pi)
+}
+
+// pong records the round trip of a ping the server sent.
+func (s *Server) pong(conn *ChildConn) error {
+	po := Pong{}
+
+	err := conn.Read(&po)
+	if err != nil {
+		return err
+	}
+
+	p := conn.Parent().Player()
+	if p == nil {
+		return ErrPlayerNotConnected
+	}
+
+	p.pingLock.Lock()
+	defer p.pingLock.Unlock()
+
+	// Pongs for pings which were never sent, or have been answered already,
+	// are ignored.
+	if po.Nonce == 0 || po.Nonce != p.pingNonce {
+		return nil
+	}
+
+	p.pingNonce = 0
+	p.ping = time.Since(p.pingSent)
+
+	return nil
+}
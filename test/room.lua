@@ -0,0 +1,25 @@
+-- Used by TestScript.
+local joined = 0
+
+function on_join(player)
+  joined = joined + 1
+  room.send(player.id, "welcome", {name = player.username, joined = joined})
+end
+
+room.command("spin", function(player, args)
+  local id = room.spawn({asset = "top.obj", y = tonumber(args.height)})
+  room.broadcast("spun", {id = id, by = player.username})
+end)
+
+room.command("hang", function()
+  while true do end
+end)
+
+room.command("recurse", function()
+  local function f() return f() + 1 end
+  return f()
+end)
+
+room.command("escape", function()
+  return loadfile("room.lua")
+end)
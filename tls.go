@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+// TLSOptions turns on TLS for the game, asset and WebSocket listeners.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile makes clients present a certificate signed by one of the
+	// CAs in the file. Leave empty to let any client connect.
+	ClientCAFile string
+}
+
+// Config loads the certificates. It returns nil if o is nil, meaning the
+// listeners stay in plaintext.
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if o.ClientCAFile != "" {
+		conf.ClientCAs, err = loadCertPool(o.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// ClientTLSConfig builds the TLS configuration for a Client. An empty caFile
+// trusts the system's CAs, and the certificate is only needed for servers
+// which verify clients.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	var err error
+
+	if caFile != "" {
+		conf.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + file)
+	}
+
+	return pool, nil
+}
+
+// listen opens a listener, wrapped in TLS if there's a configuration for it.
+func listen(addr string, conf *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen(ConnectionType, addr)
+	if err != nil || conf == nil {
+		return ln, err
+	}
+
+	return tls.NewListener(ln, conf), nil
+}
+
+// dial connects to a listener made by listen.
+func dial(addr string, conf *tls.Config) (net.Conn, error) {
+	if conf == nil {
+		return net.Dial(ConnectionType, addr)
+	}
+
+	return tls.Dial(ConnectionType, addr, conf)
+}
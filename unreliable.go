@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	UnreliableConnectionType = "udp"
+
+	maxDatagramSize = 64 * 1024
+
+	// updateQueue is how many node updates from one player can be waiting
+	// to be applied before new ones are dropped.
+	updateQueue = 64
+
+	// updateBurst is how many updates for one node can arrive at once
+	// before they're held to the server's ReadSpeed.
+	updateBurst = 10
+)
+
+// Datagram is the only message sent over the unreliable channel. It is always
+// encoded with the binary codec. A datagram without a node ID or voice is a
+// hello, which tells the server where to send updates back to.
+type Datagram struct {
+	Token  string      `json:"token"`
+	Seq    uint64      `json:"seq"`
+	Update UpdateNode  `json:"update"`
+	Voice  *VoiceFrame `json:"voice"`
+}
+
+// UnreliableServer carries high frequency node updates over UDP so that a
+// lost packet doesn't hold up every update after it. Everything else stays on
+// the reliable connection.
+type UnreliableServer struct {
+	Addr  string
+	Ready chan struct{}
+
+	s       *Server
+	conn    *net.UDPConn
+	closed  bool
+	voice   chan voicePacket
+	stopped chan struct{} // Closed with the server.
+
+	channels     map[string]*unreliableChannel // By token.
+	players      map[uint]*unreliableChannel   // By player ID.
+	channelsLock sync.RWMutex
+
+	l *log.Logger
+}
+
+type unreliableChannel struct {
+	token  string
+	player *Player
+
+	addr    *net.UDPAddr // Learnt from the first datagram the client sends.
+	lastSeq map[uint]uint64
+	sendSeq uint64
+	voice   chatLimiter
+	nodes   map[uint]*chatLimiter // Update rate, by node ID.
+	lock    sync.Mutex
+
+	updates chan UpdateNode
+	done    chan struct{} // Closed when the channel is forgotten.
+}
+
+func NewUnreliableServer(s *Server, addr string) *UnreliableServer {
+	return &UnreliableServer{
+		Addr:     addr,
+		Ready:    make(chan struct{}),
+		s:        s,
+		channels: make(map[string]*unreliableChannel),
+		players:  make(map[uint]*unreliableChannel),
+		voice:    make(chan voicePacket, voiceQueue),
+		stopped:  make(chan struct{}),
+		l:        log.New(os.Stdout, "unreliable: ", logFlags),
+	}
+}
+
+func (u *UnreliableServer) Listen() error {
+	addr, err := net.ResolveUDPAddr(UnreliableConnectionType, u.Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP(UnreliableConnectionType, addr)
+	if err != nil {
+		return err
+	}
+
+	u.channelsLock.Lock()
+	closed := u.closed
+	u.conn = conn
+	u.channelsLock.Unlock()
+
+	if closed {
+		conn.Close()
+		return ErrServerClosed
+	}
+
+	go func() { u.Ready <- struct{}{} }()
+	go u.relayLoop()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			u.channelsLock.RLock()
+			closed := u.closed
+			u.channelsLock.RUnlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		d := Datagram{}
+
+		err = BinaryCodec.Unmarshal(buf[:n], &d)
+		if err != nil {
+			u.l.Println("Dropping malformed datagram:", err)
+			continue
+		}
+
+		err = u.handle(d, from)
+		if err != nil {
+			u.l.Println("Couldn't handle datagram:", err)
+		}
+	}
+}
+
+// Close stops the server from sending or receiving datagrams.
+func (u *UnreliableServer) Close() error {
+	u.channelsLock.Lock()
+	defer u.channelsLock.Unlock()
+
+	if !u.closed {
+		u.closed = true
+		close(u.stopped)
+	}
+
+	if u.conn == nil {
+		return nil
+	}
+
+	return u.conn.Close()
+}
+
+// Open creates a channel for the player and returns the token the client has
+// to put in every datagram.
+func (u *UnreliableServer) Open(p *Player) (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	ch := &unreliableChannel{
+		token:   hex.EncodeToString(b),
+		player:  p,
+		lastSeq: make(map[uint]uint64),
+		nodes:   make(map[uint]*chatLimiter),
+		updates: make(chan UpdateNode, updateQueue),
+		done:    make(chan struct{}),
+	}
+
+	u.Forget(p.ID)
+
+	u.channelsLock.Lock()
+	u.channels[ch.token] = ch
+	u.players[p.ID] = ch
+	u.channelsLock.Unlock()
+
+	go u.updateLoop(ch)
+
+	return ch.token, nil
+}
+
+// Forget closes the player's channel, if they have one.
+func (u *UnreliableServer) Forget(pid uint) {
+	u.channelsLock.Lock()
+	defer u.channelsLock.Unlock()
+
+	ch, ok := u.players[pid]
+	if !ok {
+		return
+	}
+
+	delete(u.channels, ch.token)
+	delete(u.players, pid)
+	close(ch.done)
+}
+
+// Send delivers an update to the player over their channel. It fails if the
+// player hasn't got a channel or hasn't said hello yet, in which case the
+// update should go over the reliable connection instead.
+func (u *UnreliableServer) Send(pid uint, un UpdateNode) error {
+	un.Prepare(UpdateNodeCmd)
+
+	return u.write(pid, Datagram{Update: un})
+}
+
+// write fills in the player's token and the next sequence number, and sends
+// the datagram to them.
+func (u *UnreliableServer) write(pid uint, d Datagram) error {
+	u.channelsLock.RLock()
+	ch, ok := u.players[pid]
+	conn := u.conn
+	u.channelsLock.RUnlock()
+
+	if !ok || conn == nil {
+		return ErrNoUnreliableChannel
+	}
+
+	ch.lock.Lock()
+	addr := ch.addr
+	ch.sendSeq += 1
+	seq := ch.sendSeq
+	ch.lock.Unlock()
+
+	if addr == nil {
+		return ErrNoUnreliableChannel
+	}
+
+	d.Token = ch.token
+	d.Seq = seq
+
+	out, err := BinaryCodec.Marshal(&d)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.WriteToUDP(out, addr)
+	return err
+}
+
+func (u *UnreliableServer) handle(d Datagram, from *net.UDPAddr) error {
+	u.channelsLock.RLock()
+	ch, ok := u.channels[d.Token]
+	u.channelsLock.RUnlock()
+
+	if !ok {
+		return ErrInvalidToken
+	}
+
+	ch.lock.Lock()
+	ch.addr = from
+
+	if d.Voice != nil {
+		o := u.s.Opts.Voice
+		ok := ch.voice.allow(time.Now(), o.Rate, o.Burst)
+		ch.lock.Unlock()
+
+		// Like datagrams lost on the way, frames over the rate are dropped
+		// without a word.
+		if !ok {
+			return nil
+		}
+
+		return u.queueVoice(ch.player, d.Seq, d.Voice.Data)
+	}
+
+	if d.Update.NID == 0 {
+		ch.lock.Unlock()
+		return nil
+	}
+
+	// Only the player's own nodes are tracked, so made up IDs can't pile
+	// up.
+	p := ch.player
+	p.nodesLock.RLock()
+	_, ok = p.nodesMap[d.Update.NID]
+	p.nodesLock.RUnlock()
+
+	if !ok {
+		ch.lock.Unlock()
+		return ErrNodeDoesntExist
+	}
+
+	// Sequence numbers only ever go up, so anything older than the last
+	// update for the node is stale.
+	if d.Seq <= ch.lastSeq[d.Update.NID] {
+		ch.lock.Unlock()
+		return nil
+	}
+
+	ch.lastSeq[d.Update.NID] = d.Seq
+
+	l, ok := ch.nodes[d.Update.NID]
+	if !ok {
+		l = &chatLimiter{}
+		ch.nodes[d.Update.NID] = l
+	}
+
+	// Like the reliable connection, updates can't be read any faster than
+	// ReadSpeed. Anything over it is dropped, as voice is.
+	ok = l.allow(time.Now(), u.s.Opts.ReadSpeed, updateBurst)
+	ch.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	// The channel is bound to its player, whatever the datagram says.
+	d.Update.PID = p.ID
+
+	select {
+	case ch.updates <- d.Update:
+	default:
+	}
+
+	return nil
+}
+
+// updateLoop applies the player's queued updates until their channel is
+// forgotten, so a busy room can't hold up reading datagrams from everyone
+// else.
+func (u *UnreliableServer) updateLoop(ch *unreliableChannel) {
+	for {
+		select {
+		case un := <-ch.updates:
+			r := ch.player.Room()
+			if r == nil {
+				continue
+			}
+
+			err := r.UpdateNode(un)
+			if err != nil {
+				u.l.Println("Couldn't update node:", err)
+			}
+		case <-ch.done:
+			return
+		case <-u.stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// Limits are sanity checks applied to every node update in a room. The zero
+// value allows anything.
+type Limits struct {
+	MaxSpeed float64 // Units per second, zero for no limit.
+
+	// Min and Max are opposite corners of the world. Leave both zero for a
+	// world without edges.
+	Min Point
+	Max Point
+
+	// Clamp pulls offending nodes back within the limits instead of
+	// rejecting the update.
+	Clamp bool
+}
+
+func (l Limits) bounded() bool {
+	return l.Min != l.Max
+}
+
+// Place validates a node being put at a point without moving there, such as
+// when it's registered, and returns where it should go.
+func (l Limits) Place(p Point) (Point, error) {
+	if !p.Finite() {
+		return p, ErrNodeNotFinite
+	}
+
+	if l.bounded() && !p.Within(l.Min, l.Max) {
+		if !l.Clamp {
+			return p, ErrNodeOutOfBounds
+		}
+
+		p = p.Clamp(l.Min, l.Max)
+	}
+
+	return p, nil
+}
+
+// Rotate validates a rotation. Any is allowed so long as it's finite, as NaN
+// can't be sent to clients using JSON.
+func (l Limits) Rotate(r Point) error {
+	if !r.Finite() {
+		return ErrNodeNotFinite
+	}
+
+	return nil
+}
+
+// Check validates a node moving from one point to another over dt, and
+// returns where the node should end up.
+func (l Limits) Check(from, to Point, dt time.Duration) (Point, error) {
+	to, err := l.Place(to)
+	if err != nil {
+		return from, err
+	}
+
+	if l.MaxSpeed > 0 {
+		d := from.Distance(to)
+		max := l.MaxSpeed * dt.Seconds()
+
+		if d > max {
+			if !l.Clamp {
+				return from, ErrNodeTooFast
+			}
+
+			to = from.Lerp(to, max/d)
+		}
+	}
+
+	return to, nil
+}
+
+// Finite reports whether none of the point is NaN or infinite.
+func (p Point) Finite() bool {
+	for _, v := range []float64{p.X, p.Y, p.Z} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p Point) Within(min, max Point) bool {
+	return p.X >= math.Min(min.X, max.X) && p.X <= math.Max(min.X, max.X) &&
+		p.Y >= math.Min(min.Y, max.Y) && p.Y <= math.Max(min.Y, max.Y) &&
+		p.Z >= math.Min(min.Z, max.Z) && p.Z <= math.Max(min.Z, max.Z)
+}
+
+func (p Point) Clamp(min, max Point) Point {
+	return Point{
+		X: clamp(p.X, min.X, max.X),
+		Y: clamp(p.Y, min.Y, max.Y),
+		Z: clamp(p.Z, min.Z, max.Z),
+	}
+}
+
+// Lerp moves t of the way from p to q.
+func (p Point) Lerp(q Point, t float64) Point {
+	return Point{
+		X: p.X + (q.X-p.X)*t,
+		Y: p.Y + (q.Y-p.Y)*t,
+		Z: p.Z + (q.Z-p.Z)*t,
+	}
+}
+
+func (p Point) Add(q Point) Point {
+	return Point{X: p.X + q.X, Y: p.Y + q.Y, Z: p.Z + q.Z}
+}
+
+func (p Point) Sub(q Point) Point {
+	return Point{X: p.X - q.X, Y: p.Y - q.Y, Z: p.Z - q.Z}
+}
+
+func clamp(v, a, b float64) float64 {
+	return math.Max(math.Min(a, b), math.Min(v, math.Max(a, b)))
+}
+
+// sender returns the player bound to the connection, making sure it's the one
+// the communication claims to be from.
+func sender(conn *ChildConn, pid uint) (*Player, error) {
+	p := conn.Parent().Player()
+	if p == nil {
+		return nil, ErrPlayerNotConnected
+	}
+
+	if p.ID != pid {
+		return nil, ErrWrongPlayer
+	}
+
+	return p, nil
+}
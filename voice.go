@@ -0,0 +1,171 @@
+package server
+
+const (
+	DefaultVoiceRange     = 20
+	DefaultVoiceReference = 1
+	DefaultVoiceRate      = 60
+	DefaultVoiceBurst     = 10
+
+	// MaxVoiceFrameSize is the largest an Opus frame can be.
+	MaxVoiceFrameSize = 1275
+
+	// voiceQueue is how many frames can be waiting to be relayed before new
+	// ones are dropped.
+	voiceQueue = 256
+)
+
+// VoiceOptions control how far players can be heard. The zero value uses the
+// defaults.
+type VoiceOptions struct {
+	// Range is how far a player's voice carries from their head. Listeners
+	// any further away don't get it at all.
+	Range float64
+
+	// Reference is how close listeners have to be to hear a player at full
+	// volume. Further away, the volume falls off with the distance.
+	Reference float64
+
+	// Rate is how many frames a second each player can send, with up to
+	// Burst at once. Frames over the rate are dropped.
+	Rate  float64
+	Burst int
+}
+
+func (o *VoiceOptions) defaults() {
+	if o.Range == 0 {
+		o.Range = DefaultVoiceRange
+	}
+
+	if o.Reference == 0 {
+		o.Reference = DefaultVoiceReference
+	}
+
+	if o.Rate == 0 {
+		o.Rate = DefaultVoiceRate
+	}
+
+	if o.Burst == 0 {
+		o.Burst = DefaultVoiceBurst
+	}
+}
+
+// gain is how loud a player should be at the distance, or false if they're
+// too far away to hear.
+func (o VoiceOptions) gain(d float64) (float64, bool) {
+	if d > o.Range {
+		return 0, false
+	}
+
+	if d <= o.Reference {
+		return 1, true
+	}
+
+	return o.Reference / d, true
+}
+
+// VoiceFrame is a frame of Opus encoded audio. The server doesn't look inside
+// frames, it only works out who should hear them and how loudly.
+//
+// Clients send frames over the unreliable channel with only Data set. The
+// server relays them to everyone in range with PID set to the speaker, Seq to
+// the speaker's sequence number, so frames can be put back in order, and Gain
+// to the volume they should be played at.
+type VoiceFrame struct {
+	PID  uint    `json:"pid"`
+	Seq  uint64  `json:"seq"`
+	Gain float64 `json:"gain"`
+	Data []byte  `json:"data"`
+}
+
+// voicePacket is a frame waiting to be relayed.
+type voicePacket struct {
+	speaker *Player
+	seq     uint64
+	data    []byte
+}
+
+// queueVoice puts a frame from the speaker in line to be relayed, dropping it
+// if the queue is full, as it would be on a congested network.
+func (u *UnreliableServer) queueVoice(speaker *Player, seq uint64, data []byte) error {
+	if len(data) > MaxVoiceFrameSize {
+		return ErrVoiceFrameTooBig
+	}
+
+	// The read buffer is reused for the next datagram.
+	v := voicePacket{speaker, seq, append([]byte(nil), data...)}
+
+	select {
+	case u.voice <- v:
+	default:
+	}
+
+	return nil
+}
+
+// relayLoop relays queued voice until the server closes, so a room full of
+// listeners can't hold up reading datagrams.
+func (u *UnreliableServer) relayLoop() {
+	for {
+		select {
+		case v := <-u.voice:
+			err := u.relayVoice(v.speaker, v.seq, v.data)
+			if err != nil {
+				u.l.Println("Couldn't relay voice:", err)
+			}
+		case <-u.stopped:
+			return
+		}
+	}
+}
+
+// relayVoice sends a frame from the speaker to everyone in their room close
+// enough to hear it. Voice goes over the unreliable channel only, so it can
+// never hold up anything on the reliable connection.
+func (u *UnreliableServer) relayVoice(speaker *Player, seq uint64, data []byte) error {
+	r := speaker.Room()
+	if r == nil {
+		return ErrPlayerNotConnected
+	}
+
+	if speaker.Muted() {
+		return nil
+	}
+
+	// Without a head there's nowhere to hear the speaker from.
+	h := speaker.Head()
+	if h == nil {
+		return nil
+	}
+
+	o := u.s.Opts.Voice
+
+	for _, p := range r.members() {
+		if p.ID == speaker.ID {
+			continue
+		}
+
+		lh := p.Head()
+		if lh == nil {
+			continue
+		}
+
+		gain, ok := o.gain(h.Position.Distance(lh.Position))
+		if !ok {
+			continue
+		}
+
+		err := u.write(p.ID, Datagram{
+			Voice: &VoiceFrame{
+				PID:  speaker.ID,
+				Seq:  seq,
+				Gain: gain,
+				Data: data,
+			},
+		})
+		if err != nil && err != ErrNoUnreliableChannel {
+			u.l.Printf("Couldn't send voice to %v: %v", p.ID, err)
+		}
+	}
+
+	return nil
+}
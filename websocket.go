@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketServer lets browser clients join the same rooms as native ones.
+// Every WebSocket message carries exactly one communication: text messages
+// are JSON and binary messages start with the tag of the codec they were
+// encoded with.
+type WebSocketServer struct {
+	Addr  string
+	Ready chan struct{}
+	TLS   *tls.Config // Nil for plaintext.
+
+	// Origins are the pages, such as "https://example.com", which may connect
+	// as well as those served from the same host. "*" lets in any page.
+	Origins []string
+
+	s        *Server
+	srv      *http.Server
+	ln       listener
+	upgrader websocket.Upgrader
+	l        *log.Logger
+}
+
+func NewWebSocketServer(s *Server, addr string) *WebSocketServer {
+	ws := &WebSocketServer{
+		Addr:  addr,
+		Ready: make(chan struct{}),
+		s:     s,
+		l:     log.New(os.Stdout, "websocket: ", logFlags),
+	}
+
+	ws.upgrader.CheckOrigin = ws.checkOrigin
+	ws.srv = &http.Server{Handler: ws}
+
+	return ws
+}
+
+func (ws *WebSocketServer) Listen() error {
+	ln, err := listen(ws.Addr, ws.TLS)
+	if err != nil {
+		return err
+	}
+
+	err = ws.ln.set(ln)
+	if err != nil {
+		return err
+	}
+
+	go func() { ws.Ready <- struct{}{} }()
+
+	err = ws.srv.Serve(ws.ln.ln)
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+
+	return ws.ln.err(err)
+}
+
+// Close stops accepting connections. Connections which have already been
+// upgraded are left to the server to close.
+func (ws *WebSocketServer) Close() error {
+	ws.ln.Close()
+
+	return ws.srv.Close()
+}
+
+// checkOrigin lets in pages from the same host as the server or one of its
+// Origins. Requests without an Origin aren't from a browser, so anything
+// could have sent them anyway.
+func (ws *WebSocketServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, o := range ws.Origins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ws *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		ws.l.Println("Couldn't upgrade connection:", err)
+		return
+	}
+
+	// Leave room for the codec tag binary messages start with.
+	if max := ws.s.Opts.MaxFrameSize; max > 0 {
+		c.SetReadLimit(int64(max) + 1)
+	}
+
+	ws.s.Netw.Handle(&wsConn{Conn: c}, ws.s.nextConnID())
+}
+
+// wsConn adapts a WebSocket connection to the framed stream Conn expects, so
+// it can go through the same Networker as TCP connections.
+type wsConn struct {
+	*websocket.Conn
+
+	r io.Reader // Whatever is left of the frame currently being read.
+
+	wbuf  bytes.Buffer
+	wLock sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r != nil {
+			n, err := c.r.Read(p)
+			if err == io.EOF {
+				c.r = nil
+
+				if n == 0 {
+					continue
+				}
+
+				err = nil
+			}
+
+			return n, err
+		}
+
+		typ, msg, err := c.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		c.r = bytes.NewReader(frameMessage(typ, msg))
+	}
+}
+
+func frameMessage(typ int, msg []byte) []byte {
+	if typ == websocket.TextMessage {
+		return append([]byte(fmt.Sprintf("%v\n", len(msg))), msg...)
+	}
+
+	if len(msg) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, 5, 5+len(msg)-1)
+	buf[0] = msg[0]
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg)-1))
+
+	return append(buf, msg[1:]...)
+}
+
+// Write buffers until it has a whole frame, then sends it as one message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	c.wbuf.Write(p)
+
+	for {
+		typ, msg, ok := c.nextFrame()
+		if !ok {
+			return len(p), nil
+		}
+
+		err := c.Conn.WriteMessage(typ, msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *wsConn) nextFrame() (int, []byte, bool) {
+	b := c.wbuf.Bytes()
+	if len(b) == 0 {
+		return 0, nil, false
+	}
+
+	if b[0] >= '0' && b[0] <= '9' {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return 0, nil, false
+		}
+
+		l, err := strconv.Atoi(string(bytes.TrimSpace(b[:i])))
+		if err != nil || len(b) < i+1+l {
+			return 0, nil, false
+		}
+
+		msg := append([]byte(nil), b[i+1:i+1+l]...)
+		c.wbuf.Next(i + 1 + l)
+
+		return websocket.TextMessage, msg, true
+	}
+
+	if len(b) < 5 {
+		return 0, nil, false
+	}
+
+	l := int(binary.BigEndian.Uint32(b[1:5]))
+	if len(b) < 5+l {
+		return 0, nil, false
+	}
+
+	msg := append([]byte{b[0]}, b[5:5+l]...)
+	c.wbuf.Next(5 + l)
+
+	return websocket.BinaryMessage, msg, true
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}